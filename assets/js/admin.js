@@ -50,6 +50,11 @@ try { localStorage.getItem('cookie-ok') && document.querySelector('.cookie-toast
 
 rilti.run(() => {
 
+let csrfToken
+const csrf = window.csrf = () => csrfToken ? Promise.resolve(csrfToken) : fetch('/csrf', {credentials: 'same-origin'})
+  .then(res => res.json())
+  .then(res => (csrfToken = res.token))
+
 const bakeWrit = window.bakeWrit = (writ = {
   title: 'First post',
   slug: 'first-post',
@@ -61,10 +66,11 @@ const bakeWrit = window.bakeWrit = (writ = {
   membersonly: true
 }, fn, errfn) => {
 
-  fetch('/writ', {
+  csrf().then(token => fetch('/writ', {
     method: 'POST',
+    headers: {'X-CSRF-Token': token},
     body: JSON.stringify(writ)
-  }).then(res => res.json(), err => {
+  })).then(res => res.json(), err => {
     console.error(`Writ problem:`, err)
     errfn && errfn(err)
   }).then(res => {
@@ -81,10 +87,11 @@ const bakeWrit = window.bakeWrit = (writ = {
 
 const queryWrits = window.queryWrits = (query = {}, fn) => {
   if (!('editormode' in query)) query.editormode = true
-  fetch('/writ/query', {
+  csrf().then(token => fetch('/writ/query', {
     method: 'POST',
+    headers: {'X-CSRF-Token': token},
     body: JSON.stringify(query)
-  }).then(res => res.json(), err => {
+  })).then(res => res.json(), err => {
     console.error(`Writ Query problem:`, err)
   }).then(res => {
     if (res.err || res.error) return console.error(`Writ Query Problem:`, res.err || res.error)
@@ -0,0 +1,290 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+)
+
+var (
+	// ErrUsernameTaken someone already goes by that name
+	ErrUsernameTaken = errors.New("that username is already taken")
+	// ErrEmailTaken someone already uses that email
+	ErrEmailTaken = errors.New("that email is already in use")
+	// ErrNoEmailChange there's no pending email change to confirm
+	ErrNoEmailChange = errors.New("no pending email change")
+	// DeletedAuthor what writs by deleted users are attributed to
+	DeletedAuthor = "[deleted]"
+)
+
+// EmailChange a pending change of email address, awaiting confirmation from both addresses
+type EmailChange struct {
+	Email        string `json:"email"`
+	OldConfirmed bool   `json:"oldconfirmed,omitempty"`
+	NewConfirmed bool   `json:"newconfirmed,omitempty"`
+}
+
+// Account self-service queries
+var (
+	RenameAuthor = `FOR writ IN writs FILTER writ.authorkey == @key
+		UPDATE writ WITH {author: @username} IN writs OPTIONS {waitForSync: true}
+		RETURN NEW.slug`
+	AnonymizeUserWrits = `FOR writ IN writs
+		FILTER writ.authorkey == @key || @key IN writ.likedby || @key IN writ.viewedby
+		UPDATE writ WITH {
+			author: writ.authorkey == @key ? @deleted : writ.author,
+			authorkey: writ.authorkey == @key ? null : writ.authorkey,
+			likedby: REMOVE_VALUE(writ.likedby, @key),
+			viewedby: REMOVE_VALUE(writ.viewedby, @key),
+			likes: (writ.likes || 0) + (@key IN writ.likedby ? 1 : 0),
+			views: (writ.views || 0) + (@key IN writ.viewedby ? 1 : 0)
+		} IN writs OPTIONS {keepNull: false, waitForSync: true}
+		RETURN NEW.slug`
+	// ScrubUserAudits strip what the audit log holds on a user (names, emails, ips) leaving only
+	// what happened and when, entries by or about them stay, under DeletedAuthor
+	ScrubUserAudits = `FOR a IN audit
+		FILTER a.actorkey == @key || a.target == CONCAT("users/", @key)
+		UPDATE a WITH {
+			actor: a.actorkey == @key ? @deleted : a.actor,
+			ip: a.actorkey == @key ? null : a.ip,
+			before: a.target == CONCAT("users/", @key) ? null : a.before,
+			after: a.target == CONCAT("users/", @key) ? null : a.after
+		} IN audit OPTIONS {keepNull: false, waitForSync: true}`
+)
+
+// ChangeUsername give a user a new username, and carry it over to their writs
+func (user *User) ChangeUsername(app *App, username string) error {
+	if !validUsername(username) {
+		return ErrInvalidUsernameOrEmail
+	}
+	if !app.IsUsernameAvailable(username) {
+		return ErrUsernameTaken
+	}
+	err := user.Update(app, `{username: @username}`, obj{"username": username})
+	if err != nil {
+		return err
+	}
+	return app.updateWrits(RenameAuthor, obj{"key": user.Key, "username": username})
+}
+
+// RequestEmailChange start changing a user's email,
+// both the old and the new address have to confirm it before it goes through
+func (user *User) RequestEmailChange(app *App, email string) error {
+	if !validEmail(email) {
+		return ErrInvalidUsernameOrEmail
+	}
+	if _, err := app.UserByEmail(email); err == nil {
+		return ErrEmailTaken
+	}
+	if !app.ratelimitEmail(user.Email, 2, time.Minute*5) || !app.ratelimitEmail(email, 2, time.Minute*5) {
+		return ErrEmailRateLimit
+	}
+
+	err := user.Update(app, `{emailchange: @change}`, obj{"change": EmailChange{Email: email}})
+	if err != nil {
+		return err
+	}
+
+	for _, side := range []string{"old", "new"} {
+		token, err := app.Verinator.Encode(user.Key + "|" + side + "|" + email)
+		if err != nil {
+			return err
+		}
+		link := app.AppURL("/me/email/confirm/" + token)
+
+		mail := app.Emailer.Make()
+		mail.Subject("Confirm your new email address at " + app.Conf.AppName)
+		if side == "old" {
+			mail.To(user.Email)
+			mail.HTML().Set(`
+				<h4>Hi ` + user.Username + `, someone asked to change your email to ` + email + `</h4>
+				<p>If that was you, <a href="` + link + `">confirm the change</a>.
+				The new address has to confirm it as well.</p>
+				<p>If it wasn't you, ignore this email and nothing will change.</p>
+			`)
+		} else {
+			mail.To(email)
+			mail.HTML().Set(`
+				<h4>Hi ` + user.Username + `, please confirm this is your new email address</h4>
+				<p><a href="` + link + `">confirm the change</a>,
+				your old address has to confirm it as well.</p>
+			`)
+		}
+		err = app.Emailer.Send(mail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfirmEmailChange apply one side's confirmation of an email change,
+// once the change is complete the previous email is returned
+func (app *App) ConfirmEmailChange(token string) (*User, string, error) {
+	tk, err := app.Verinator.Decode(token)
+	if err != nil {
+		return nil, "", ErrUnauthorized
+	}
+	parts := strings.SplitN(tk.Payload, "|", 3)
+	if len(parts) != 3 {
+		return nil, "", ErrUnauthorized
+	}
+	user, err := app.UserByKey(parts[0])
+	if err != nil {
+		return nil, "", ErrUnauthorized
+	}
+	if user.EmailChange == nil || user.EmailChange.Email != parts[2] {
+		return &user, "", ErrNoEmailChange
+	}
+
+	change := *user.EmailChange
+	if parts[1] == "old" {
+		change.OldConfirmed = true
+	} else {
+		change.NewConfirmed = true
+	}
+
+	if !change.OldConfirmed || !change.NewConfirmed {
+		err = user.Update(app, `{emailchange: @change}`, obj{"change": change})
+		return &user, "", err
+	}
+
+	if _, err := app.UserByEmail(change.Email); err == nil {
+		return &user, "", ErrEmailTaken
+	}
+	previous := user.Email
+	err = user.Update(app, `{email: @email, emailmd5: @emailmd5, emailchange: null}`, obj{
+		"email":    change.Email,
+		"emailmd5": GetMD5Hash(change.Email),
+	})
+	if err != nil {
+		return &user, "", err
+	}
+	return &user, previous, nil
+}
+
+// DeleteUser remove a user's account from the db,
+// their writs are kept but no longer attributed to them,
+// their likes and views are folded into anonymous counts
+// and the audit log is scrubbed of their personal details
+func (app *App) DeleteUser(key string) error {
+	err := app.updateWrits(AnonymizeUserWrits, obj{"key": key, "deleted": DeletedAuthor})
+	if err != nil {
+		return err
+	}
+	_, err = app.DB.Query(
+		driver.WithWaitForSync(context.Background()),
+		`FOR c IN credentials FILTER c.userkey == @key REMOVE c IN credentials`,
+		obj{"key": key},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = app.DB.Query(
+		driver.WithWaitForSync(context.Background()),
+		ScrubUserAudits,
+		obj{"key": key, "deleted": DeletedAuthor},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = app.Users.RemoveDocument(driver.WithWaitForSync(context.Background()), key)
+	return err
+}
+
+func initAccount(app *App) {
+	app.Server.POST("/me/username", app.AuthHandle(func(c ctx, user *User) error {
+		body, err := JSONbody(c)
+		if err != nil {
+			return BadRequestError(c)
+		}
+		before := obj{"username": user.Username}
+		err = user.ChangeUsername(app, body.Get("username").String())
+		if err == ErrInvalidUsernameOrEmail {
+			return BadUsernameError(c)
+		} else if err == ErrUsernameTaken {
+			return JSONErr(c, 409, err.Error())
+		} else if err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "user.username", "users/"+user.Key, before, obj{"username": user.Username})
+		return c.JSON(200, obj{"ok": true, "username": user.Username})
+	}))
+
+	app.Server.POST("/me/email", app.AuthHandle(func(c ctx, user *User) error {
+		body, err := JSONbody(c)
+		if err != nil {
+			return BadRequestError(c)
+		}
+		email := body.Get("email").String()
+		err = user.RequestEmailChange(app, email)
+		if err == ErrInvalidUsernameOrEmail {
+			return BadEmailError(c)
+		} else if err == ErrEmailTaken {
+			return JSONErr(c, 409, err.Error())
+		} else if err == ErrEmailRateLimit {
+			return JSONErr(c, 429, "too many emails, wait a bit and try again")
+		} else if err != nil {
+			if app.DevMode {
+				fmt.Println("email change request - error: ", err)
+			}
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "user.email.request", "users/"+user.Key, obj{"email": user.Email}, obj{"email": email})
+		return c.JSON(200, obj{
+			"ok":  true,
+			"msg": "we sent a confirmation link to both your old and new email addresses",
+		})
+	}))
+
+	app.Server.GET("/me/email/confirm/:token", func(c ctx) error {
+		user, previous, err := app.ConfirmEmailChange(c.Param("token"))
+		if err == ErrNoEmailChange || err == ErrEmailTaken {
+			return JSONErr(c, 409, err.Error())
+		} else if err != nil || user == nil {
+			return UnauthorizedError(c)
+		}
+		if len(previous) == 0 {
+			return c.JSON(200, obj{"ok": true, "msg": "confirmed, waiting on the other address to confirm too"})
+		}
+		app.Audit(c, user, "user.email", "users/"+user.Key, obj{"email": previous}, obj{"email": user.Email})
+		return c.JSON(200, obj{"ok": true, "msg": "your email has been changed"})
+	})
+
+	app.Server.POST("/me/description", app.AuthHandle(func(c ctx, user *User) error {
+		body, err := JSONbody(c)
+		if err != nil {
+			return BadRequestError(c)
+		}
+		description := body.Get("description").String()
+		if len(description) > 2000 {
+			return JSONErr(c, 400, "description is too long, keep it under 2000 characters")
+		}
+		err = user.Update(app, `{description: @description}`, obj{"description": description})
+		if err != nil {
+			return ServerDBError(c)
+		}
+		return c.JSON(200, obj{"ok": true})
+	}))
+
+	app.Server.DELETE("/me", app.AuthHandle(func(c ctx, user *User) error {
+		body, err := JSONbody(c)
+		if err != nil || body.Get("confirm").String() != user.Username {
+			return JSONErr(c, 400, "confirm the deletion by sending your username as confirm")
+		}
+		err = app.DeleteUser(user.Key)
+		if err != nil {
+			if app.DevMode {
+				fmt.Println("account deletion - error: ", err)
+			}
+			return ServerDBError(c)
+		}
+		app.Audit(c, nil, "user.delete.self", "users/"+user.Key, nil, nil)
+		clearAuthCookie(c)
+		return c.JSON(200, obj{"ok": true, "msg": "your account has been deleted"})
+	}))
+}
@@ -0,0 +1,604 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LetsEncryptDirectory the production ACME (RFC 8555) directory
+	LetsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeChallengePath    = "/.well-known/acme-challenge/"
+)
+
+var (
+	// ErrACMEUnknownHost someone asked for a certificate for a domain that isn't configured
+	ErrACMEUnknownHost = errors.New("acme: not configured to serve that host")
+	// ErrACMEOrderFailed the CA wouldn't validate the order
+	ErrACMEOrderFailed = errors.New("acme: the order could not be validated")
+	// ErrACMENoCertificate there's no certificate yet, the background loop is still getting one
+	ErrACMENoCertificate = errors.New("acme: no certificate yet")
+
+	// ACMECheckEvery how often the certificate is checked for renewal
+	ACMECheckEvery = 12 * time.Hour
+	// ACMERetryMin how long to wait after a first failed order, it doubles with every failure after
+	ACMERetryMin = time.Minute
+	// ACMERetryMax the longest wait between failed orders
+	ACMERetryMax = 12 * time.Hour
+)
+
+// ACMEManager obtains, caches and renews one certificate covering all of the app's domains
+// from an RFC 8555 certificate authority, answering its http-01 challenges
+type ACMEManager struct {
+	DirectoryURL string
+	Email        string
+	Domains      []string
+	CacheDir     string
+	RenewBefore  time.Duration
+	HTTPClient   *http.Client
+
+	sync.RWMutex
+	cert       *tls.Certificate
+	challenges map[string]string
+	obtaining  sync.Mutex
+	// failures orders failed in a row, the last of them at lastFailure
+	failures    int
+	lastFailure time.Time
+
+	key       *ecdsa.PrivateKey
+	kid       string
+	directory struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	nonce string
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *acmeProblem) Error() string {
+	return "acme: " + p.Type + " - " + p.Detail
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type   string `json:"type"`
+		URL    string `json:"url"`
+		Token  string `json:"token"`
+		Status string `json:"status"`
+	} `json:"challenges"`
+}
+
+// GetCertificate hand the tls stack the current certificate, handshakes never order one,
+// that's left to the background loop started by watch
+func (m *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !m.covers(hello.ServerName) {
+		return nil, ErrACMEUnknownHost
+	}
+	m.RLock()
+	cert := m.cert
+	m.RUnlock()
+	if cert == nil {
+		return nil, ErrACMENoCertificate
+	}
+	return cert, nil
+}
+
+// covers is the host one of the configured domains
+func (m *ACMEManager) covers(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range m.Domains {
+		if domain == host {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPHandler answer http-01 challenges, passing everything else on to fallback
+func (m *ACMEManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+			fallback.ServeHTTP(res, req)
+			return
+		}
+		m.RLock()
+		keyAuth, ok := m.challenges[strings.TrimPrefix(req.URL.Path, acmeChallengePath)]
+		m.RUnlock()
+		if !ok {
+			http.NotFound(res, req)
+			return
+		}
+		res.Header().Set("Content-Type", "text/plain")
+		res.Write([]byte(keyAuth))
+	})
+}
+
+// needsRenewal is there no certificate, or one about to expire or missing a domain
+func (m *ACMEManager) needsRenewal() bool {
+	m.RLock()
+	defer m.RUnlock()
+	if m.cert == nil || m.cert.Leaf == nil {
+		return true
+	}
+	if time.Now().Add(m.RenewBefore).After(m.cert.Leaf.NotAfter) {
+		return true
+	}
+	for _, domain := range m.Domains {
+		if m.cert.Leaf.VerifyHostname(domain) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ACMEManager) certFile() string {
+	return filepath.Join(m.CacheDir, m.Domains[0]+".pem")
+}
+
+// loadCached pick up a previously obtained certificate from the disk cache
+func (m *ACMEManager) loadCached() error {
+	data, err := ioutil.ReadFile(m.certFile())
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	m.cert = &cert
+	m.Unlock()
+	return nil
+}
+
+// obtain order a fresh certificate and swap it in, concurrent callers share one order
+func (m *ACMEManager) obtain() (*tls.Certificate, error) {
+	m.obtaining.Lock()
+	defer m.obtaining.Unlock()
+	if !m.needsRenewal() {
+		m.RLock()
+		defer m.RUnlock()
+		return m.cert, nil
+	}
+
+	fmt.Println("acme: requesting a certificate for ", strings.Join(m.Domains, ", "), " from ", m.DirectoryURL)
+	cert, err := m.issue()
+	m.Lock()
+	defer m.Unlock()
+	if err != nil {
+		m.failures++
+		m.lastFailure = time.Now()
+		fmt.Println("acme: couldn't get a certificate: ", err)
+		return nil, err
+	}
+	m.failures = 0
+	m.cert = cert
+	fmt.Println("acme: got a certificate valid until ", cert.Leaf.NotAfter)
+	return cert, nil
+}
+
+// issue order a certificate and cache it on disk
+func (m *ACMEManager) issue() (*tls.Certificate, error) {
+	certKey, chain, err := m.order()
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return nil, err
+	}
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), chain...)
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(m.certFile(), data, 0600); err != nil {
+		fmt.Println("acme: couldn't cache the certificate: ", err)
+	}
+	return &cert, nil
+}
+
+// acmeBackoff how long to wait after some failed orders in a row
+func acmeBackoff(failures int) time.Duration {
+	wait := ACMERetryMin
+	for i := 1; i < failures && wait < ACMERetryMax; i++ {
+		wait *= 2
+	}
+	if wait > ACMERetryMax {
+		wait = ACMERetryMax
+	}
+	return wait
+}
+
+// nextCheck how long till the background loop should look at the certificate again,
+// sooner after a failed order, backing off with each one
+func (m *ACMEManager) nextCheck(now time.Time) time.Duration {
+	m.RLock()
+	defer m.RUnlock()
+	if m.failures == 0 {
+		return ACMECheckEvery
+	}
+	wait := m.lastFailure.Add(acmeBackoff(m.failures)).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// order run an RFC 8555 order through to an issued certificate chain
+func (m *ACMEManager) order() (*ecdsa.PrivateKey, []byte, error) {
+	if err := m.register(); err != nil {
+		return nil, nil, err
+	}
+
+	identifiers := []obj{}
+	for _, domain := range m.Domains {
+		identifiers = append(identifiers, obj{"type": "dns", "value": domain})
+	}
+	var order acmeOrder
+	res, err := m.post(m.directory.NewOrder, obj{"identifiers": identifiers}, &order)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := res.Header.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		if err = m.authorize(authzURL); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.Domains[0]},
+		DNSNames: m.Domains,
+	}, certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = m.post(order.Finalize, obj{"csr": b64url.EncodeToString(csr)}, &order); err != nil {
+		return nil, nil, err
+	}
+	for i := 0; order.Status != "valid"; i++ {
+		if order.Status == "invalid" || i > 30 {
+			return nil, nil, ErrACMEOrderFailed
+		}
+		time.Sleep(2 * time.Second)
+		if _, err = m.post(orderURL, nil, &order); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var chain []byte
+	_, err = m.post(order.Certificate, nil, &chain)
+	return certKey, chain, err
+}
+
+// authorize prove control of a domain with an http-01 challenge
+func (m *ACMEManager) authorize(authzURL string) error {
+	var authz acmeAuthorization
+	if _, err := m.post(authzURL, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	found := false
+	for _, challenge := range authz.Challenges {
+		if challenge.Type != "http-01" {
+			continue
+		}
+		found = true
+		m.Lock()
+		m.challenges[challenge.Token] = challenge.Token + "." + m.thumbprint()
+		m.Unlock()
+		defer func(token string) {
+			m.Lock()
+			delete(m.challenges, token)
+			m.Unlock()
+		}(challenge.Token)
+
+		if _, err := m.post(challenge.URL, obj{}, nil); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return errors.New("acme: no http-01 challenge offered for " + authz.Identifier.Value)
+	}
+
+	for i := 0; authz.Status != "valid"; i++ {
+		if authz.Status == "invalid" || i > 30 {
+			return errors.New("acme: couldn't validate " + authz.Identifier.Value)
+		}
+		time.Sleep(2 * time.Second)
+		if _, err := m.post(authzURL, nil, &authz); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// register discover the directory and find or create the account, once
+func (m *ACMEManager) register() error {
+	if len(m.kid) != 0 {
+		return nil
+	}
+	res, err := m.HTTPClient.Get(m.DirectoryURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err = json.NewDecoder(res.Body).Decode(&m.directory); err != nil {
+		return err
+	}
+
+	if m.key == nil {
+		m.key, err = loadACMEAccountKey(filepath.Join(m.CacheDir, "account.key"))
+		if err != nil {
+			return err
+		}
+	}
+
+	account := obj{"termsOfServiceAgreed": true}
+	if len(m.Email) != 0 {
+		account["contact"] = []string{"mailto:" + m.Email}
+	}
+	res, err = m.post(m.directory.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	m.kid = res.Header.Get("Location")
+	return nil
+}
+
+func loadACMEAccountKey(location string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		return key, ioutil.WriteFile(location, data, 0600)
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("acme account key isn't pem encoded")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// jwk the account key as a json web key, members in the order thumbprints need
+func (m *ACMEManager) jwk() string {
+	size := (m.key.Curve.Params().BitSize + 7) / 8
+	return `{"crv":"P-256","kty":"EC","x":"` + b64url.EncodeToString(padBytes(m.key.X, size)) +
+		`","y":"` + b64url.EncodeToString(padBytes(m.key.Y, size)) + `"}`
+}
+
+// thumbprint the RFC 7638 thumbprint of the account key, used in key authorizations
+func (m *ACMEManager) thumbprint() string {
+	sum := sha256.Sum256([]byte(m.jwk()))
+	return b64url.EncodeToString(sum[:])
+}
+
+func padBytes(n *big.Int, size int) []byte {
+	raw := n.Bytes()
+	if len(raw) >= size {
+		return raw
+	}
+	return append(make([]byte, size-len(raw)), raw...)
+}
+
+func (m *ACMEManager) freshNonce() (string, error) {
+	if len(m.nonce) != 0 {
+		nonce := m.nonce
+		m.nonce = ""
+		return nonce, nil
+	}
+	res, err := m.HTTPClient.Head(m.directory.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return res.Header.Get("Replay-Nonce"), nil
+}
+
+// post send a JWS signed request, a nil payload makes it a POST-as-GET.
+// The response body is always closed before post returns: it's decoded into out as json,
+// copied into out as is when out is a *[]byte, or thrown away when out is nil
+func (m *ACMEManager) post(url string, payload interface{}, out interface{}) (*http.Response, error) {
+	body := []byte{}
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		nonce, err := m.freshNonce()
+		if err != nil {
+			return nil, err
+		}
+		protected := `{"alg":"ES256","nonce":"` + nonce + `","url":"` + url + `",`
+		if len(m.kid) != 0 {
+			protected += `"kid":"` + m.kid + `"}`
+		} else {
+			protected += `"jwk":` + m.jwk() + `}`
+		}
+		signed := b64url.EncodeToString([]byte(protected)) + "." + b64url.EncodeToString(body)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, m.key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		signature := append(padBytes(r, 32), padBytes(s, 32)...)
+		jws, _ := json.Marshal(obj{
+			"protected": b64url.EncodeToString([]byte(protected)),
+			"payload":   b64url.EncodeToString(body),
+			"signature": b64url.EncodeToString(signature),
+		})
+
+		res, err := m.HTTPClient.Post(url, "application/jose+json", bytes.NewReader(jws))
+		if err != nil {
+			return nil, err
+		}
+		m.nonce = res.Header.Get("Replay-Nonce")
+
+		if res.StatusCode >= 400 {
+			problem := &acmeProblem{}
+			json.NewDecoder(res.Body).Decode(problem)
+			res.Body.Close()
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < 3 {
+				continue
+			}
+			return res, problem
+		}
+		defer res.Body.Close()
+		switch dst := out.(type) {
+		case nil:
+			_, err = io.Copy(ioutil.Discard, res.Body)
+		case *[]byte:
+			*dst, err = ioutil.ReadAll(res.Body)
+		default:
+			err = json.NewDecoder(res.Body).Decode(out)
+		}
+		return res, err
+	}
+}
+
+// watch get a certificate if there isn't one cached, then renew it ahead of expiry,
+// swapping it in without a restart, failed orders are retried with exponential backoff
+func (m *ACMEManager) watch(done <-chan struct{}) {
+	go func() {
+		for {
+			failed := false
+			if m.needsRenewal() {
+				_, err := m.obtain()
+				failed = err != nil
+			}
+			wait := m.nextCheck(time.Now())
+			if failed {
+				fmt.Println("acme: trying again in ", wait)
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// configureACME set up the certificate manager from the "acme" section of the config,
+// directory_url can point at a test CA like pebble, whose root ca_bundle then needs trusting
+func (app *App) configureACME() error {
+	conf := app.Conf.ACME
+	if conf == nil || conf.Disabled {
+		return nil
+	}
+
+	m := &ACMEManager{
+		DirectoryURL: conf.DirectoryURL,
+		Email:        conf.Email,
+		CacheDir:     conf.Cache,
+		RenewBefore:  30 * 24 * time.Hour,
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+		challenges:   map[string]string{},
+	}
+	if len(m.DirectoryURL) == 0 {
+		m.DirectoryURL = LetsEncryptDirectory
+	}
+	if len(m.Email) == 0 && len(app.Conf.MaintainerEmails) != 0 {
+		m.Email = app.Conf.MaintainerEmails[0]
+	}
+	if len(m.CacheDir) == 0 {
+		m.CacheDir = "./private/acme"
+	}
+	if len(conf.RenewBefore) != 0 {
+		renewBefore, err := time.ParseDuration(conf.RenewBefore)
+		if err != nil {
+			return err
+		}
+		m.RenewBefore = renewBefore
+	}
+	for _, domain := range conf.Domains {
+		m.Domains = append(m.Domains, strings.ToLower(domain))
+	}
+	if len(m.Domains) == 0 {
+		m.Domains = []string{app.Conf.Domain}
+	}
+
+	if bundle := conf.CABundle; len(bundle) != 0 {
+		pool, err := loadCABundle(bundle)
+		if err != nil {
+			return err
+		}
+		m.HTTPClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	if err := os.MkdirAll(m.CacheDir, 0700); err != nil {
+		return err
+	}
+	if err := m.loadCached(); err != nil && !os.IsNotExist(err) {
+		fmt.Println("acme: ignoring unreadable cached certificate: ", err)
+	}
+	app.ACME = m
+	return nil
+}
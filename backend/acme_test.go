@@ -0,0 +1,60 @@
+package backend
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestACMEBackoff(t *testing.T) {
+	cases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, ACMERetryMin},
+		{2, 2 * ACMERetryMin},
+		{3, 4 * ACMERetryMin},
+		{6, 32 * ACMERetryMin},
+		{11, ACMERetryMax},
+		{1000, ACMERetryMax},
+	}
+	for _, tc := range cases {
+		if got := acmeBackoff(tc.failures); got != tc.want {
+			t.Errorf("%d failures: %v, want %v", tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestACMENextCheck(t *testing.T) {
+	now := time.Now()
+	m := &ACMEManager{}
+	if got := m.nextCheck(now); got != ACMECheckEvery {
+		t.Errorf("without failures: %v, want %v", got, ACMECheckEvery)
+	}
+	m.failures, m.lastFailure = 3, now.Add(-time.Minute)
+	if got := m.nextCheck(now); got != 3*time.Minute {
+		t.Errorf("three failures, one a minute ago: %v, want 3m", got)
+	}
+	m.lastFailure = now.Add(-time.Hour)
+	if got := m.nextCheck(now); got != 0 {
+		t.Errorf("long overdue: %v, want 0", got)
+	}
+}
+
+// TestACMEGetCertificate handshakes get the cached certificate or an error, never an order,
+// the manager has no http client so ordering would panic
+func TestACMEGetCertificate(t *testing.T) {
+	m := &ACMEManager{Domains: []string{"saul.test"}, challenges: map[string]string{}}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "saul.test"}); err != ErrACMENoCertificate {
+		t.Errorf("without a certificate: %v", err)
+	}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); err != ErrACMEUnknownHost {
+		t.Errorf("another host: %v", err)
+	}
+
+	cert := &tls.Certificate{}
+	m.cert = cert
+	if got, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "Saul.Test."}); err != nil || got != cert {
+		t.Errorf("with a certificate: %v, %v", got, err)
+	}
+}
@@ -1,7 +1,256 @@
 package backend
 
-func initAdmin() {
-	Server.GET("/admin", AdminHandle(func(c ctx, user *User) error {
-		return c.File(AssetsFolder + "/admin.html")
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+)
+
+// Admin user management queries
+var (
+	ListUsers = `FOR u IN users
+		FILTER @search == "" || CONTAINS(LOWER(u.username), @search) || CONTAINS(LOWER(u.email), @search)
+		SORT u.created DESC
+		LIMIT @page, @count
+		RETURN UNSET(u, "verifier", "logincode", "totp")`
+	CountUsers = `RETURN LENGTH(
+		FOR u IN users
+		FILTER @search == "" || CONTAINS(LOWER(u.username), @search) || CONTAINS(LOWER(u.email), @search)
+		RETURN 1
+	)`
+	UserWrits = `FOR writ IN writs FILTER writ.authorkey == @key SORT writ.created DESC
+		RETURN KEEP(writ, "_key", "title", "slug", "created", "public", "membersonly")`
+)
+
+// SearchUsers list users page by page, optionally filtering by username/email
+func (app *App) SearchUsers(search string, page, count int64) ([]User, int64, error) {
+	users := []User{}
+	var total int64
+	vars := obj{"search": strings.ToLower(search)}
+	err := app.QueryOne(CountUsers, vars, &total)
+	if err != nil {
+		return users, total, err
+	}
+
+	vars["page"] = page * count
+	vars["count"] = count
+	ctx := driver.WithQueryCount(context.Background())
+	cursor, err := app.DB.Query(ctx, ListUsers, vars)
+	if err != nil {
+		return users, total, err
+	}
+	defer cursor.Close()
+	for {
+		var user User
+		_, err = cursor.ReadDocument(ctx, &user)
+		if driver.IsNoMoreDocuments(err) {
+			err = nil
+			break
+		} else if err != nil {
+			break
+		}
+		users = append(users, user)
+	}
+	return users, total, err
+}
+
+// SetRoles add and/or remove roles from a user
+func (user *User) SetRoles(app *App, add, remove []Role) error {
+	if add == nil {
+		add = []Role{}
+	}
+	if remove == nil {
+		remove = []Role{}
+	}
+	for _, roles := range [][]Role{add, remove} {
+		for _, role := range roles {
+			if role < UnverifiedUser || role > Admin {
+				return ErrInvalidRole
+			}
+		}
+	}
+	return user.Update(app, `{roles: UNION_DISTINCT(MINUS(u.roles, @remove), @add)}`, obj{
+		"add":    add,
+		"remove": remove,
+	})
+}
+
+// Ban bar a user from the site and end all their sessions
+func (user *User) Ban(app *App) error {
+	return user.Update(app, `{banned: true, sessions: [], revoked: @now}`, obj{"now": time.Now()})
+}
+
+// Unban let a banned user back in
+func (user *User) Unban(app *App) error {
+	return user.Update(app, `{banned: false}`, obj{})
+}
+
+// Suspend keep a user out until a certain time
+func (user *User) Suspend(app *App, until time.Time) error {
+	return user.Update(app, `{suspended: @until, sessions: [], revoked: @now}`, obj{
+		"until": until,
+		"now":   time.Now(),
+	})
+}
+
+// ForceLogout revoke every session the user currently has
+func (user *User) ForceLogout(app *App) error {
+	return user.Update(app, `{sessions: [], revoked: @now}`, obj{"now": time.Now()})
+}
+
+func userAuditSummary(user *User) obj {
+	return obj{
+		"username":  user.Username,
+		"roles":     user.Roles,
+		"banned":    user.Banned,
+		"suspended": user.Suspended,
+	}
+}
+
+func (app *App) adminUserAction(c ctx, admin *User, action string, fn func(*User) error) error {
+	user, err := app.UserByKey(c.Param("key"))
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return JSONErr(c, 404, "no such user")
+		}
+		return ServerDBError(c)
+	}
+	before := userAuditSummary(&user)
+	err = fn(&user)
+	if err != nil {
+		if app.DevMode {
+			fmt.Println("admin "+action+" on user "+user.Username+" - error: ", err)
+		}
+		if err == ErrInvalidRole {
+			return BadRequestError(c)
+		}
+		return ServerDBError(c)
+	}
+	if action == "user.delete" {
+		// DeleteUser scrubbed whatever the audit log had on them, don't put it back
+		app.Audit(c, admin, action, "users/"+user.Key, nil, nil)
+		return c.JSON(200, obj{"ok": true})
+	}
+	app.Audit(c, admin, action, "users/"+user.Key, before, userAuditSummary(&user))
+	return c.JSON(200, obj{"ok": true, "user": user})
+}
+
+func initAdmin(app *App) {
+	app.Server.GET("/admin", app.AdminHandle(func(c ctx, user *User) error {
+		return c.File(app.Conf.Assets + "/admin.html")
+	}))
+
+	app.Server.GET("/admin/users", app.AdminHandle(func(c ctx, admin *User) error {
+		page, err := strconv.ParseInt(c.QueryParam("page"), 10, 64)
+		if err != nil || page < 0 {
+			page = 0
+		}
+		count, err := strconv.ParseInt(c.QueryParam("count"), 10, 64)
+		if err != nil || count < 1 {
+			count = 50
+		} else if count > 200 {
+			return JSONErr(c, 403, "requesting too many users at once, >= 200")
+		}
+
+		users, total, err := app.SearchUsers(c.QueryParam("q"), page, count)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		return c.JSON(200, obj{"users": users, "total": total, "page": page, "count": count})
+	}))
+
+	app.Server.GET("/admin/users/:key", app.AdminHandle(func(c ctx, admin *User) error {
+		user, err := app.UserByKey(c.Param("key"))
+		if err != nil {
+			if driver.IsNotFound(err) {
+				return JSONErr(c, 404, "no such user")
+			}
+			return ServerDBError(c)
+		}
+		user.Verifier = ""
+		user.LoginCode = ""
+		if user.TOTP != nil {
+			user.TOTP = &TOTPConfig{Enabled: user.TOTP.Enabled}
+		}
+
+		writs, err := app.Query(UserWrits, obj{"key": user.Key})
+		if err != nil {
+			return ServerDBError(c)
+		}
+
+		return c.JSON(200, obj{
+			"user":       user,
+			"writs":      writs,
+			"sessions":   user.Sessions,
+			"sessionips": user.SessionIPs,
+			"logins":     user.Logins,
+		})
 	}))
+
+	app.Server.POST("/admin/users/:key/roles", app.AdminHandle(func(c ctx, admin *User) error {
+		var body struct {
+			Add    []Role `json:"add"`
+			Remove []Role `json:"remove"`
+		}
+		if err := UnmarshalJSONBody(c, &body); err != nil {
+			return BadRequestError(c)
+		}
+		return app.adminUserAction(c, admin, "user.roles", func(user *User) error {
+			return user.SetRoles(app, body.Add, body.Remove)
+		})
+	}))
+
+	app.Server.POST("/admin/users/:key/suspend", app.AdminHandle(func(c ctx, admin *User) error {
+		var body struct {
+			Until time.Time `json:"until"`
+		}
+		if err := UnmarshalJSONBody(c, &body); err != nil || body.Until.Before(time.Now()) {
+			return BadRequestError(c)
+		}
+		return app.adminUserAction(c, admin, "user.suspend", func(user *User) error {
+			return user.Suspend(app, body.Until)
+		})
+	}))
+
+	app.Server.POST("/admin/users/:key/unsuspend", app.AdminHandle(func(c ctx, admin *User) error {
+		return app.adminUserAction(c, admin, "user.unsuspend", func(user *User) error {
+			return user.Update(app, `{suspended: null}`, obj{})
+		})
+	}))
+
+	app.Server.POST("/admin/users/:key/ban", app.AdminHandle(func(c ctx, admin *User) error {
+		if c.Param("key") == admin.Key {
+			return JSONErr(c, 400, "you can't ban yourself")
+		}
+		return app.adminUserAction(c, admin, "user.ban", func(user *User) error {
+			return user.Ban(app)
+		})
+	}))
+
+	app.Server.POST("/admin/users/:key/unban", app.AdminHandle(func(c ctx, admin *User) error {
+		return app.adminUserAction(c, admin, "user.unban", func(user *User) error {
+			return user.Unban(app)
+		})
+	}))
+
+	app.Server.POST("/admin/users/:key/logout", app.AdminHandle(func(c ctx, admin *User) error {
+		return app.adminUserAction(c, admin, "user.logout", func(user *User) error {
+			return user.ForceLogout(app)
+		})
+	}))
+
+	app.Server.DELETE("/admin/users/:key", app.AdminHandle(func(c ctx, admin *User) error {
+		if c.Param("key") == admin.Key {
+			return JSONErr(c, 400, "you can't delete yourself from here")
+		}
+		return app.adminUserAction(c, admin, "user.delete", func(user *User) error {
+			return app.DeleteUser(user.Key)
+		})
+	}))
+
+	fmt.Println("Admin Services Started")
 }
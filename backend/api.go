@@ -0,0 +1,397 @@
+package backend
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/labstack/echo"
+)
+
+// APIPrefix where the current version of the public json api lives
+const APIPrefix = "/api/v1"
+
+// publicWritFields what the api lets anyone see of a writ, and pick from with ?fields=
+var publicWritFields = []string{
+	"title", "slug", "author", "description", "content", "tags",
+	"created", "views", "type", "membersonly", "nocomments",
+}
+
+// apiRoute a public api endpoint, it's registered and documented from the same description
+// so the openapi document can't drift from what the handlers actually take
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Params  []apiParam
+	// Response an example of what a 200 carries, its type is what gets documented
+	Response interface{}
+	// CacheGroup the response cache group, nil if responses shouldn't be cached
+	CacheGroup func(c ctx) string
+	Handle     echo.HandlerFunc
+}
+
+type apiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Description string
+	Required    bool
+}
+
+// apiWritPage what a page of writs looks like coming out of the api
+type apiWritPage struct {
+	Writs []Writ `json:"writs"`
+	Next  string `json:"next,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Total int64  `json:"total,omitempty"`
+}
+
+// API the public read-only json api, every route it has ends up in its openapi document
+type API struct {
+	app    *App
+	routes []apiRoute
+}
+
+// route register an endpoint under APIPrefix
+func (api *API) route(r apiRoute) {
+	api.routes = append(api.routes, r)
+	var middleware []echo.MiddlewareFunc
+	if r.CacheGroup != nil {
+		middleware = append(middleware, api.app.Responses.Middleware(r.CacheGroup))
+	}
+	api.app.Server.Add(r.Method, APIPrefix+r.Path, r.Handle, middleware...)
+}
+
+// apiFields which fields a ?fields=title,slug asks for, all the public ones if it's empty
+func apiFields(raw string) ([]string, error) {
+	if len(strings.TrimSpace(raw)) == 0 {
+		return publicWritFields, nil
+	}
+	known := map[string]bool{}
+	for _, field := range publicWritFields {
+		known[field] = true
+	}
+	fields := []string{}
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if !known[field] {
+			return nil, errors.New("there's no field called " + strconv.Quote(field) + ", pick from " + strings.Join(publicWritFields, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// apiOmissions the writQuery Omissions leaving out everything the fields don't ask for,
+// membersonly is always fetched since whether the viewer may see a writ depends on it
+func apiOmissions(fields []string) []string {
+	wanted := map[string]bool{"membersonly": true}
+	for _, field := range fields {
+		wanted[field] = true
+	}
+	omissions := []string{"authorkey", "injection"}
+	for _, field := range publicWritFields {
+		if !wanted[field] {
+			omissions = append(omissions, field)
+		}
+	}
+	return omissions
+}
+
+// apiWrit a writ cut down to the fields asked for
+func apiWrit(writ *Writ, fields []string) obj {
+	full := writ.ToObj()
+	output := obj{}
+	for _, field := range fields {
+		if value, ok := full[field]; ok {
+			output[field] = value
+		}
+	}
+	return output
+}
+
+// apiTime take both 2006-01-02 and full RFC3339 times, a plain date's end is the end of that day
+func apiTime(raw string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err == nil && end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+func (api *API) listWrits(c ctx) error {
+	fields, err := apiFields(c.QueryParam("fields"))
+	if err != nil {
+		return JSONErr(c, 400, err.Error())
+	}
+	q := &writQuery{
+		Cursor:    c.QueryParam("cursor"),
+		PageSize:  WritPageSize,
+		Author:    c.QueryParam("author"),
+		Omissions: apiOmissions(fields),
+	}
+	for _, tag := range strings.Split(c.QueryParam("tags"), ",") {
+		if tag = strings.TrimSpace(tag); len(tag) != 0 {
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+	if raw := c.QueryParam("from"); len(raw) != 0 {
+		if q.Between.Start, err = apiTime(raw, false); err != nil {
+			return JSONErr(c, 400, "from should be a date like 2006-01-02 or an RFC3339 time")
+		}
+	}
+	if raw := c.QueryParam("to"); len(raw) != 0 {
+		if q.Between.End, err = apiTime(raw, true); err != nil {
+			return JSONErr(c, 400, "to should be a date like 2006-01-02 or an RFC3339 time")
+		}
+	}
+	if raw := c.QueryParam("count"); len(raw) != 0 {
+		q.PageSize, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || q.PageSize < 1 || q.PageSize > 100 {
+			return JSONErr(c, 400, "count should be between 1 and 100")
+		}
+	}
+	if raw := c.QueryParam("total"); len(raw) != 0 {
+		if q.CountTotal, err = strconv.ParseBool(raw); err != nil {
+			return BadRequestError(c)
+		}
+	}
+	if user, err := api.app.CredentialCheck(c); err == nil && user != nil {
+		q.IncludeMembersOnly = true
+	}
+
+	page, err := q.ExecPage(api.app)
+	if err == ErrBadCursor {
+		return JSONErr(c, 400, err.Error())
+	} else if err != nil {
+		return ServerDBError(c)
+	}
+
+	// next and prev keep every other parameter, only the cursor moves
+	link := func(cursor string) string {
+		params := c.QueryParams()
+		params.Set("cursor", cursor)
+		return APIPrefix + "/writs?" + params.Encode()
+	}
+	writs := make([]obj, len(page.Writs))
+	for i := range page.Writs {
+		writs[i] = apiWrit(&page.Writs[i], fields)
+	}
+	output := obj{"writs": writs}
+	if len(page.Next) != 0 {
+		output["next"] = link(page.Next)
+	}
+	if len(page.Prev) != 0 {
+		output["prev"] = link(page.Prev)
+	}
+	if page.Total != nil {
+		output["total"] = *page.Total
+	}
+	return c.JSON(200, output)
+}
+
+func (api *API) getWrit(c ctx) error {
+	fields, err := apiFields(c.QueryParam("fields"))
+	if err != nil {
+		return JSONErr(c, 400, err.Error())
+	}
+	slug, err := url.PathUnescape(c.Param("slug"))
+	if err != nil || len(slug) == 0 {
+		return BadRequestError(c)
+	}
+
+	writ, err := (&writQuery{Slug: slug, Omissions: apiOmissions(fields)}).ExecOne(api.app)
+	if driver.IsNoMoreDocuments(err) || driver.IsNotFound(err) {
+		return JSONErr(c, 404, "couldn't find a writ like that")
+	} else if err != nil {
+		return ServerDBError(c)
+	}
+	if writ.MembersOnly {
+		if user, err := api.app.CredentialCheck(c); err != nil || user == nil {
+			return UnauthorizedError(c)
+		}
+	}
+	return c.JSON(200, apiWrit(&writ, fields))
+}
+
+func initAPI(app *App) {
+	api := &API{app: app}
+	fieldsParam := apiParam{
+		Name:        "fields",
+		In:          "query",
+		Type:        "string",
+		Description: "comma separated fields to return, any of: " + strings.Join(publicWritFields, ", "),
+	}
+
+	api.route(apiRoute{
+		Method:  "GET",
+		Path:    "/writs",
+		Summary: "published writs, newest first, a page at a time",
+		Params: []apiParam{
+			{Name: "tags", In: "query", Type: "string", Description: "comma separated tags the writs must all have"},
+			{Name: "author", In: "query", Type: "string", Description: "the author's username"},
+			{Name: "from", In: "query", Type: "string", Description: "created on or after, 2006-01-02 or RFC3339"},
+			{Name: "to", In: "query", Type: "string", Description: "created before, a plain date includes that whole day"},
+			fieldsParam,
+			{Name: "cursor", In: "query", Type: "string", Description: "where to pick up, from a previous page's next or prev link"},
+			{Name: "count", In: "query", Type: "integer", Description: "writs per page, 1 to 100"},
+			{Name: "total", In: "query", Type: "boolean", Description: "also count every writ the filters find"},
+		},
+		Response:   apiWritPage{},
+		CacheGroup: listingCacheGroup,
+		Handle:     api.listWrits,
+	})
+
+	api.route(apiRoute{
+		Method:  "GET",
+		Path:    "/writs/:slug",
+		Summary: "one published writ by its slug",
+		Params: []apiParam{
+			{Name: "slug", In: "path", Type: "string", Required: true},
+			fieldsParam,
+		},
+		Response:   Writ{},
+		CacheGroup: writCacheGroup,
+		Handle:     api.getWrit,
+	})
+
+	api.route(apiRoute{
+		Method:   "GET",
+		Path:     "/openapi.json",
+		Summary:  "this api described as an OpenAPI 3 document",
+		Response: obj{},
+		Handle: func(c ctx) error {
+			return c.JSON(200, api.OpenAPI())
+		},
+	})
+}
+
+// OpenAPI describe every api route as an OpenAPI 3 document
+func (api *API) OpenAPI() obj {
+	paths := obj{}
+	for _, r := range api.routes {
+		path := r.Path
+		params := []obj{}
+		for _, p := range r.Params {
+			if p.In == "path" {
+				path = strings.Replace(path, ":"+p.Name, "{"+p.Name+"}", 1)
+			}
+			param := obj{
+				"name":     p.Name,
+				"in":       p.In,
+				"required": p.Required || p.In == "path",
+				"schema":   obj{"type": p.Type},
+			}
+			if len(p.Description) != 0 {
+				param["description"] = p.Description
+			}
+			params = append(params, param)
+		}
+
+		errorResponse := func(description string) obj {
+			return obj{
+				"description": description,
+				"content":     obj{"application/json": obj{"schema": obj{"$ref": "#/components/schemas/Error"}}},
+			}
+		}
+		operation := obj{
+			"summary":    r.Summary,
+			"parameters": params,
+			"responses": obj{
+				"200": obj{
+					"description": "ok",
+					"content":     obj{"application/json": obj{"schema": apiSchema(reflect.TypeOf(r.Response))}},
+				},
+				"400": errorResponse("the parameters don't make sense"),
+				"404": errorResponse("there's nothing there"),
+			},
+		}
+		if existing, ok := paths[APIPrefix+path].(obj); ok {
+			existing[strings.ToLower(r.Method)] = operation
+		} else {
+			paths[APIPrefix+path] = obj{strings.ToLower(r.Method): operation}
+		}
+	}
+
+	return obj{
+		"openapi": "3.0.3",
+		"info": obj{
+			"title":   api.app.Conf.AppName + " api",
+			"version": strings.TrimPrefix(APIPrefix, "/api/"),
+		},
+		"servers": []obj{{"url": api.app.AppURL("")}},
+		"paths":   paths,
+		"components": obj{
+			"schemas": obj{
+				"Writ": apiObjectSchema(reflect.TypeOf(Writ{}), publicWritFields),
+				"Error": obj{
+					"type": "object",
+					"properties": obj{
+						"ok":  obj{"type": "boolean"},
+						"err": obj{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// apiSchema a json schema for values of type t, going by their json tags
+func apiSchema(t reflect.Type) obj {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == reflect.TypeOf(Writ{}):
+		return obj{"$ref": "#/components/schemas/Writ"}
+	case t == timeType:
+		return obj{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return obj{"type": "string"}
+	case reflect.Bool:
+		return obj{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return obj{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return obj{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return obj{"type": "array", "items": apiSchema(t.Elem())}
+	case reflect.Struct:
+		return apiObjectSchema(t, nil)
+	}
+	return obj{"type": "object"}
+}
+
+// apiObjectSchema a struct's json schema, only the fields named in only if it isn't nil
+func apiObjectSchema(t reflect.Type, only []string) obj {
+	include := map[string]bool{}
+	for _, name := range only {
+		include[name] = true
+	}
+	properties := obj{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if len(field.PkgPath) != 0 || name == "-" || (only != nil && !include[name]) {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		properties[name] = apiSchema(field.Type)
+	}
+	return obj{"type": "object", "properties": properties}
+}
@@ -0,0 +1,328 @@
+package backend
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/arangodb/go-driver"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// App one instance of the site, built by New, run with Start and stopped with Shutdown.
+// Its echo Server can also be mounted inside another server since App is an http.Handler.
+//
+// Everything an instance talks to hangs off it, the handlers reach it through the closures
+// they're registered in, so two Apps with their own configs can share a process.
+type App struct {
+	Conf      *Config
+	DevMode   bool
+	Server    *echo.Echo
+	Emailer   *Emailer
+	Templates *TemplateRegistry
+	Responses *ResponseCache
+	// ACME the app's certificate manager, nil when certificates come from files
+	ACME *ACMEManager
+
+	// DB the arangodb database and the collections the app keeps its data in
+	DB           driver.Database
+	Users        driver.Collection
+	Writs        driver.Collection
+	RateLimits   driver.Collection
+	Audits       driver.Collection
+	Spent        driver.Collection
+	CSPReports   driver.Collection
+	Credentials  driver.Collection
+	OAuthClients driver.Collection
+	// DBAlive does the db still live?
+	DBAlive bool
+
+	// Tokenator auth tokens, Verinator verification codes, the rest their namesakes
+	Tokenator     *Branca
+	Verinator     *Branca
+	Cursorinator  *Branca
+	Exportinator  *Branca
+	Passkeyinator *Branca
+	Consentinator *Branca
+	Grantinator   *Branca
+	// OIDCKey the key id tokens and access tokens are signed with
+	OIDCKey *rsa.PrivateKey
+
+	Security          SecurityHeaders
+	SanitizePolicies  map[Role]*bluemonday.Policy
+	RateLimitPolicies map[string]*RateLimitPolicy
+	RateLimitRoutes   []RateLimitRoute
+	RateLimiter       RateLimitStore
+	TrustedProxies    []*net.IPNet
+	ProxyProtocol     bool
+	TLSMinVersion     uint16
+	TLSCipherSuites   []uint16
+	CertWatchInterval time.Duration
+
+	// WritsDir where the admin endpoint imports, exports and syncs markdown writs
+	WritsDir string
+	// ExportsFolder where background exports wait to be downloaded
+	ExportsFolder string
+	// Notifying subscriber emails still going out, Shutdown waits for them
+	Notifying sync.WaitGroup
+
+	oidcKeyID   string
+	dbendpoints []string
+	diedEmails  int
+	pingclient  *http.Client
+	spent       spentValues
+
+	redirectServer *http.Server
+	tlsServer      *http.Server
+	done           chan struct{}
+	stopping       sync.Once
+}
+
+var (
+	// ErrAppNotStarted Shutdown was called on an App that never started
+	ErrAppNotStarted = errors.New("the app was never started")
+)
+
+// New set up an App from a validated config: email, db, tokens and every route,
+// nothing listens until Start
+func New(conf *Config) (*App, error) {
+	app := &App{Conf: conf}
+	if err := app.setup(); err != nil {
+		return nil, err
+	}
+	if err := app.mount(); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// setup everything commands and the server both need: email, templates, tokens and the db
+func (app *App) setup() error {
+	conf := app.Conf
+	app.DevMode = conf.DevMode
+	app.done = make(chan struct{})
+	app.pingclient = &http.Client{Transport: &http.Transport{}}
+	app.Security = DefaultSecurityHeaders()
+	app.SanitizePolicies = DefaultSanitizePolicies()
+	app.RateLimitPolicies = DefaultRateLimitPolicies()
+	app.RateLimitRoutes = DefaultRateLimitRoutes()
+	app.RateLimiter = newMemoryRateLimits()
+	app.TLSMinVersion = tls.VersionTLS12
+	app.CertWatchInterval = CertWatchInterval
+
+	dkimKey, err := ioutil.ReadFile(conf.DKIMKey)
+	if err != nil {
+		return fmt.Errorf("dkim_key is missing, generate one: %v", err)
+	}
+	app.Emailer, err = NewEmailer(conf, dkimKey)
+	if err != nil {
+		return err
+	}
+
+	err = app.setupDB(conf.DBLocalAddress, conf.DBName, conf.DBUsername, conf.DBPassword)
+	if err != nil {
+		fmt.Println("couldn't connect to DB locally, trying remote connection now...")
+
+		err = app.setupDB(conf.DBAddress, conf.DBName, conf.DBUsername, conf.DBPassword)
+		if err != nil {
+			return fmt.Errorf("couldn't get DB connection going: %v", err)
+		}
+	}
+
+	app.Templates, err = NewTemplateRegistry("./templates", conf.Theme)
+	if err != nil {
+		return fmt.Errorf("the templates didn't load: %v", err)
+	}
+	app.Templates.AppName = conf.AppName
+	app.Templates.AssetsFolder = conf.Assets
+	app.Templates.DevMode = app.DevMode
+
+	app.Tokenator = NewBranca(conf.TokenSecret)
+	app.Tokenator.SetTTL(86400 * 7)
+	app.Verinator = NewBranca(conf.VerifierSecret)
+	app.Verinator.SetTTL(925)
+	app.Cursorinator = NewBranca(cursorKey(conf.TokenSecret))
+
+	app.Responses = app.configureResponseCache()
+
+	app.configureSanitizer()
+	app.Templates.Markdown = app.PolicyFor(nil)
+	return nil
+}
+
+// mount build the echo server, its middleware and every module's routes
+func (app *App) mount() error {
+	app.Server = echo.New()
+	app.Server.HideBanner = true
+	app.Server.Renderer = app.Templates
+
+	app.Server.Use(middleware.Recover())
+	app.Server.Use(middleware.BodyLimit("3M"))
+
+	initProxies(app)
+
+	app.Server.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Format: "${method}::${status} ${host}${uri}  \tip=${remote_ip} lag=${latency_human}\n",
+	}))
+
+	initRateLimits(app)
+	initSecurityHeaders(app)
+	app.Server.Use(app.CSRFMiddleware())
+
+	app.Server.Static("/", app.Conf.Assets)
+
+	if err := app.configureACME(); err != nil {
+		return err
+	}
+	if err := app.configureTLS(); err != nil {
+		return err
+	}
+
+	initCSRF(app)
+	initCSPReports(app)
+	initSanitizer(app)
+	initAuth(app)
+	initWrits(app)
+	initListings(app)
+	initAPI(app)
+	initMarkdownSync(app)
+	initResponseCache(app)
+	initAudit(app)
+	initExport(app)
+	initOIDC(app)
+	return nil
+}
+
+// ServeHTTP serve a request through the app's echo server, for mounting it elsewhere
+func (app *App) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	app.Server.ServeHTTP(res, req)
+}
+
+// ports the https and plain http ports, dev ones in dev mode
+func (app *App) ports() (string, string) {
+	if app.DevMode {
+		return ":" + string(app.Conf.DevPort), ":" + string(app.Conf.DevInsecurePort)
+	}
+	return ":" + string(app.Conf.Port), ":" + string(app.Conf.InsecurePort)
+}
+
+// Start listen on the https port and the plain http redirect port, and start the
+// background jobs. It returns once both are listening; they keep going until
+// Shutdown is called or ctx is done.
+func (app *App) Start(ctx context.Context) error {
+	port, insecurePort := app.ports()
+
+	tlsConf, err := app.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	tlsConf.NextProtos = []string{"h2", "http/1.1"}
+
+	secure, err := app.listen(port)
+	if err != nil {
+		return err
+	}
+	insecure, err := app.listen(insecurePort)
+	if err != nil {
+		secure.Close()
+		return err
+	}
+
+	app.tlsServer = &http.Server{Addr: port, Handler: app.Server, TLSConfig: tlsConf}
+	app.redirectServer = &http.Server{Addr: insecurePort, Handler: app.insecureHandler(http.HandlerFunc(app.redirect))}
+
+	go app.serve(app.tlsServer, tls.NewListener(secure, tlsConf))
+	go app.serve(app.redirectServer, insecure)
+	fmt.Println(app.Conf.AppName, " is listening on ", port, " and redirecting from ", insecurePort)
+
+	app.startDBHealthCheck(func() {
+		app.Shutdown(context.Background())
+	})
+	app.startRateLimitPruning()
+	app.startExportSweeping()
+	if app.DevMode {
+		app.Templates.watch(app.done)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			app.Shutdown(context.Background())
+		case <-app.done:
+		}
+	}()
+	return nil
+}
+
+// listen open a tcp listener, through a PROXY protocol listener if that's configured
+func (app *App) listen(address string) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if app.ProxyProtocol {
+		l = &proxyListener{l, app}
+	}
+	return l, nil
+}
+
+func (app *App) serve(server *http.Server, l net.Listener) {
+	if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+		fmt.Println("server on ", server.Addr, " stopped: ", err)
+	}
+}
+
+// redirect send plain http requests over to https
+func (app *App) redirect(res http.ResponseWriter, req *http.Request) {
+	target := "https://" + req.Host + req.URL.Path
+	if len(req.URL.RawQuery) > 0 {
+		target += "?" + req.URL.RawQuery
+	}
+	if app.DevMode {
+		fmt.Printf("\nredirect to: %s \n", target)
+		fmt.Println(app.resolveClientIP(req.RemoteAddr, req.Header))
+	}
+	http.Redirect(res, req, target, http.StatusTemporaryRedirect)
+}
+
+// Shutdown stop the background jobs, let in-flight requests and subscriber emails
+// finish (until ctx is done), then close the servers
+func (app *App) Shutdown(ctx context.Context) error {
+	if app.tlsServer == nil {
+		return ErrAppNotStarted
+	}
+	var err error
+	app.stopping.Do(func() {
+		close(app.done)
+
+		if e := app.redirectServer.Shutdown(ctx); e != nil {
+			err = e
+		}
+		if e := app.tlsServer.Shutdown(ctx); e != nil {
+			err = e
+		}
+
+		notified := make(chan struct{})
+		go func() {
+			app.Notifying.Wait()
+			close(notified)
+		}()
+		select {
+		case <-notified:
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,246 @@
+package backend
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeArango just enough of arangodb's http api for New to get its collections and
+// indexes ready, documents are kept in memory and queries come back empty unless
+// a test gave an answer for them
+type fakeArango struct {
+	*httptest.Server
+	sync.Mutex
+	docs    map[string]map[string]obj
+	answers []fakeAnswer
+	// reads how many times each collection/key was read
+	reads map[string]int
+}
+
+// fakeAnswer the results for queries containing some text, worked out from the documents
+type fakeAnswer struct {
+	contains string
+	answer   func(docs map[string]map[string]obj, vars obj) []obj
+}
+
+func fakeArangoDB() *fakeArango {
+	db := &fakeArango{docs: map[string]map[string]obj{}, reads: map[string]int{}}
+	db.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		var body obj
+		json.NewDecoder(req.Body).Decode(&body)
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/_open/auth"):
+			res.Write([]byte(`{"jwt": "fake"}`))
+		case strings.Contains(req.URL.Path, "/_api/document/"):
+			db.document(res, req, body)
+		case strings.HasSuffix(req.URL.Path, "/_api/index"):
+			res.WriteHeader(201)
+			json.NewEncoder(res).Encode(obj{"id": req.URL.Query().Get("collection") + "/1", "type": body["type"]})
+		case strings.HasSuffix(req.URL.Path, "/_api/cursor"):
+			res.WriteHeader(201)
+			json.NewEncoder(res).Encode(obj{"result": db.query(body), "hasMore": false})
+		case req.Method == "GET":
+			res.Write([]byte(`{}`))
+		default:
+			notFound(res)
+		}
+	}))
+	return db
+}
+
+func notFound(res http.ResponseWriter) {
+	res.WriteHeader(404)
+	res.Write([]byte(`{"error": true, "code": 404, "errorNum": 1202, "errorMessage": "not found"}`))
+}
+
+// document create, read, replace or remove a document
+func (db *fakeArango) document(res http.ResponseWriter, req *http.Request, body obj) {
+	db.Lock()
+	defer db.Unlock()
+	parts := strings.SplitN(strings.SplitN(req.URL.Path, "/_api/document/", 2)[1], "/", 2)
+	collection := db.docs[parts[0]]
+	if collection == nil {
+		collection = map[string]obj{}
+		db.docs[parts[0]] = collection
+	}
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	} else if k, ok := body["_key"].(string); ok {
+		key = k
+	} else {
+		key = RandStr(12)
+	}
+	meta := obj{"_key": key, "_id": parts[0] + "/" + key, "_rev": "1"}
+
+	doc, exists := collection[key]
+	switch req.Method {
+	case "GET":
+		db.reads[parts[0]+"/"+key]++
+		if !exists {
+			notFound(res)
+			return
+		}
+		json.NewEncoder(res).Encode(doc)
+	case "POST":
+		if exists {
+			res.WriteHeader(409)
+			res.Write([]byte(`{"error": true, "code": 409, "errorNum": 1210, "errorMessage": "unique constraint violated"}`))
+			return
+		}
+		body["_key"] = key
+		collection[key] = body
+		res.WriteHeader(201)
+		json.NewEncoder(res).Encode(meta)
+	case "PUT", "PATCH", "DELETE":
+		if !exists {
+			notFound(res)
+			return
+		}
+		switch req.Method {
+		case "PUT":
+			body["_key"] = key
+			collection[key] = body
+		case "PATCH":
+			for field, value := range body {
+				if value == nil && req.URL.Query().Get("keepNull") == "false" {
+					delete(doc, field)
+				} else {
+					doc[field] = value
+				}
+			}
+		default:
+			delete(collection, key)
+		}
+		res.WriteHeader(202)
+		json.NewEncoder(res).Encode(meta)
+	default:
+		notFound(res)
+	}
+}
+
+// query the answer for a cursor request, if there is one
+func (db *fakeArango) query(body obj) []obj {
+	db.Lock()
+	defer db.Unlock()
+	query, _ := body["query"].(string)
+	vars, _ := body["bindVars"].(map[string]interface{})
+	for _, answer := range db.answers {
+		if strings.Contains(query, answer.contains) {
+			return answer.answer(db.docs, vars)
+		}
+	}
+	return []obj{}
+}
+
+// answer give queries containing some text results
+func (db *fakeArango) answer(contains string, answer func(docs map[string]map[string]obj, vars obj) []obj) {
+	db.Lock()
+	defer db.Unlock()
+	db.answers = append(db.answers, fakeAnswer{contains, answer})
+}
+
+// put store a document as if it had been there all along
+func (db *fakeArango) put(collection string, doc obj) {
+	db.Lock()
+	defer db.Unlock()
+	if db.docs[collection] == nil {
+		db.docs[collection] = map[string]obj{}
+	}
+	db.docs[collection][doc["_key"].(string)] = doc
+}
+
+// testConfig a config for an App on db, its keys and folders go in dir
+func testConfig(t *testing.T, dir, name, db string) *Config {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dkim := filepath.Join(dir, name+"-dkim.pem")
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(dkim, pemKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Config{
+		AppName:        name,
+		Domain:         name + ".test",
+		Assets:         "./assets",
+		DKIMKey:        dkim,
+		DBLocalAddress: []string{db},
+		DBAddress:      []string{db},
+		DBName:         name,
+		DBUsername:     "root",
+		TokenSecret:    fmt.Sprintf("%-32s", name+" token secret"),
+		VerifierSecret: fmt.Sprintf("%-32s", name+" verifier secret"),
+		OIDCKey:        filepath.Join(dir, name+"-oidc.pem"),
+		Exports:        filepath.Join(dir, name+"-exports"),
+	}
+	conf.RateLimit.Backend = "memory"
+	return conf
+}
+
+// testApp an App on a fresh fake db, run from the repo root so it finds its templates and assets
+func testApp(t *testing.T, name string) (*App, *fakeArango) {
+	db := fakeArangoDB()
+	t.Cleanup(db.Close)
+	dir := t.TempDir()
+	t.Chdir("..")
+	app, err := New(testConfig(t, dir, name, db.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, db
+}
+
+func TestTwoApps(t *testing.T) {
+	db := fakeArangoDB()
+	defer db.Close()
+	dir := t.TempDir()
+	// the templates and assets are found from the repo root
+	t.Chdir("..")
+
+	one, err := New(testConfig(t, dir, "one", db.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := New(testConfig(t, dir, "two", db.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, app := range []*App{one, two} {
+		res := httptest.NewRecorder()
+		app.ServeHTTP(res, httptest.NewRequest("GET", "/.well-known/openid-configuration", nil))
+		var discovery obj
+		if err := json.Unmarshal(res.Body.Bytes(), &discovery); err != nil {
+			t.Fatalf("%s: %d %v", app.Conf.AppName, res.Code, err)
+		}
+		if want := "https://" + app.Conf.Domain; discovery["issuer"] != want {
+			t.Errorf("%s: issuer %v, want %s", app.Conf.AppName, discovery["issuer"], want)
+		}
+	}
+
+	token, err := one.Tokenator.Encode("someone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := one.Tokenator.Decode(token); err != nil {
+		t.Fatalf("one's token didn't decode on one: %v", err)
+	}
+	if _, err := two.Tokenator.Decode(token); err == nil {
+		t.Fatal("one's token decoded on two")
+	}
+}
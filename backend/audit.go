@@ -0,0 +1,189 @@
+package backend
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/arangodb/go-driver"
+)
+
+// AuditEntry a record of something someone did to something,
+// entries are only ever appended, never updated or removed
+type AuditEntry struct {
+	Key     string      `json:"_key,omitempty"`
+	Actor   string      `json:"actor,omitempty"`
+	ActorID string      `json:"actorkey,omitempty"`
+	Action  string      `json:"action"`
+	Target  string      `json:"target,omitempty"`
+	Before  interface{} `json:"before,omitempty"`
+	After   interface{} `json:"after,omitempty"`
+	IP      string      `json:"ip,omitempty"`
+	Created time.Time   `json:"created"`
+}
+
+type auditQuery struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Page   int64
+	Count  int64
+}
+
+// Audit record an action taken by a user against some target,
+// c may be nil when the action didn't come from a request
+func (app *App) Audit(c ctx, actor *User, action, target string, before, after interface{}) {
+	entry := AuditEntry{
+		Action:  action,
+		Target:  target,
+		Before:  before,
+		After:   after,
+		Created: time.Now(),
+	}
+	if actor != nil {
+		entry.Actor = actor.Username
+		entry.ActorID = actor.Key
+	}
+	if c != nil {
+		entry.IP = ClientIP(c)
+	}
+	_, err := app.Audits.CreateDocument(context.Background(), &entry)
+	if err != nil {
+		fmt.Println("Audit - couldn't record ", action, " on ", target, ": ", err)
+	}
+}
+
+// Exec find audit entries matching the query, newest first
+func (q *auditQuery) Exec(app *App) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	vars := obj{
+		"actor":  q.Actor,
+		"action": q.Action,
+		"target": q.Target,
+		"page":   q.Page * q.Count,
+		"count":  q.Count,
+	}
+	query := `FOR a IN audit
+		FILTER (@actor == "" || a.actor == @actor || a.actorkey == @actor)
+		&& (@action == "" || STARTS_WITH(a.action, @action))
+		&& (@target == "" || a.target == @target) `
+	if !q.Since.IsZero() {
+		vars["since"] = q.Since
+		query += `&& a.created >= @since `
+	}
+	if !q.Until.IsZero() {
+		vars["until"] = q.Until
+		query += `&& a.created <= @until `
+	}
+	query += `SORT a.created DESC LIMIT @page, @count RETURN a`
+
+	ctx := driver.WithQueryCount(context.Background())
+	cursor, err := app.DB.Query(ctx, query, vars)
+	if err != nil {
+		return entries, err
+	}
+	defer cursor.Close()
+	for {
+		var entry AuditEntry
+		_, err = cursor.ReadDocument(ctx, &entry)
+		if driver.IsNoMoreDocuments(err) {
+			err = nil
+			break
+		} else if err != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, err
+}
+
+func writAuditSummary(writ *Writ) obj {
+	return obj{
+		"title":       writ.Title,
+		"slug":        writ.Slug,
+		"tags":        writ.Tags,
+		"public":      writ.Public,
+		"membersonly": writ.MembersOnly,
+	}
+}
+
+func writeAuditCSV(c ctx, entries []AuditEntry) error {
+	res := c.Response()
+	res.Header().Set("Content-Type", "text/csv")
+	res.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	res.WriteHeader(200)
+	w := csv.NewWriter(res)
+	w.Write([]string{"created", "actor", "actorkey", "action", "target", "ip", "before", "after"})
+	for _, entry := range entries {
+		before, _ := json.Marshal(entry.Before)
+		after, _ := json.Marshal(entry.After)
+		w.Write([]string{
+			entry.Created.Format(time.RFC3339),
+			entry.Actor,
+			entry.ActorID,
+			entry.Action,
+			entry.Target,
+			entry.IP,
+			string(before),
+			string(after),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func initAudit(app *App) {
+	_, _, err := app.Audits.EnsureSkipListIndex(nil, []string{"created"}, nil)
+	if err != nil {
+		fmt.Println("couldn't ensure audit index: ", err)
+	}
+
+	app.Server.GET("/admin/audit", app.AdminHandle(func(c ctx, admin *User) error {
+		q := auditQuery{
+			Actor:  c.QueryParam("actor"),
+			Action: c.QueryParam("action"),
+			Target: c.QueryParam("target"),
+		}
+		var err error
+		if since := c.QueryParam("since"); len(since) > 0 {
+			q.Since, err = time.Parse(time.RFC3339, since)
+			if err != nil {
+				return BadRequestError(c)
+			}
+		}
+		if until := c.QueryParam("until"); len(until) > 0 {
+			q.Until, err = time.Parse(time.RFC3339, until)
+			if err != nil {
+				return BadRequestError(c)
+			}
+		}
+		q.Page, err = strconv.ParseInt(c.QueryParam("page"), 10, 64)
+		if err != nil || q.Page < 0 {
+			q.Page = 0
+		}
+		q.Count, err = strconv.ParseInt(c.QueryParam("count"), 10, 64)
+		if err != nil || q.Count < 1 {
+			q.Count = 100
+		} else if q.Count > 10000 {
+			return JSONErr(c, 403, "requesting too many entries at once, >= 10000")
+		}
+
+		entries, err := q.Exec(app)
+		if err != nil {
+			return ServerDBError(c)
+		}
+
+		if c.QueryParam("format") == "csv" {
+			return writeAuditCSV(c, entries)
+		}
+		if c.QueryParam("format") == "json" {
+			c.Response().Header().Set("Content-Disposition", `attachment; filename="audit.json"`)
+		}
+		return c.JSON(200, entries)
+	}))
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/arangodb/go-driver"
@@ -19,6 +21,14 @@ var (
 	ErrIncompleteUser = errors.New("cannot mutate a user that is incomplete or not in database")
 	// ErrEmailRateLimit too many send requests on a particular email
 	ErrEmailRateLimit = errors.New("too many emails sent to this address in a short time")
+	// ErrAccountBanned the user has been banned and may not do anything
+	ErrAccountBanned = errors.New("this account has been banned")
+	// ErrAccountSuspended the user is suspended for the time being
+	ErrAccountSuspended = errors.New("this account is suspended for now")
+	// ErrSessionRevoked the session predates a forced logout
+	ErrSessionRevoked = errors.New("this session has been revoked")
+	// ErrInvalidRole no such role exists
+	ErrInvalidRole = errors.New("invalid role")
 )
 
 // Role auth roles/perms
@@ -34,10 +44,6 @@ const (
 )
 
 var (
-	// VerifiedSubject auth email subject
-	VerifiedSubject string
-	// UnverifiedSubject auth email subject for first timers
-	UnverifiedSubject string
 	// UnauthorizedError unauthorized request, cannot proceed
 	UnauthorizedError = sendError("unauthorized request, cannot proceed")
 	// InvalidDetailsError invalid details, could not authorize user
@@ -72,19 +78,31 @@ var (
 
 // User struct describing a user account
 type User struct {
-	Key         string      `json:"_key,omitempty"`
-	Email       string      `json:"email"`
-	EmailMD5    string      `json:"emailmd5"`
-	Username    string      `json:"username"`
-	Description string      `json:"description,omitempty"`
-	Verifier    string      `json:"verifier,omitempty"`
-	Created     time.Time   `json:"created,omitempty"`
-	Logins      []time.Time `json:"logins,omitempty"`
-	Sessions    []time.Time `json:"sessions,omitempty"`
-	Roles       []Role      `json:"roles,omitempty"`
-	Friends     []string    `json:"friends,omitempty"`
-	Exp         int64       `json:"exp,omitempty"`
-	Subscriber  bool        `json:"subscriber,omitempty"`
+	Key         string       `json:"_key,omitempty"`
+	Email       string       `json:"email"`
+	EmailMD5    string       `json:"emailmd5"`
+	Username    string       `json:"username"`
+	Description string       `json:"description,omitempty"`
+	Verifier    string       `json:"verifier,omitempty"`
+	LoginCode   string       `json:"logincode,omitempty"`
+	TOTP        *TOTPConfig  `json:"totp,omitempty"`
+	Created     time.Time    `json:"created,omitempty"`
+	Logins      []time.Time  `json:"logins,omitempty"`
+	Sessions    []time.Time  `json:"sessions,omitempty"`
+	SessionIPs  obj          `json:"sessionips,omitempty"`
+	Roles       []Role       `json:"roles,omitempty"`
+	Friends     []string     `json:"friends,omitempty"`
+	Exp         int64        `json:"exp,omitempty"`
+	Subscriber  bool         `json:"subscriber,omitempty"`
+	EmailChange *EmailChange `json:"emailchange,omitempty"`
+	Banned      bool         `json:"banned,omitempty"`
+	Suspended   time.Time    `json:"suspended,omitempty"`
+	Revoked     time.Time    `json:"revoked,omitempty"`
+	// MFA whether the current session passed a second factor, never stored
+	MFA bool `json:"-"`
+	// AuthTime when the current session last logged in or passed a second factor,
+	// carried along in the auth token, never stored
+	AuthTime time.Time `json:"-"`
 }
 
 // IsValid check that the user's username and email are valid
@@ -93,18 +111,18 @@ func (user *User) IsValid() bool {
 }
 
 // Update update a user's details using a common map
-func (user *User) Update(query string, vars obj) error {
+func (user *User) Update(app *App, query string, vars obj) error {
 	if len(user.Key) < 0 {
 		return ErrIncompleteUser
 	}
 	vars["key"] = user.Key
 	query = "FOR u in users FILTER u._key == @key UPDATE u WITH " + query + " IN users OPTIONS {keepNull: false, waitForSync: true} RETURN NEW"
 	ctx := driver.WithQueryCount(context.Background())
-	cursor, err := DB.Query(ctx, query, vars)
+	cursor, err := app.DB.Query(ctx, query, vars)
 	if err == nil {
 		defer cursor.Close()
 		_, err = cursor.ReadDocument(ctx, user)
-		if err != nil && DevMode {
+		if err != nil && app.DevMode {
 			fmt.Println("error updating user: ", err)
 		}
 	}
@@ -140,52 +158,71 @@ func (user *User) Verified() bool {
 	return user.HasRole(VerifiedUser)
 }
 
-// Verified check that a user has verified their email at least once
+// Standing check that a user isn't banned or suspended,
+// and that a session issued at a certain time hasn't been revoked since
+func (user *User) Standing(issued time.Time) error {
+	if user.Banned {
+		return ErrAccountBanned
+	}
+	if user.Suspended.After(time.Now()) {
+		return ErrAccountSuspended
+	}
+	if !user.Revoked.IsZero() && !issued.After(user.Revoked) {
+		return ErrSessionRevoked
+	}
+	return nil
+}
+
+// isAdmin check that a user has the admin role
 func (user *User) isAdmin() bool {
 	return user.HasRole(Admin)
 }
 
-// SetupVerifier initiate verification process with verifier and db update
-func (user *User) SetupVerifier() error {
-	return user.Update("{verifier: @verifier}", obj{
-		"verifier": GenerateVerifier(user.Key),
+// SetupVerifier initiate verification process with verifier and db update,
+// returns a one-time login code bound to the same pending login
+func (user *User) SetupVerifier(app *App) (string, error) {
+	code := GenerateLoginCode()
+	err := user.Update(app, "{verifier: @verifier, logincode: @logincode}", obj{
+		"verifier":  app.GenerateVerifier(user.Key),
+		"logincode": hashLoginCode(user.Key, code),
 	})
+	return code, err
 }
 
 // UserByKey retrieve user using their db document key
-func UserByKey(key string) (User, error) {
+func (app *App) UserByKey(key string) (User, error) {
 	var user User
-	_, err := Users.ReadDocument(context.Background(), key, &user)
+	_, err := app.Users.ReadDocument(context.Background(), key, &user)
 	return user, err
 }
 
 // UserByUsername get user with a certain username
-func UserByUsername(username string) (User, error) {
+func (app *App) UserByUsername(username string) (User, error) {
 	var user User
 	if !validUsername(username) {
 		return user, ErrInvalidUsernameOrEmail
 	}
-	err := QueryOne(FindUSERByUsername, obj{"username": username}, &user)
+	err := app.QueryOne(FindUSERByUsername, obj{"username": username}, &user)
 	return user, err
 }
 
 // UserByEmail get user with a certain email
-func UserByEmail(email string) (User, error) {
+func (app *App) UserByEmail(email string) (User, error) {
 	var user User
 	if !validEmail(email) {
 		return user, ErrInvalidUsernameOrEmail
 	}
-	err := QueryOne(FindUSERByEmail, obj{"email": email}, &user)
+	err := app.QueryOne(FindUSERByEmail, obj{"email": email}, &user)
 	return user, err
 }
 
 // UserByDetails attempt to get a user via their email/username combo
-func UserByDetails(email, username string) (User, error) {
+func (app *App) UserByDetails(email, username string) (User, error) {
 	var user User
 	if !validEmail(email) || !validUsername(username) {
 		return user, ErrInvalidUsernameOrEmail
 	}
-	err := QueryOne(FindUserByDetails, obj{
+	err := app.QueryOne(FindUserByDetails, obj{
 		"email":    email,
 		"username": username,
 	}, &user)
@@ -193,29 +230,29 @@ func UserByDetails(email, username string) (User, error) {
 }
 
 // IsUsernameAvailable checks that the username is as of yet unused
-func IsUsernameAvailable(username string) bool {
+func (app *App) IsUsernameAvailable(username string) bool {
 	if validUsername(username) {
-		_, err := UserByUsername(username)
+		_, err := app.UserByUsername(username)
 		return err != nil
 	}
 	return false
 }
 
 // AuthenticateUser create and/or authenticate a user
-func AuthenticateUser(email, username string) (User, error) {
-	user, err := UserByDetails(email, username)
+func (app *App) AuthenticateUser(email, username string) (User, error) {
+	user, err := app.UserByDetails(email, username)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("Authentication no user with those details - error: ", err)
 		}
 
-		if IsUsernameAvailable(username) && !validEmail(email) {
+		if app.IsUsernameAvailable(username) && !validEmail(email) {
 			return user, ErrInvalidUsernameOrEmail
 		}
 
 		user = User{}
 
-		err = QueryOne(CreateUser, obj{
+		err = app.QueryOne(CreateUser, obj{
 			"email":    email,
 			"emailmd5": GetMD5Hash(email),
 			"username": username,
@@ -223,74 +260,76 @@ func AuthenticateUser(email, username string) (User, error) {
 			"created":  time.Now(),
 		}, &user)
 		if err != nil {
-			if DevMode {
+			if app.DevMode {
 				fmt.Println("\nAutentication - error: ", err, "\nuser:\t\n", user, "\n\t")
 			}
 			return user, err
 		}
 	}
 
-	if !ratelimitEmail(email, 2, time.Minute*5) {
+	if user.Banned {
+		return user, ErrAccountBanned
+	}
+
+	if !app.ratelimitEmail(email, 2, time.Minute*5) {
 		return user, ErrEmailRateLimit
 	}
 
-	err = user.SetupVerifier()
+	code, err := user.SetupVerifier(app)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("Autentication verifier setup troubles - error: ", err)
 		}
 		return user, err
 	}
 
-	link := "https://" + AppDomain + "/auth/" + user.Verifier
-	if DevMode {
-		link = "https://localhost:" + Config.Get("devPort").String() + "/auth/" + user.Verifier
-	}
+	link := app.AppURL("/auth/" + user.Verifier)
 
 	vars := obj{
-		"AppName":  AppName,
+		"AppName":  app.Conf.AppName,
 		"Username": user.Username,
 		"Link":     link,
 		"Verifier": user.Verifier,
-		"Domain":   AppDomain,
+		"Code":     code,
+		"Domain":   app.Conf.Domain,
 	}
-	emailtxt, err := execTemplate(AuthEmailTXT, vars)
+	emailtxt, err := app.Templates.Bytes("authemail.txt", vars)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("Autentication email text template - error: ", err)
 		}
 		return user, err
 	}
-	emailhtml, err := execTemplate(AuthEmailHTML, vars)
+	emailhtml, err := app.Templates.Bytes("authemail.html", vars)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("Autentication email html template - error: ", err)
 		}
 		return user, err
 	}
 
-	mail := MakeEmail()
+	mail := app.Emailer.Make()
 
 	mail.To(user.Email)
 	if user.Verified() {
-		mail.Subject(VerifiedSubject)
+		mail.Subject("Login to " + app.Conf.AppName)
 	} else {
-		mail.Subject(UnverifiedSubject)
+		mail.Subject("Welcome to " + app.Conf.AppName)
 	}
 
 	mail.HTML().Set(string(emailhtml[:len(emailhtml)]))
 	mail.Plain().Set(string(emailtxt[:len(emailtxt)]))
 
-	err = SendEmail(mail)
-	if err != nil && DevMode {
+	err = app.Emailer.Send(mail)
+	if err != nil && app.DevMode {
 		fmt.Println(`Could not send email to `+user.Email+` because: `, err)
 	}
 	return user, err
 }
 
 // GenerateVerifier create a branca token
-func GenerateVerifier(key string) string {
-	token, err := Verinator.Encode(key)
+func (app *App) GenerateVerifier(key string) string {
+	token, err := app.Verinator.Encode(key)
 	if err != nil {
 		panic(err)
 	}
@@ -298,47 +337,84 @@ func GenerateVerifier(key string) string {
 }
 
 // VerifyUser from a verifier token, check that a user has verified their email at least once
-func VerifyUser(verifier string) (*User, error) {
+func (app *App) VerifyUser(verifier string) (*User, error) {
 	var user *User
-	tk, err := Verinator.Decode(verifier)
+	tk, err := app.Verinator.Decode(verifier)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println(`VerifyUser Decoding Error: `, err)
 		}
 		return user, ErrUnauthorized
 	}
-	usr, err := UserByKey(tk.Payload)
+	usr, err := app.UserByKey(tk.Payload)
 	user = &usr
 	if err != nil || user.Verifier != verifier {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println(`VerifyUser Error - either no such user or the verifier didn't match: `, err)
 		}
 		return user, ErrUnauthorized
 	}
 
-	if user.Verified() {
-		err = user.Update(`{verifier: null}`, obj{})
-	} else {
-		err = user.Update(`{
-			verifier: null,
-			roles: PUSH(REMOVE_VALUE(u.roles, @unverified), @verified, true)
-		}`, obj{
-			"unverified": UnverifiedUser,
-			"verified":   VerifiedUser,
-		})
-	}
-
-	if err != nil && DevMode {
+	err = user.completeVerification(app)
+	if err != nil && app.DevMode {
 		fmt.Println(`VerifyUser Error: `, err)
 		panic(err)
 	}
 	return user, err
 }
 
-// GenerateAuthToken create a branca token
-func GenerateAuthToken(user *User, renew bool) (string, error) {
+// completeVerification clear a user's pending login and mark them as verified
+func (user *User) completeVerification(app *App) error {
+	if user.Verified() {
+		return user.Update(app, `{verifier: null, logincode: null}`, obj{})
+	}
+	return user.Update(app, `{
+		verifier: null,
+		logincode: null,
+		roles: PUSH(REMOVE_VALUE(u.roles, @unverified), @verified, true)
+	}`, obj{
+		"unverified": UnverifiedUser,
+		"verified":   VerifiedUser,
+	})
+}
+
+// authTokenPayload what goes into an auth token: the user's key, a marker when
+// the session passed a second factor and when it logged in, renewals keep that
+func authTokenPayload(user *User) string {
+	mfa := ""
+	if user.MFA {
+		mfa = "mfa"
+	}
+	return user.Key + "|" + mfa + "|" + strconv.FormatInt(user.AuthTime.Unix(), 10)
+}
+
+// parseAuthTokenPayload get the user key, mfa marker and login time back out of an auth token,
+// tokens from before the login time was carried have none
+func parseAuthTokenPayload(payload string) (string, bool, int64) {
+	parts := strings.SplitN(payload, "|", 3)
+	mfa := len(parts) > 1 && parts[1] == "mfa"
+	if len(parts) < 3 {
+		return parts[0], mfa, 0
+	}
+	authTime, _ := strconv.ParseInt(parts[2], 10, 64)
+	return parts[0], mfa, authTime
+}
+
+// sessionAuthTime when a session logged in, falling back on when its token was issued
+func sessionAuthTime(tk BrancaToken, authTime int64) time.Time {
+	if authTime == 0 {
+		authTime = tk.Timestamp
+	}
+	return time.Unix(authTime, 0)
+}
+
+// GenerateAuthToken create a branca token, noting which ip the session was started from
+func (app *App) GenerateAuthToken(user *User, renew bool, ip string) (string, error) {
 	now := time.Now()
-	token, err := Tokenator.EncodeWithTime(user.Key, now)
+	if !renew || user.AuthTime.IsZero() {
+		user.AuthTime = now
+	}
+	token, err := app.Tokenator.EncodeWithTime(authTokenPayload(user), now)
 	if err != nil {
 		panic(err)
 	}
@@ -352,24 +428,45 @@ func GenerateAuthToken(user *User, renew bool) (string, error) {
 		}
 	}
 	vars["sessions"] = append(user.Sessions, now)
+	vars["sessionips"] = sessionIPs(user, now, ip)
 	if renew {
-		err = user.Update(`{sessions: @sessions}`, vars)
+		err = user.Update(app, `{sessions: @sessions, sessionips: @sessionips}`, vars)
 	} else {
 		vars["now"] = now
-		err = user.Update(`{sessions: @sessions, logins: PUSH(u.logins, @now)}`, vars)
+		err = user.Update(app, `{sessions: @sessions, sessionips: @sessionips, logins: PUSH(u.logins, @now)}`, vars)
 	}
 	return token, err
 }
 
+// sessionIPs the ips of a user's live sessions plus a new one,
+// gone sessions are nulled so the update drops them
+func sessionIPs(user *User, started time.Time, ip string) obj {
+	live := map[string]bool{}
+	for _, session := range user.Sessions {
+		live[strconv.FormatInt(session.Unix(), 10)] = true
+	}
+	ips := obj{}
+	for session := range user.SessionIPs {
+		if !live[session] {
+			ips[session] = nil
+		}
+	}
+	ips[strconv.FormatInt(started.Unix(), 10)] = ip
+	return ips
+}
+
 // ValidateAuthToken and return a user if ok
-func ValidateAuthToken(token string) (User, bool) {
+func (app *App) ValidateAuthToken(token string) (User, bool) {
 	var user User
-	tk, err := Tokenator.Decode(token)
+	tk, err := app.Tokenator.Decode(token)
 	ok := err == nil
 	if !ok {
 		return user, ok
 	}
-	user, err = UserByKey(tk.Payload)
+	key, mfa, authTime := parseAuthTokenPayload(tk.Payload)
+	user, err = app.UserByKey(key)
+	user.MFA = mfa
+	user.AuthTime = sessionAuthTime(tk, authTime)
 	ok = err == nil && len(user.Sessions) < 1
 	if !ok {
 		return user, ok
@@ -384,40 +481,51 @@ func ValidateAuthToken(token string) (User, bool) {
 			ok = true
 		}
 	}
-	ok = user.Update(`{sessions: @sessions}`, obj{"sessions": user.Sessions}) == nil
+	ok = user.Update(app, `{sessions: @sessions}`, obj{"sessions": user.Sessions}) == nil
 	return user, ok
 }
 
 // CredentialCheck get an authorized user from a route handler's context
-func CredentialCheck(c ctx) (*User, error) {
+func (app *App) CredentialCheck(c ctx) (*User, error) {
 	cookie, err := c.Cookie("Auth")
 	if err != nil || cookie == nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("CredentialCheck cookie troubles - error: ", err)
 		}
 		return nil, ErrUnauthorized
 	}
 
-	tk, err := Tokenator.Decode(cookie.Value)
+	tk, err := app.Tokenator.Decode(cookie.Value)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("CredentialCheck Decoding - error: ", err)
 		}
 		return nil, ErrUnauthorized
 	}
 
-	user, err := UserByKey(tk.Payload)
+	key, mfa, authTime := parseAuthTokenPayload(tk.Payload)
+	user, err := app.UserByKey(key)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("CredentialCheck User retrieval - error: ", err)
 		}
 		return nil, ErrUnauthorized
 	}
+	user.MFA = mfa
+	user.AuthTime = sessionAuthTime(tk, authTime)
+
+	err = user.Standing(time.Unix(tk.Timestamp, 0))
+	if err != nil {
+		if app.DevMode {
+			fmt.Println("CredentialCheck User standing - error: ", err)
+		}
+		return nil, err
+	}
 
 	if tk.ExpiresBefore(time.Now().Add(time.Hour * 48)) {
 		// refresh the auth token if it's about to go bad
 
-		newtoken, err := GenerateAuthToken(&user, true)
+		newtoken, err := app.GenerateAuthToken(&user, true, ClientIP(c))
 		if err == nil {
 			authCookie := &http.Cookie{
 				Name:     "Auth",
@@ -427,13 +535,13 @@ func CredentialCheck(c ctx) (*User, error) {
 				Path:     "/",
 				HttpOnly: true,
 			}
-			if !DevMode {
-				authCookie.Domain = AppDomain
+			if !app.DevMode {
+				authCookie.Domain = app.Conf.Domain
 				authCookie.SameSite = http.SameSiteStrictMode
 			}
 			c.SetCookie(authCookie)
 		} else {
-			if DevMode {
+			if app.DevMode {
 				fmt.Println(`error Renewing Auth Token, it probably has something to do with the db`)
 			}
 		}
@@ -442,10 +550,28 @@ func CredentialCheck(c ctx) (*User, error) {
 	return &user, err
 }
 
+// ViewerKey where the request's logged in user lives in the echo context, a nil *User once
+// the credentials were checked and nobody's logged in
+var ViewerKey = "viewer"
+
+// Viewer the logged in user making this request or nil, the credentials are only checked
+// once per request however many middlewares and handlers ask
+func (app *App) Viewer(c ctx) *User {
+	if user, ok := c.Get(ViewerKey).(*User); ok {
+		return user
+	}
+	user, err := app.CredentialCheck(c)
+	if err != nil {
+		user = nil
+	}
+	c.Set(ViewerKey, user)
+	return user
+}
+
 // AuthHandle create a GET route, accessible only to authenticated users
-func AuthHandle(handle func(ctx, *User) error) func(ctx) error {
+func (app *App) AuthHandle(handle func(ctx, *User) error) func(ctx) error {
 	return func(c ctx) error {
-		user, err := CredentialCheck(c)
+		user, err := app.CredentialCheck(c)
 		if err != nil || user == nil {
 			return UnauthorizedError(c)
 		}
@@ -454,23 +580,27 @@ func AuthHandle(handle func(ctx, *User) error) func(ctx) error {
 }
 
 // AdminHandle create a GET route, accessible only to admin users
-func AdminHandle(handle func(ctx, *User) error) func(ctx) error {
+// whose session passed a second factor
+func (app *App) AdminHandle(handle func(ctx, *User) error) func(ctx) error {
 	return func(c ctx) error {
-		user, err := CredentialCheck(c)
+		user, err := app.CredentialCheck(c)
 		if err != nil || user == nil || !user.isAdmin() {
-			if DevMode {
+			if app.DevMode {
 				fmt.Println(`AdminHandle for didn't go through: `, err)
 			}
 			return UnauthorizedError(c)
 		}
+		if !user.MFA {
+			return MFARequiredError(c, user)
+		}
 		return handle(c, user)
 	}
 }
 
 // RoleHandle create a GET route, accessible only to users with certain Roles
-func RoleHandle(roles []Role, handle func(ctx, *User) error) func(ctx) error {
+func (app *App) RoleHandle(roles []Role, handle func(ctx, *User) error) func(ctx) error {
 	return func(c ctx) error {
-		user, err := CredentialCheck(c)
+		user, err := app.CredentialCheck(c)
 		if err != nil {
 			return UnauthorizedError(c)
 		}
@@ -491,16 +621,47 @@ func RoleHandle(roles []Role, handle func(ctx, *User) error) func(ctx) error {
 	}
 }
 
-func initAuth() {
-	VerifiedSubject = "Login to " + AppName
-	UnverifiedSubject = "Welcome to " + AppName
+// issueAuthCookie start a new session for a user and hand them its Auth cookie
+func (app *App) issueAuthCookie(c ctx, user *User) error {
+	newtoken, err := app.GenerateAuthToken(user, false, ClientIP(c))
+	if err != nil {
+		return err
+	}
+	authCookie := &http.Cookie{
+		Name:     "Auth",
+		Value:    newtoken,
+		Expires:  time.Now().Add(time.Hour * (24 * 7)),
+		MaxAge:   60 * 60 * 24 * 7,
+		Path:     "/",
+		HttpOnly: true,
+	}
+	if !app.DevMode {
+		authCookie.Domain = app.Conf.Domain
+		authCookie.SameSite = http.SameSiteStrictMode
+	}
+	c.SetCookie(authCookie)
+	return nil
+}
 
-	Server.GET("/check-username/:username", func(c ctx) error {
-		return c.JSON(200, obj{"ok": IsUsernameAvailable(c.Param("username"))})
+// clearAuthCookie tell the browser to forget its Auth cookie
+func clearAuthCookie(c ctx) {
+	c.SetCookie(&http.Cookie{
+		Name:     "Auth",
+		Value:    "",
+		Expires:  time.Now().Truncate(time.Hour),
+		MaxAge:   1,
+		Path:     "/",
+		HttpOnly: true,
 	})
+}
 
-	Server.POST("/auth", func(c ctx) error {
-		if _, err := CredentialCheck(c); err == nil {
+func initAuth(app *App) {
+	app.Server.GET("/check-username/:username", func(c ctx) error {
+		return c.JSON(200, obj{"ok": app.IsUsernameAvailable(c.Param("username"))})
+	})
+
+	app.Server.POST("/auth", func(c ctx) error {
+		if _, err := app.CredentialCheck(c); err == nil {
 			return c.JSON(203, obj{
 				"msg": "You're already logged in :D",
 				"ok":  true,
@@ -516,19 +677,23 @@ func initAuth() {
 		if !validEmail(email) {
 			return BadEmailError(c)
 		}
+		if !app.RateLimitBy(c, "email", email) {
+			return RateLimitedError(c)
+		}
 
 		username := body.Get("username").String()
 		if !validUsername(username) {
 			return BadUsernameError(c)
 		}
 
-		user, err := AuthenticateUser(email, username)
+		user, err := app.AuthenticateUser(email, username)
 		if err == nil {
+			app.Audit(c, &user, "auth.request", "users/"+user.Key, nil, nil)
 			return c.JSON(203, obj{
 				"msg": "Thanks" + user.Username + ", we sent you an authentication email.",
 				"ok":  true,
 			})
-		} else if DevMode {
+		} else if app.DevMode {
 			fmt.Println("\nAuthentication Problem: \n\tusername - ", username, "\n\temail - ", email, "\n\terror - ", err, "\n\t")
 		}
 
@@ -542,72 +707,52 @@ func initAuth() {
 		return UnauthorizedError(c)
 	})
 
-	Server.GET("/auth/logout", func(c ctx) error {
+	app.Server.POST("/auth/logout", func(c ctx) error {
 		token := ""
 		cookie, err := c.Cookie("Auth")
 		if err == nil {
 			token = cookie.Value
 		}
 
-		c.SetCookie(&http.Cookie{
-			Name:     "Auth",
-			Value:    "",
-			Expires:  time.Now().Truncate(time.Hour),
-			MaxAge:   1,
-			Path:     "/",
-			HttpOnly: true,
-		})
+		clearAuthCookie(c)
 
 		if len(token) > 0 {
-			go func() {
-				tk, err := Tokenator.Decode(token)
-				if err != nil {
-					return
-				}
+			tk, err := app.Tokenator.Decode(token)
+			if err != nil {
+				return nil
+			}
 
-				user, err := UserByKey(tk.Payload)
-				if err != nil {
-					return
-				}
+			key, _, _ := parseAuthTokenPayload(tk.Payload)
+			user, err := app.UserByKey(key)
+			if err != nil {
+				return nil
+			}
 
-				user.Update(
-					`{session: REMOVE_VALUE(u.sessions, @session)}`,
-					obj{"session": time.Unix(tk.Timestamp, 0)},
-				)
-			}()
+			app.Audit(c, &user, "auth.logout", "users/"+user.Key, nil, nil)
+
+			go user.Update(app,
+				`{sessions: REMOVE_VALUE(u.sessions, @session)}`,
+				obj{"session": time.Unix(tk.Timestamp, 0)},
+			)
 		}
 
 		return nil
 	})
 
-	Server.GET("/auth/:verifier", func(c ctx) error {
-		user, err := VerifyUser(c.Param("verifier"))
+	app.Server.GET("/auth/:verifier", func(c ctx) error {
+		user, err := app.VerifyUser(c.Param("verifier"))
 		if err != nil || user == nil {
-			if DevMode {
+			if app.DevMode {
 				fmt.Println("Unable to Authenticate user: ", err)
 			}
 			return UnauthorizedError(c)
 		}
 
-		newtoken, err := GenerateAuthToken(user, false)
+		err = app.issueAuthCookie(c, user)
 		if err == nil {
-			authCookie := &http.Cookie{
-				Name:     "Auth",
-				Value:    newtoken,
-				Expires:  time.Now().Add(time.Hour * (24 * 7)),
-				MaxAge:   60 * 60 * 24 * 7,
-				Path:     "/",
-				HttpOnly: true,
-			}
-			if !DevMode {
-				authCookie.Domain = AppDomain
-				authCookie.SameSite = http.SameSiteStrictMode
-			}
-			c.SetCookie(authCookie)
-		} else {
-			if DevMode {
-				fmt.Println("error verifying (email) the user, GenerateAuthToken db problem: ", err)
-			}
+			app.Audit(c, user, "auth.login", "users/"+user.Key, nil, nil)
+		} else if app.DevMode {
+			fmt.Println("error verifying (email) the user, GenerateAuthToken db problem: ", err)
 		}
 
 		if user.isAdmin() {
@@ -616,19 +761,72 @@ func initAuth() {
 		return c.Redirect(301, "/")
 	})
 
-	Server.GET("/subscribe-toggle", AuthHandle(func(c ctx, user *User) error {
-		err := user.Update("{subscriber: @subscriber}", obj{"subscriber": !user.Subscriber})
+	app.Server.POST("/auth/code", func(c ctx) error {
+		body, err := JSONbody(c)
+		if err != nil {
+			return BadRequestError(c)
+		}
+
+		email := body.Get("email").String()
+		if !validEmail(email) {
+			return BadEmailError(c)
+		}
+		if !app.RateLimitBy(c, "email", email) {
+			return RateLimitedError(c)
+		}
+
+		user, err := app.VerifyLoginCode(email, body.Get("code").String())
+		if err == ErrLoginCodeLockout {
+			return c.JSON(429, obj{
+				"msg": "too many wrong codes, wait a while and try logging in again",
+				"ok":  false,
+			})
+		} else if err != nil {
+			if app.DevMode {
+				fmt.Println("Unable to Authenticate user by code: ", err)
+			}
+			return InvalidDetailsError(c)
+		}
+
+		err = app.issueAuthCookie(c, user)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "auth.login.code", "users/"+user.Key, nil, nil)
+		return c.JSON(200, obj{"ok": true, "admin": user.isAdmin()})
+	})
+
+	app.Server.GET("/unsubscribe", func(c ctx) error {
+		user, err := app.CredentialCheck(c)
+		page := `<!DOCTYPE html><html><head><meta charset="utf-8"><title>Unsubscribe</title></head><body>`
+		if err != nil {
+			page += `<p>Log in at <a href="/">` + app.Conf.Domain + `</a> first, then come back to unsubscribe.</p>`
+		} else if !user.Subscriber {
+			page += `<p>You're not subscribed, there's nothing to do.</p>`
+		} else {
+			page += `<form method="POST" action="/subscribe-toggle">
+				<input type="hidden" name="` + CSRFField + `" value="` + app.csrfToken(c) + `">
+				<button type="submit">Unsubscribe from ` + app.Conf.AppName + `</button>
+			</form>`
+		}
+		return c.HTML(200, page+`</body></html>`)
+	})
+
+	app.Server.POST("/subscribe-toggle", app.AuthHandle(func(c ctx, user *User) error {
+		before := obj{"subscriber": user.Subscriber}
+		err := user.Update(app, "{subscriber: @subscriber}", obj{"subscriber": !user.Subscriber})
 		if err != nil {
-			mail := MakeEmail()
+			mail := app.Emailer.Make()
 			mail.To("saulvdw@gmail.com")
 			mail.Subject("Subscriber State Toggle Error: " + user.Username)
 			mail.HTML().Set(`
 				<h4>There's been a problem updating user ` + user.Username + `'s subscriber status</h4>
 				<p>err:<br>` + err.Error() + `</p>
 			`)
-			go SendEmail(mail)
+			go app.Emailer.Send(mail)
 			return c.JSON(203, obj{"msg": "something happened, don't worry, we'll figure it out", "ok": false})
 		}
+		app.Audit(c, user, "user.subscription", "users/"+user.Key, before, obj{"subscriber": user.Subscriber})
 		msg := "success, you are "
 		if user.Subscriber {
 			msg += "subscribed for new writs and updates"
@@ -639,5 +837,8 @@ func initAuth() {
 	}))
 
 	fmt.Println("Authentication Services Started")
-	initAdmin()
+	initAccount(app)
+	initTOTP(app)
+	initWebAuthn(app)
+	initAdmin(app)
 }
@@ -58,12 +58,12 @@ func NewBranca(key string) (b *Branca) {
 // EncodeWithTime encodes the data matching the format:
 // Version (byte) || Timestamp ([4]byte) || Nonce ([24]byte) || Ciphertext ([]byte) || Tag ([16]byte)
 func (b *Branca) EncodeWithTime(data string, timeStamp time.Time) (string, error) {
-	var timestamp uint32
 	var nonce []byte
-	if b.timestamp == 0 {
-		b.timestamp = uint32(timeStamp.Unix())
+	// b.timestamp is only ever set for testing, every other token gets its own time
+	timestamp := b.timestamp
+	if timestamp == 0 {
+		timestamp = uint32(timeStamp.Unix())
 	}
-	timestamp = b.timestamp
 
 	if len(b.nonce) == 0 {
 		nonce = make([]byte, 24)
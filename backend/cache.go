@@ -0,0 +1,348 @@
+package backend
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// ResponseCache rendered pages and json kept in memory, keyed by viewer class and request uri,
+// least recently used entries go first once MaxEntries or MaxBytes is reached
+type ResponseCache struct {
+	MaxEntries int
+	MaxBytes   int64
+	TTL        time.Duration
+	Disabled   bool
+
+	// templates when they change (dev mode reloads) every rendered page is stale
+	templates *TemplateRegistry
+	// viewer who's looking, responses are cached per viewer class
+	viewer func(c ctx) string
+
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int64
+	stats   ResponseCacheStats
+}
+
+// ResponseCacheStats how well the cache is doing
+type ResponseCacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+}
+
+type cachedResponse struct {
+	key         string
+	group       string
+	contentType string
+	body        []byte
+	etag        string
+	modified    time.Time
+	// nonced the body carries the request's csp nonce, so it can't be revalidated with a 304
+	nonced bool
+}
+
+// cspNoncePlaceholder stands in for the csp nonce in stored bodies, each hit gets its own nonce back
+const cspNoncePlaceholder = "\x00cspnonce\x00"
+
+var (
+	// ResponseCacheTTL how long a cached response lives by default, edits made from
+	// the cli happen in another process and can't invalidate it
+	ResponseCacheTTL = 5 * time.Minute
+)
+
+// NewResponseCache make an empty response cache
+func NewResponseCache(maxEntries int, maxBytes int64, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+		TTL:        ttl,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+func entrySize(entry *cachedResponse) int64 {
+	return int64(len(entry.key) + len(entry.body))
+}
+
+func (rc *ResponseCache) get(key string) (*cachedResponse, bool) {
+	rc.Lock()
+	defer rc.Unlock()
+	el, ok := rc.entries[key]
+	if !ok {
+		rc.stats.Misses++
+		return nil, false
+	}
+	entry := el.Value.(*cachedResponse)
+	// templates changing (dev mode reloads) makes every rendered page stale
+	if time.Since(entry.modified) > rc.TTL || (rc.templates != nil && rc.templates.Modified().After(entry.modified)) {
+		rc.remove(el)
+		rc.stats.Misses++
+		return nil, false
+	}
+	rc.order.MoveToFront(el)
+	rc.stats.Hits++
+	return entry, true
+}
+
+func (rc *ResponseCache) put(entry *cachedResponse) {
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.MaxBytes > 0 && entrySize(entry) > rc.MaxBytes {
+		return
+	}
+	if el, ok := rc.entries[entry.key]; ok {
+		rc.remove(el)
+	}
+	rc.entries[entry.key] = rc.order.PushFront(entry)
+	rc.size += entrySize(entry)
+	for rc.order.Len() > 0 &&
+		((rc.MaxEntries > 0 && rc.order.Len() > rc.MaxEntries) || (rc.MaxBytes > 0 && rc.size > rc.MaxBytes)) {
+		rc.remove(rc.order.Back())
+		rc.stats.Evictions++
+	}
+}
+
+// remove drop an entry, the lock has to be held
+func (rc *ResponseCache) remove(el *list.Element) {
+	entry := rc.order.Remove(el).(*cachedResponse)
+	delete(rc.entries, entry.key)
+	rc.size -= entrySize(entry)
+}
+
+// Invalidate drop every response in the given groups, like "writ:<slug>" or "listing"
+func (rc *ResponseCache) Invalidate(groups ...string) {
+	if rc == nil {
+		return
+	}
+	drop := map[string]bool{}
+	for _, group := range groups {
+		drop[group] = true
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	for el := rc.order.Front(); el != nil; {
+		next := el.Next()
+		if drop[el.Value.(*cachedResponse).group] {
+			rc.remove(el)
+			rc.stats.Invalidations++
+		}
+		el = next
+	}
+}
+
+// invalidateWrits drop the cached pages of the writs with these slugs, and every listing
+// since any of them could be on one
+func (app *App) invalidateWrits(slugs ...string) {
+	groups := []string{"listing"}
+	for _, slug := range slugs {
+		if len(slug) != 0 {
+			groups = append(groups, "writ:"+slug)
+		}
+	}
+	app.Responses.Invalidate(groups...)
+}
+
+// Purge drop every cached response
+func (rc *ResponseCache) Purge() {
+	if rc == nil {
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	rc.stats.Invalidations += int64(rc.order.Len())
+	rc.entries = map[string]*list.Element{}
+	rc.order.Init()
+	rc.size = 0
+}
+
+// Stats the cache's counters as they are now
+func (rc *ResponseCache) Stats() ResponseCacheStats {
+	rc.Lock()
+	defer rc.Unlock()
+	stats := rc.stats
+	stats.Entries = rc.order.Len()
+	stats.Bytes = rc.size
+	return stats
+}
+
+// viewerClass who's looking, as far as what they get to see goes: anon, member or admin
+func (app *App) viewerClass(c ctx) string {
+	user := app.Viewer(c)
+	if user == nil {
+		return "anon"
+	}
+	if user.isAdmin() {
+		return "admin"
+	}
+	return "member"
+}
+
+// responseRecorder hold on to what a handler writes so it can be cached before it's sent
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.status = code
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// Middleware cache successful GET responses of a route, group says which group a
+// request's response belongs to so InitWrit and friends can invalidate it
+func (rc *ResponseCache) Middleware(group func(c ctx) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c ctx) error {
+			if rc == nil || rc.Disabled || c.Request().Method != http.MethodGet {
+				return next(c)
+			}
+
+			class := "anon"
+			if rc.viewer != nil {
+				class = rc.viewer(c)
+			}
+			key := class + " " + c.Request().RequestURI
+			h := c.Response().Header()
+			h.Add("Vary", "Cookie")
+			if class == "anon" {
+				h.Set("Cache-Control", "no-cache")
+			} else {
+				h.Set("Cache-Control", "private, no-cache")
+			}
+
+			nonce := CSPNonce(c)
+			if entry, ok := rc.get(key); ok {
+				h.Set("X-Cache", "hit")
+				return entry.serve(c, nonce)
+			}
+			h.Set("X-Cache", "miss")
+
+			res := c.Response()
+			writer := res.Writer
+			recorder := &responseRecorder{ResponseWriter: writer, status: http.StatusOK}
+			res.Writer = recorder
+			err := next(c)
+			res.Writer = writer
+			if !res.Committed {
+				return err
+			}
+
+			body := recorder.body.Bytes()
+			if err == nil && recorder.status == http.StatusOK {
+				entry := &cachedResponse{
+					key:         key,
+					group:       group(c),
+					contentType: h.Get(echo.HeaderContentType),
+					modified:    time.Now(),
+				}
+				entry.body = body
+				if len(nonce) != 0 && bytes.Contains(body, []byte(nonce)) {
+					entry.body = bytes.Replace(body, []byte(nonce), []byte(cspNoncePlaceholder), -1)
+					entry.nonced = true
+				}
+				sum := sha256.Sum256(entry.body)
+				entry.etag = `"` + hex.EncodeToString(sum[:12]) + `"`
+				rc.put(entry)
+				if !entry.nonced {
+					h.Set("ETag", entry.etag)
+					h.Set("Last-Modified", entry.modified.UTC().Format(http.TimeFormat))
+				}
+			}
+			writer.WriteHeader(recorder.status)
+			if _, werr := writer.Write(body); err == nil {
+				err = werr
+			}
+			return err
+		}
+	}
+}
+
+// serve answer a request from the cache, with a 304 if the client already has it
+func (entry *cachedResponse) serve(c ctx, nonce string) error {
+	h := c.Response().Header()
+	if entry.nonced {
+		body := bytes.Replace(entry.body, []byte(cspNoncePlaceholder), []byte(nonce), -1)
+		return c.Blob(http.StatusOK, entry.contentType, body)
+	}
+
+	h.Set("ETag", entry.etag)
+	h.Set("Last-Modified", entry.modified.UTC().Format(http.TimeFormat))
+	if notModified(c.Request(), entry) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, entry.contentType, entry.body)
+}
+
+// notModified whether the request's If-None-Match or If-Modified-Since says the client is up to date
+func notModified(req *http.Request, entry *cachedResponse) bool {
+	if match := req.Header.Get("If-None-Match"); len(match) != 0 {
+		for _, etag := range strings.Split(match, ",") {
+			etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+			if etag == entry.etag || etag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		return !entry.modified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// configureResponseCache build the response cache from the "cache" section of the config
+func (app *App) configureResponseCache() *ResponseCache {
+	conf := app.Conf.Cache
+	ttl := ResponseCacheTTL
+	if len(conf.TTL) != 0 {
+		parsed, err := time.ParseDuration(conf.TTL)
+		critCheck(err)
+		ttl = parsed
+	}
+	maxEntries := conf.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = 2000
+	}
+	maxBytes := conf.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = 64 << 20
+	}
+	rc := NewResponseCache(maxEntries, maxBytes, ttl)
+	rc.Disabled = conf.Disabled
+	rc.templates = app.Templates
+	rc.viewer = app.viewerClass
+	return rc
+}
+
+func initResponseCache(app *App) {
+	app.Server.GET("/admin/cache", app.AdminHandle(func(c ctx, admin *User) error {
+		return c.JSON(200, app.Responses.Stats())
+	}))
+
+	app.Server.POST("/admin/cache/purge", app.AdminHandle(func(c ctx, admin *User) error {
+		app.Responses.Purge()
+		if app.DevMode {
+			fmt.Println("response cache purged by ", admin.Username)
+		}
+		return c.JSON(200, obj{"ok": true})
+	}))
+}
@@ -0,0 +1,37 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestViewerResolvedOnce(t *testing.T) {
+	app, db := testApp(t, "viewer")
+	db.put("users", obj{"_key": "someone", "username": "someone", "email": "someone@viewer.test", "roles": []Role{VerifiedUser}})
+	token, err := app.Tokenator.Encode(authTokenPayload(&User{Key: "someone", AuthTime: time.Now()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the response cache sorts viewers into classes before the handler looks them up
+	for _, path := range []string{"/writ/a-writ", "/writs", "/"} {
+		db.Lock()
+		db.reads = map[string]int{}
+		db.Unlock()
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(&http.Cookie{Name: "Auth", Value: token})
+		app.ServeHTTP(httptest.NewRecorder(), req)
+		db.Lock()
+		if reads := db.reads["users/someone"]; reads != 1 {
+			t.Errorf("%s: the user was read %d times", path, reads)
+		}
+		db.Unlock()
+	}
+
+	c := app.Server.NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	if user := app.Viewer(c); user != nil || app.viewerClass(c) != "anon" {
+		t.Errorf("no cookie, but the viewer is %v", user)
+	}
+}
@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ErrBadCBOR the cbor data is malformed or uses something unsupported
+var ErrBadCBOR = errors.New("malformed or unsupported cbor")
+
+// decodeCBOR decode the definite-length subset of CBOR (RFC 7049) that webauthn uses,
+// maps come out as map[interface{}]interface{} keyed by int64 or string,
+// returns the value and whatever bytes are left over
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	if len(data) < 1 {
+		return nil, nil, ErrBadCBOR
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		return nil, nil, ErrBadCBOR
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrBadCBOR
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrBadCBOR
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if uint64(len(data)) < arg {
+			return nil, nil, ErrBadCBOR
+		}
+		if major == 2 {
+			return data[:arg], data[arg:], nil
+		}
+		return string(data[:arg]), data[arg:], nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, nil, ErrBadCBOR
+		}
+		list := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			var err error
+			item, data, err = decodeCBOR(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, item)
+		}
+		return list, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, ErrBadCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, val interface{}
+			var err error
+			key, data, err = decodeCBOR(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrBadCBOR
+			}
+			val, data, err = decodeCBOR(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = val
+		}
+		return m, data, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+	}
+	return nil, nil, ErrBadCBOR
+}
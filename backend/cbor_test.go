@@ -0,0 +1,171 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// cborPair a map entry for encodeCBOR, kept in order so the encoding is deterministic
+type cborPair struct {
+	Key, Val interface{}
+}
+
+// cborHead the major type and argument that start every cbor item
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		b := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(arg))
+		return b
+	case arg <= 0xffffffff:
+		b := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(arg))
+		return b
+	}
+	b := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], arg)
+	return b
+}
+
+// encodeCBOR just enough cbor to play an authenticator in the tests
+func encodeCBOR(v interface{}) []byte {
+	switch v := v.(type) {
+	case int:
+		return encodeCBOR(int64(v))
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []interface{}:
+		out := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case []cborPair:
+		out := cborHead(5, uint64(len(v)))
+		for _, pair := range v {
+			out = append(out, encodeCBOR(pair.Key)...)
+			out = append(out, encodeCBOR(pair.Val)...)
+		}
+		return out
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []byte
+		want interface{}
+	}{
+		{"tiny uint", []byte{0x17}, int64(23)},
+		{"one byte uint", []byte{0x18, 0x18}, int64(24)},
+		{"two byte uint", []byte{0x19, 0x01, 0xf4}, int64(500)},
+		{"four byte uint", []byte{0x1a, 0x00, 0x01, 0x00, 0x00}, int64(65536)},
+		{"eight byte uint", []byte{0x1b, 0, 0, 0, 1, 0, 0, 0, 0}, int64(1 << 32)},
+		{"negative", []byte{0x26}, int64(-7)},
+		{"two byte negative", []byte{0x39, 0x01, 0x00}, int64(-257)},
+		{"bytes", []byte{0x43, 1, 2, 3}, []byte{1, 2, 3}},
+		{"empty bytes", []byte{0x40}, []byte{}},
+		{"text", []byte{0x64, 'n', 'o', 'n', 'e'}, "none"},
+		{"array", []byte{0x83, 0x01, 0x20, 0x61, 'a'}, []interface{}{int64(1), int64(-1), "a"}},
+		{"nested array", []byte{0x82, 0x80, 0x81, 0x00}, []interface{}{[]interface{}{}, []interface{}{int64(0)}}},
+		{"map", []byte{0xa2, 0x01, 0x02, 0x61, 'k', 0xf5},
+			map[interface{}]interface{}{int64(1): int64(2), "k": true}},
+		{"false", []byte{0xf4}, false},
+		{"true", []byte{0xf5}, true},
+		{"null", []byte{0xf6}, nil},
+		{"undefined", []byte{0xf7}, nil},
+	}
+	for _, tc := range cases {
+		got, rest, err := decodeCBOR(tc.in)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if len(rest) != 0 {
+			t.Errorf("%s: %d bytes left over", tc.name, len(rest))
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeCBORLeftovers(t *testing.T) {
+	got, rest, err := decodeCBOR([]byte{0x01, 0xff, 0xee})
+	if err != nil || got != int64(1) || !bytes.Equal(rest, []byte{0xff, 0xee}) {
+		t.Fatalf("got %v, rest %x, err %v", got, rest, err)
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", []byte{}},
+		{"truncated argument", []byte{0x19, 0x01}},
+		{"truncated bytes", []byte{0x45, 1, 2}},
+		{"truncated text", []byte{0x63, 'a'}},
+		{"truncated array", []byte{0x82, 0x01}},
+		{"truncated map", []byte{0xa1, 0x01}},
+		{"huge array length", []byte{0x9a, 0xff, 0xff, 0xff, 0xff}},
+		{"huge map length", []byte{0xba, 0xff, 0xff, 0xff, 0xff}},
+		{"uint past int64", []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"negative past int64", []byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"indefinite bytes", []byte{0x5f, 0x41, 0x00, 0xff}},
+		{"indefinite map", []byte{0xbf, 0x01, 0x02, 0xff}},
+		{"reserved info", []byte{0x1c}},
+		{"bytes map key", []byte{0xa1, 0x41, 0x00, 0x01}},
+		{"array map key", []byte{0xa1, 0x80, 0x01}},
+		{"tag", []byte{0xc0, 0x00}},
+		{"half float", []byte{0xf9, 0x3c, 0x00}},
+	}
+	for _, tc := range cases {
+		if _, _, err := decodeCBOR(tc.in); err != ErrBadCBOR {
+			t.Errorf("%s: got %v, want ErrBadCBOR", tc.name, err)
+		}
+	}
+}
+
+func TestEncodeDecodeCBOR(t *testing.T) {
+	in := []cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", bytes.Repeat([]byte{0xab}, 300)},
+		{int64(-3), []interface{}{int64(-1 << 40), int64(1 << 40), nil, false}},
+	}
+	got, rest, err := decodeCBOR(encodeCBOR(in))
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("err %v, %d bytes left over", err, len(rest))
+	}
+	want := map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": bytes.Repeat([]byte{0xab}, 300),
+		int64(-3):  []interface{}{int64(-1 << 40), int64(1 << 40), nil, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,445 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/integrii/flaggy"
+)
+
+// command a cli subcommand that does one job against the db and exits,
+// without starting any servers, run gets an App that's set up but not mounted
+type command struct {
+	*flaggy.Subcommand
+	run func(app *App) error
+}
+
+var (
+	commands []*command
+
+	serveCmd       *flaggy.Subcommand
+	configCheckCmd *flaggy.Subcommand
+
+	// ErrNoSuchUser the command was pointed at a user that isn't there
+	ErrNoSuchUser = errors.New("there's no user with that username or email")
+)
+
+func newGroup(name, description string) *flaggy.Subcommand {
+	group := flaggy.NewSubcommand(name)
+	group.Description = description
+	flaggy.AttachSubcommand(group, 1)
+	return group
+}
+
+func newCommand(group *flaggy.Subcommand, name, description string, run func(app *App) error) *flaggy.Subcommand {
+	sub := flaggy.NewSubcommand(name)
+	sub.Description = description
+	group.AttachSubcommand(sub, 1)
+	commands = append(commands, &command{sub, run})
+	return sub
+}
+
+// usedCommand the command picked on the command line, if any
+func usedCommand() *command {
+	for _, cmd := range commands {
+		if cmd.Used {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// findUser look a user up by username or by email
+func (app *App) findUser(who string) (User, error) {
+	var user User
+	var err error
+	if strings.Contains(who, "@") {
+		user, err = app.UserByEmail(who)
+	} else {
+		user, err = app.UserByUsername(who)
+	}
+	if err != nil {
+		return user, ErrNoSuchUser
+	}
+	return user, nil
+}
+
+// outputFile stdout for "-" or nothing, otherwise a fresh file
+func outputFile(location string) (io.WriteCloser, error) {
+	if len(location) == 0 || location == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(location)
+}
+
+func registerCommands() {
+	serveCmd = flaggy.NewSubcommand("serve")
+	serveCmd.Description = "run the site (the default when no command is given)"
+	flaggy.AttachSubcommand(serveCmd, 1)
+
+	configCmd := newGroup("config", "config file tools")
+	configCheckCmd = flaggy.NewSubcommand("check")
+	configCheckCmd.Description = "load and validate the config, listing every problem, without starting anything"
+	configCmd.AttachSubcommand(configCheckCmd, 1)
+
+	registerUserCommands()
+	registerWritCommands()
+	registerTokenCommands()
+	registerDBCommands()
+	registerEmailCommands()
+	registerSiteCommands()
+}
+
+func registerUserCommands() {
+	group := newGroup("user", "manage users")
+
+	var email, username string
+	var admin bool
+	create := newCommand(group, "create", "create a user and email them a login link", func(app *App) error {
+		if !validEmail(email) || !validUsername(username) {
+			return ErrInvalidUsernameOrEmail
+		}
+		user, err := app.AuthenticateUser(email, username)
+		if err != nil && len(user.Key) == 0 {
+			return err
+		}
+		if admin {
+			if err := user.SetRoles(app, []Role{VerifiedUser, Admin}, nil); err != nil {
+				return err
+			}
+		}
+		app.Audit(nil, nil, "cli.user.create", "users/"+user.Key, nil, userAuditSummary(&user))
+		fmt.Println("created ", user.Username, " (", user.Key, ")")
+		if err != nil {
+			fmt.Println("but the login email didn't go out: ", err)
+		}
+		return nil
+	})
+	create.String(&email, "e", "email", "the new user's email")
+	create.String(&username, "u", "username", "the new user's username")
+	create.Bool(&admin, "a", "admin", "make them an admin straight away")
+
+	var promoteWho, roleName string
+	promote := newCommand(group, "promote", "give a user a role, admin by default", func(app *App) error {
+		user, err := app.findUser(promoteWho)
+		if err != nil {
+			return err
+		}
+		if len(roleName) == 0 {
+			roleName = "admin"
+		}
+		for role, name := range RoleNames {
+			if name == roleName {
+				before := userAuditSummary(&user)
+				if err = user.SetRoles(app, []Role{role}, nil); err != nil {
+					return err
+				}
+				app.Audit(nil, nil, "cli.user.promote", "users/"+user.Key, before, userAuditSummary(&user))
+				fmt.Println(user.Username, " is now ", roleName)
+				return nil
+			}
+		}
+		return ErrInvalidRole
+	})
+	promote.String(&promoteWho, "u", "user", "username or email of the user")
+	promote.String(&roleName, "r", "role", "unverified, verified or admin")
+
+	var banWho string
+	var suspend time.Duration
+	ban := newCommand(group, "ban", "ban a user, or suspend them for a while, ending all their sessions", func(app *App) error {
+		user, err := app.findUser(banWho)
+		if err != nil {
+			return err
+		}
+		before := userAuditSummary(&user)
+		action := "cli.user.ban"
+		if suspend > 0 {
+			action = "cli.user.suspend"
+			err = user.Suspend(app, time.Now().Add(suspend))
+		} else {
+			err = user.Ban(app)
+		}
+		if err != nil {
+			return err
+		}
+		app.Audit(nil, nil, action, "users/"+user.Key, before, userAuditSummary(&user))
+		fmt.Println(user.Username, " is out")
+		return nil
+	})
+	ban.String(&banWho, "u", "user", "username or email of the user")
+	ban.Duration(&suspend, "s", "suspend", "only suspend them for this long, like 72h")
+
+	var bootstrapWho string
+	bootstrap := newCommand(group, "totp-bootstrap", "mint a one-time token an admin needs to set up an authenticator app", func(app *App) error {
+		user, err := app.findUser(bootstrapWho)
+		if err != nil {
+			return err
+		}
+		token, err := user.BootstrapTOTP(app)
+		if err != nil {
+			return err
+		}
+		app.Audit(nil, nil, "cli.user.totp.bootstrap", "users/"+user.Key, nil, nil)
+		fmt.Println(token)
+		fmt.Println("send it as bootstrap to POST /me/totp/enroll within ", TOTPBootstrapTTL)
+		return nil
+	})
+	bootstrap.String(&bootstrapWho, "u", "user", "username or email of the admin")
+}
+
+func registerWritCommands() {
+	group := newGroup("writ", "manage writs")
+
+	var importFile string
+	importCmd := newCommand(group, "import", "create or update writs from a json file of one writ or a list of them", func(app *App) error {
+		data, err := ioutil.ReadFile(importFile)
+		if err != nil {
+			return err
+		}
+		writs := []Writ{}
+		if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+			err = json.Unmarshal(data, &writs)
+		} else {
+			var writ Writ
+			err = json.Unmarshal(data, &writ)
+			writs = append(writs, writ)
+		}
+		if err != nil {
+			return err
+		}
+		for i := range writs {
+			if err = app.InitWrit(&writs[i]); err != nil {
+				return fmt.Errorf("writ %q: %v", writs[i].Title, err)
+			}
+			fmt.Println("imported ", writs[i].Title)
+		}
+		return nil
+	})
+	importCmd.AddPositionalValue(&importFile, "file", 1, true, "json file holding the writ(s)")
+
+	var exportFile string
+	exportCmd := newCommand(group, "export", "write every writ out as json", func(app *App) error {
+		writs, err := app.Query(`FOR writ IN writs SORT writ.created RETURN UNSET(writ, "_id", "_rev", "viewedby", "likedby")`, obj{})
+		if err != nil {
+			return err
+		}
+		out, err := outputFile(exportFile)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(writs)
+	})
+	exportCmd.String(&exportFile, "o", "out", "file to write to, stdout by default")
+
+	var slug string
+	publish := newCommand(group, "publish", "make a writ public and tell the subscribers", func(app *App) error {
+		writ, err := (&writQuery{EditorMode: true, IncludePrivate: true, Slug: slug}).ExecOne(app)
+		if err != nil {
+			return err
+		}
+		if writ.Public {
+			fmt.Println(writ.Title, " is already public")
+			return nil
+		}
+		err = app.InitWrit(&Writ{
+			Key:         writ.Key,
+			Tags:        writ.Tags,
+			Edits:       writ.Edits,
+			Public:      true,
+			MembersOnly: writ.MembersOnly,
+			NoComments:  writ.NoComments,
+		})
+		if err == nil {
+			fmt.Println("published ", writ.Title, ", notifying subscribers...")
+		}
+		return err
+	})
+	publish.String(&slug, "s", "slug", "slug of the writ")
+
+	var mdDir, prefer string
+	var mdOnly bool
+	sync := newCommand(group, "sync", "import, export or sync a directory of markdown writs with front matter, by slug", func(app *App) error {
+		mode := SyncBoth
+		if mdOnly {
+			mode = SyncImport
+		}
+		if len(mdDir) == 0 {
+			mdDir = app.Conf.WritsDir
+		}
+		if len(mdDir) == 0 {
+			mdDir = "./writs"
+		}
+		report, err := app.SyncMarkdown(nil, nil, mdDir, mode, prefer)
+		if err != nil {
+			return err
+		}
+		printSyncReport(report)
+		return nil
+	})
+	sync.String(&mdDir, "d", "dir", "the markdown directory, writs_dir or ./writs by default")
+	sync.String(&prefer, "p", "prefer", "settle conflicts in favour of the db or the files")
+	sync.Bool(&mdOnly, "i", "import-only", "only push the files into the db")
+
+	var exportDir string
+	newCommand(group, "export-md", "write every writ out as <slug>.md with front matter", func(app *App) error {
+		if len(exportDir) == 0 {
+			exportDir = "./writs"
+		}
+		report, err := app.SyncMarkdown(nil, nil, exportDir, SyncExport, "")
+		if err != nil {
+			return err
+		}
+		printSyncReport(report)
+		return nil
+	}).String(&exportDir, "d", "dir", "directory to write to, ./writs by default")
+
+	newCommand(group, "resanitize", "re-render and re-sanitize the content of every stored writ", func(app *App) error {
+		count, err := app.ResanitizeWrits()
+		if err == nil {
+			fmt.Println("resanitized ", count, " writs")
+		}
+		return err
+	})
+}
+
+func printSyncReport(report SyncReport) {
+	for _, slug := range report.Imported {
+		fmt.Println("imported: ", slug)
+	}
+	for _, slug := range report.Exported {
+		fmt.Println("exported: ", slug)
+	}
+	for _, conflict := range report.Conflicts {
+		fmt.Println("conflict: ", conflict.File, " - ", conflict.Reason)
+	}
+	for _, err := range report.Errors {
+		fmt.Println("error: ", err)
+	}
+	fmt.Println(report.Unchanged, " unchanged, ", len(report.Conflicts), " conflicts")
+}
+
+func registerTokenCommands() {
+	group := newGroup("token", "auth tokens")
+
+	var who string
+	var mfa bool
+	mint := newCommand(group, "mint", "mint an auth token for a user, for scripts and debugging", func(app *App) error {
+		user, err := app.findUser(who)
+		if err != nil {
+			return err
+		}
+		user.MFA = mfa
+		token, err := app.GenerateAuthToken(&user, false, "cli")
+		if err != nil {
+			return err
+		}
+		app.Audit(nil, nil, "cli.token.mint", "users/"+user.Key, nil, obj{"mfa": mfa})
+		fmt.Println(token)
+		return nil
+	})
+	mint.String(&who, "u", "user", "username or email of the user")
+	mint.Bool(&mfa, "m", "mfa", "mark the session as having passed a second factor")
+}
+
+func registerDBCommands() {
+	group := newGroup("db", "database upkeep")
+
+	newCommand(group, "migrate", "create missing collections and run pending migrations", func(app *App) error {
+		ran, err := app.RunMigrations()
+		for _, name := range ran {
+			fmt.Println("migrated: ", name)
+		}
+		if err == nil && len(ran) == 0 {
+			fmt.Println("nothing to migrate")
+		}
+		return err
+	})
+
+	var backupFile string
+	backup := newCommand(group, "backup", "dump every collection as gzipped json lines", func(app *App) error {
+		if len(backupFile) == 0 {
+			backupFile = "./private/backup-" + time.Now().Format("2006-01-02T15-04-05") + ".jsonl.gz"
+		}
+		out, err := outputFile(backupFile)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		count, err := app.Backup(out)
+		if err == nil && out != os.Stdout {
+			fmt.Println("backed up ", count, " documents to ", backupFile)
+		}
+		return err
+	})
+	backup.String(&backupFile, "o", "out", "file to write to, ./private/backup-<time>.jsonl.gz by default")
+
+	var restoreFile string
+	restore := newCommand(group, "restore", "load a backup back in, replacing documents that already exist", func(app *App) error {
+		in, err := os.Open(restoreFile)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		count, err := app.Restore(in)
+		if err == nil {
+			fmt.Println("restored ", count, " documents")
+		}
+		return err
+	})
+	restore.AddPositionalValue(&restoreFile, "file", 1, true, "backup file to restore")
+}
+
+func registerEmailCommands() {
+	group := newGroup("email", "email tools")
+
+	var to string
+	test := newCommand(group, "test", "send a test email to check the smtp and dkim setup", func(app *App) error {
+		recipients := app.Conf.MaintainerEmails
+		if len(to) != 0 {
+			recipients = []string{to}
+		}
+		if len(recipients) == 0 {
+			return ErrInvalidEmail
+		}
+		mail := app.Emailer.Make()
+		mail.Subject(app.Conf.AppName + " test email")
+		mail.To(recipients...)
+		mail.Plain().Set("If you can read this, " + app.Conf.AppName + " can send emails.\n\nSent " + time.Now().Format(time.RFC1123))
+		err := app.Emailer.Send(mail)
+		if err == nil {
+			fmt.Println("sent a test email to ", strings.Join(recipients, ", "))
+		}
+		return err
+	})
+	test.String(&to, "t", "to", "who to send it to, the maintainers by default")
+}
+
+func registerSiteCommands() {
+	group := newGroup("site", "the static copy of the site")
+
+	var out string
+	var full bool
+	build := newCommand(group, "build", "render every public writ, the index, tag pages, feeds and assets into a static directory", func(app *App) error {
+		if len(out) == 0 {
+			out = "./private/static"
+		}
+		report, err := app.BuildStaticSite(out, full)
+		if err != nil {
+			return err
+		}
+		fmt.Println("rendered ", report.Rendered, " writs, ", report.Skipped, " unchanged, ", report.Removed, " removed")
+		fmt.Println(report.Tags, " tag pages, ", report.Assets, " assets copied to ", out)
+		return nil
+	})
+	build.String(&out, "o", "out", "directory to build into, ./private/static by default")
+	build.Bool(&full, "f", "full", "re-render every writ, not just the ones edited since the last build")
+}
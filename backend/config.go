@@ -0,0 +1,502 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix environment variables starting with this override config keys,
+// SAULAPP_DB_PASSWORD sets db_password and a double underscore reaches into
+// sections, SAULAPP_ADMIN_EMAIL__PASSWORD sets admin_email.password
+const EnvPrefix = "SAULAPP_"
+
+// Config the app's settings, read from a json, toml or yaml file
+type Config struct {
+	AppName          string   `json:"appname"`
+	Domain           string   `json:"domain"`
+	DevMode          bool     `json:"devmode"`
+	Assets           string   `json:"assets"`
+	MaintainerEmails []string `json:"maintainer_emails"`
+	DKIMKey          string   `json:"dkim_key"`
+	AdminEmail       struct {
+		Email    string     `json:"email"`
+		Server   string     `json:"server"`
+		Port     ConfigPort `json:"port"`
+		Password string     `json:"password"`
+		Name     string     `json:"name"`
+	} `json:"admin_email"`
+
+	Port            ConfigPort `json:"port"`
+	InsecurePort    ConfigPort `json:"insecurePort"`
+	DevPort         ConfigPort `json:"devPort"`
+	DevInsecurePort ConfigPort `json:"devInsecurePort"`
+	HTTPSCert       string     `json:"https_cert"`
+	HTTPSKey        string     `json:"https_key"`
+
+	DBLocalAddress []string `json:"db_local_address"`
+	DBAddress      []string `json:"db_address"`
+	DBName         string   `json:"db_name"`
+	DBUsername     string   `json:"db_username"`
+	DBPassword     string   `json:"db_password"`
+	DBCA           string   `json:"db_ca"`
+	DBServerName   string   `json:"db_server_name"`
+
+	TokenSecret    string `json:"token_secret"`
+	VerifierSecret string `json:"verifier_secret"`
+	OIDCKey        string `json:"oidc_key"`
+	Exports        string `json:"exports"`
+	WritsDir       string `json:"writs_dir"`
+	Theme          string `json:"theme"`
+
+	TrustedProxies []string `json:"trusted_proxies"`
+	ProxyProtocol  bool     `json:"proxy_protocol"`
+
+	ACME *struct {
+		Disabled     bool     `json:"disabled"`
+		DirectoryURL string   `json:"directory_url"`
+		Email        string   `json:"email"`
+		Cache        string   `json:"cache"`
+		RenewBefore  string   `json:"renew_before"`
+		Domains      []string `json:"domains"`
+		CABundle     string   `json:"ca_bundle"`
+	} `json:"acme"`
+
+	TLS struct {
+		MinVersion    string   `json:"min_version"`
+		Ciphers       []string `json:"ciphers"`
+		WatchInterval string   `json:"watch_interval"`
+	} `json:"tls"`
+
+	Security struct {
+		HSTSMaxAge        *int64            `json:"hsts_max_age"`
+		HSTSSubdomains    *bool             `json:"hsts_subdomains"`
+		CSPReportOnly     *bool             `json:"csp_report_only"`
+		ReferrerPolicy    *string           `json:"referrer_policy"`
+		PermissionsPolicy *string           `json:"permissions_policy"`
+		FrameAncestors    *string           `json:"frame_ancestors"`
+		CSP               map[string]string `json:"csp"`
+	} `json:"security"`
+
+	RateLimit struct {
+		Backend  string `json:"backend"`
+		Policies map[string]struct {
+			Limit  *int64  `json:"limit"`
+			Window *string `json:"window"`
+			Key    *string `json:"key"`
+		} `json:"policies"`
+		Routes map[string]string `json:"routes"`
+	} `json:"ratelimit"`
+
+	Sanitize map[string]string `json:"sanitize"`
+
+	Cache struct {
+		Disabled   bool   `json:"disabled"`
+		MaxEntries int    `json:"max_entries"`
+		MaxBytes   int64  `json:"max_bytes"`
+		TTL        string `json:"ttl"`
+	} `json:"cache"`
+}
+
+// ConfigPort a port number, written either as a number or a string
+type ConfigPort string
+
+// UnmarshalJSON take "8080" and 8080 alike
+func (p *ConfigPort) UnmarshalJSON(data []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err == nil {
+		*p = ConfigPort(n.String())
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("ports should be numbers")
+	}
+	*p = ConfigPort(s)
+	return nil
+}
+
+// ConfigErrors every problem found with a config, so they can all be fixed in one go
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = " - " + err.Error()
+	}
+	return "the config has " + strconv.Itoa(len(errs)) + " problem(s):\n" + strings.Join(lines, "\n")
+}
+
+// LoadConfig read a config file, apply SAULAPP_* environment overrides and
+// swap every *_file key for the (trimmed) contents of the file it names
+func LoadConfig(location string) (*Config, error) {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree map[string]interface{}
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".toml":
+		tree, err = parseTOML(data)
+	case ".yaml", ".yml":
+		tree, err = parseYAML(data)
+	default:
+		err = json.Unmarshal(data, &tree)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config %s: %v", location, err)
+	}
+	if tree == nil {
+		tree = map[string]interface{}{}
+	}
+
+	applyEnvOverrides(tree, os.Environ())
+	problems := resolveSecretFiles(tree, "")
+
+	raw, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Config{}
+	if err = json.Unmarshal(raw, conf); err != nil {
+		problems = append(problems, describeJSONError(err))
+	}
+	if len(problems) != 0 {
+		return conf, problems
+	}
+	return conf, nil
+}
+
+func describeJSONError(err error) error {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return fmt.Errorf("%s should be a %s, not a %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	return err
+}
+
+// applyEnvOverrides set config keys from SAULAPP_* variables, each value is read as
+// whatever type the Config field it lands on has, so a password of 123 stays a string
+func applyEnvOverrides(tree map[string]interface{}, environ []string) {
+	for _, entry := range environ {
+		if !strings.HasPrefix(entry, EnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(entry, EnvPrefix), "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			continue
+		}
+		path := strings.Split(strings.ToLower(parts[0]), "__")
+
+		value := coerceEnvValue(configFieldType(path), parts[1])
+
+		node := tree
+		for _, key := range path[:len(path)-1] {
+			key = envKey(node, key)
+			next, ok := node[key].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				node[key] = next
+			}
+			node = next
+		}
+		node[envKey(node, path[len(path)-1])] = value
+	}
+}
+
+// configFieldType the type of the Config field a path of lowercased keys leads to,
+// nil when there's no such field
+func configFieldType(path []string) reflect.Type {
+	t := reflect.TypeOf(Config{})
+	for _, key := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			var field reflect.Type
+			for i := 0; i < t.NumField(); i++ {
+				name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+				if strings.ToLower(name) == key {
+					field = t.Field(i).Type
+					break
+				}
+			}
+			if field == nil {
+				return nil
+			}
+			t = field
+		default:
+			return nil
+		}
+	}
+	return t
+}
+
+// coerceEnvValue read an env var as the field's type, values that don't parse are
+// left as strings so decoding the config reports them as the wrong type
+func coerceEnvValue(t reflect.Type, raw string) interface{} {
+	if t == nil {
+		return raw
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(strings.TrimSpace(raw)); err == nil {
+			return b
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64); err == nil {
+			return n
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, err := strconv.ParseUint(strings.TrimSpace(raw), 10, 64); err == nil {
+			return n
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(raw), 64); err == nil {
+			return f
+		}
+	case reflect.Slice:
+		// a json array, or a plain comma separated list
+		var list []interface{}
+		if err := json.Unmarshal([]byte(raw), &list); err == nil {
+			return list
+		}
+		items := []interface{}{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); len(item) != 0 {
+				items = append(items, coerceEnvValue(t.Elem(), item))
+			}
+		}
+		return items
+	case reflect.Map, reflect.Struct:
+		var tree map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &tree); err == nil {
+			return tree
+		}
+	}
+	return raw
+}
+
+// envKey match a lowercased env var name to a key that may be camelCased, like devPort
+func envKey(node map[string]interface{}, key string) string {
+	for existing := range node {
+		if strings.ToLower(existing) == key {
+			return existing
+		}
+	}
+	for _, known := range []string{"insecurePort", "devPort", "devInsecurePort"} {
+		if strings.ToLower(known) == key {
+			return known
+		}
+	}
+	return key
+}
+
+// resolveSecretFiles turn token_secret_file: /run/secrets/token into token_secret: <contents>
+func resolveSecretFiles(tree map[string]interface{}, prefix string) ConfigErrors {
+	problems := ConfigErrors{}
+	for key, value := range tree {
+		if section, ok := value.(map[string]interface{}); ok {
+			problems = append(problems, resolveSecretFiles(section, prefix+key+".")...)
+			continue
+		}
+		if !strings.HasSuffix(key, "_file") {
+			continue
+		}
+		location, ok := value.(string)
+		if !ok {
+			problems = append(problems, fmt.Errorf("%s%s should be the path of a file", prefix, key))
+			continue
+		}
+		data, err := ioutil.ReadFile(location)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s%s: %v", prefix, key, err))
+			continue
+		}
+		delete(tree, key)
+		tree[strings.TrimSuffix(key, "_file")] = strings.TrimSpace(string(data))
+	}
+	return problems
+}
+
+// Validate check every setting the app needs, returning all the problems at once
+func (conf *Config) Validate(devMode bool) error {
+	problems := ConfigErrors{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+	required := func(name, value string) {
+		if len(strings.TrimSpace(value)) == 0 {
+			problem("%s is missing", name)
+		}
+	}
+	port := func(name string, value ConfigPort) {
+		if n, err := strconv.Atoi(string(value)); err != nil || n < 1 || n > 65535 {
+			problem("%s should be a port number, got %q", name, value)
+		}
+	}
+	file := func(name, location string) {
+		if len(location) == 0 {
+			return
+		}
+		if _, err := os.Stat(location); err != nil {
+			problem("%s: %v", name, err)
+		}
+	}
+	duration := func(name, value string) {
+		if len(value) == 0 {
+			return
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			problem("%s should be a duration like 10m or 720h, got %q", name, value)
+		}
+	}
+
+	required("appname", conf.AppName)
+	required("domain", conf.Domain)
+	required("assets", conf.Assets)
+	if info, err := os.Stat(conf.Assets); len(conf.Assets) != 0 && (err != nil || !info.IsDir()) {
+		problem("assets should be a folder, %q isn't one", conf.Assets)
+	}
+	for _, email := range conf.MaintainerEmails {
+		if !validEmail(email) {
+			problem("maintainer_emails: %q isn't a valid email", email)
+		}
+	}
+
+	required("dkim_key", conf.DKIMKey)
+	file("dkim_key", conf.DKIMKey)
+	required("admin_email.email", conf.AdminEmail.Email)
+	required("admin_email.server", conf.AdminEmail.Server)
+	required("admin_email.password", conf.AdminEmail.Password)
+	port("admin_email.port", conf.AdminEmail.Port)
+
+	if devMode || conf.DevMode {
+		port("devPort", conf.DevPort)
+		port("devInsecurePort", conf.DevInsecurePort)
+		required("https_cert", conf.HTTPSCert)
+		required("https_key", conf.HTTPSKey)
+	} else {
+		port("port", conf.Port)
+		port("insecurePort", conf.InsecurePort)
+	}
+	file("https_cert", conf.HTTPSCert)
+	file("https_key", conf.HTTPSKey)
+
+	if len(conf.DBLocalAddress) == 0 && len(conf.DBAddress) == 0 {
+		problem("db_local_address or db_address needs at least one endpoint")
+	}
+	required("db_name", conf.DBName)
+	required("db_username", conf.DBUsername)
+	required("db_password", conf.DBPassword)
+	file("db_ca", conf.DBCA)
+
+	// branca keys are 32 bytes
+	if len(conf.TokenSecret) != 32 {
+		problem("token_secret should be 32 characters long, it's %d", len(conf.TokenSecret))
+	}
+	if len(conf.VerifierSecret) != 32 {
+		problem("verifier_secret should be 32 characters long, it's %d", len(conf.VerifierSecret))
+	}
+
+	for _, entry := range conf.TrustedProxies {
+		if net.ParseIP(entry) == nil {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				problem("trusted_proxies: %q is not a valid cidr or ip", entry)
+			}
+		}
+	}
+
+	if conf.ACME != nil && !conf.ACME.Disabled {
+		duration("acme.renew_before", conf.ACME.RenewBefore)
+		file("acme.ca_bundle", conf.ACME.CABundle)
+	}
+
+	if len(conf.TLS.MinVersion) != 0 {
+		if _, ok := tlsVersions[strings.TrimPrefix(conf.TLS.MinVersion, "TLS")]; !ok {
+			problem("tls.min_version should be one of 1.0, 1.1, 1.2 or 1.3")
+		}
+	}
+	for _, name := range conf.TLS.Ciphers {
+		if _, ok := cipherSuiteByName(name); !ok {
+			problem("tls.ciphers: unknown cipher suite %s", name)
+		}
+	}
+	duration("tls.watch_interval", conf.TLS.WatchInterval)
+
+	if backend := conf.RateLimit.Backend; len(backend) != 0 && backend != "memory" && backend != "arangodb" {
+		problem("ratelimit.backend should be memory or arangodb, got %q", backend)
+	}
+	for name, policy := range conf.RateLimit.Policies {
+		if policy.Window != nil {
+			duration("ratelimit.policies."+name+".window", *policy.Window)
+		}
+		if policy.Key != nil && *policy.Key != "ip" && *policy.Key != "user" && *policy.Key != "email" {
+			problem("ratelimit.policies.%s.key should be ip, user or email", name)
+		}
+	}
+	defaultPolicies := DefaultRateLimitPolicies()
+	for prefix, policy := range conf.RateLimit.Routes {
+		if _, ok := conf.RateLimit.Policies[policy]; !ok && defaultPolicies[policy] == nil {
+			problem("ratelimit.routes.%s uses an unknown policy %q", prefix, policy)
+		}
+	}
+
+	duration("cache.ttl", conf.Cache.TTL)
+	if conf.Cache.MaxEntries < 0 || conf.Cache.MaxBytes < 0 {
+		problem("cache.max_entries and cache.max_bytes can't be negative")
+	}
+
+	for role, policy := range conf.Sanitize {
+		if policy != "strict" && policy != "ugc" && policy != "rich" {
+			problem("sanitize.%s should be strict, ugc or rich", role)
+		}
+		known := false
+		for _, name := range RoleNames {
+			known = known || name == role
+		}
+		if !known {
+			problem("sanitize: unknown role %q", role)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+	return problems
+}
+
+// checkConfig load and validate a config, gathering the problems from both steps
+func checkConfig(location string, devMode bool) (*Config, error) {
+	conf, err := LoadConfig(location)
+	if conf == nil {
+		return nil, err
+	}
+	problems := ConfigErrors{}
+	if loadProblems, ok := err.(ConfigErrors); ok {
+		problems = append(problems, loadProblems...)
+	}
+	if validationProblems, ok := conf.Validate(devMode).(ConfigErrors); ok {
+		problems = append(problems, validationProblems...)
+	}
+	if len(problems) != 0 {
+		return conf, problems
+	}
+	return conf, nil
+}
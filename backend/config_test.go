@@ -0,0 +1,37 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	cases := []struct {
+		name string
+		env  string
+		want m
+	}{
+		{"numeric password stays a string", "SAULAPP_DB_PASSWORD=123", m{"db_password": "123"}},
+		{"boolean looking secret stays a string", "SAULAPP_TOKEN_SECRET=true", m{"token_secret": "true"}},
+		{"json looking name stays a string", "SAULAPP_APPNAME=[saul]", m{"appname": "[saul]"}},
+		{"ports stay strings", "SAULAPP_DEVPORT=8080", m{"devPort": "8080"}},
+		{"booleans", "SAULAPP_DEVMODE=1", m{"devmode": true}},
+		{"unparseable booleans are left for decoding to report", "SAULAPP_DEVMODE=maybe", m{"devmode": "maybe"}},
+		{"ints", "SAULAPP_CACHE__MAX_ENTRIES= 50", m{"cache": m{"max_entries": int64(50)}}},
+		{"pointers", "SAULAPP_SECURITY__HSTS_MAX_AGE=600", m{"security": m{"hsts_max_age": int64(600)}}},
+		{"comma separated lists", "SAULAPP_DB_ADDRESS=tcp://a:8529, tcp://b:8529",
+			m{"db_address": l{"tcp://a:8529", "tcp://b:8529"}}},
+		{"json lists", `SAULAPP_MAINTAINER_EMAILS=["a@b.c"]`, m{"maintainer_emails": l{"a@b.c"}}},
+		{"into maps", "SAULAPP_RATELIMIT__POLICIES__AUTH__LIMIT=5",
+			m{"ratelimit": m{"policies": m{"auth": m{"limit": int64(5)}}}}},
+		{"map values", "SAULAPP_SANITIZE__DEFAULT=1", m{"sanitize": m{"default": "1"}}},
+		{"unknown keys stay strings", "SAULAPP_TOKEN_SECRET_FILE=42", m{"token_secret_file": "42"}},
+	}
+	for _, tc := range cases {
+		tree := m{}
+		applyEnvOverrides(tree, []string{tc.env, "OTHER=1"})
+		if !reflect.DeepEqual(tree, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, tree, tc.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// CSRFCookie the cookie holding the double-submit csrf token
+	CSRFCookie = "CSRF"
+	// CSRFHeader the header scripts send the csrf token back in
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFField the form field html forms send the csrf token back in
+	CSRFField = "csrf"
+)
+
+var (
+	// CSRFExempt routes that take no cookie auth, so they don't need csrf checks
+	CSRFExempt = map[string]bool{
+		"/oauth/token": true,
+		"/csp-report":  true,
+	}
+	// CSRFRejectedError csrf check failed, refusing to change anything
+	CSRFRejectedError = func(c ctx) error {
+		return JSONErr(c, 403, "missing or invalid csrf token, refresh and try again")
+	}
+)
+
+// csrfToken get the request's csrf token, handing out a fresh cookie if there isn't one yet
+func (app *App) csrfToken(c ctx) string {
+	if cookie, err := c.Cookie(CSRFCookie); err == nil && len(cookie.Value) == 32 {
+		return cookie.Value
+	}
+	token := RandStr(32)
+	cookie := &http.Cookie{
+		Name:    CSRFCookie,
+		Value:   token,
+		Expires: time.Now().Add(oneweek),
+		MaxAge:  int(oneweek.Seconds()),
+		Path:    "/",
+		// scripts need to read it, so it can't be HttpOnly
+		HttpOnly: false,
+	}
+	if !app.DevMode {
+		cookie.Domain = app.Conf.Domain
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteStrictMode
+	}
+	c.SetCookie(cookie)
+	return token
+}
+
+// sameOrigin check a request's Origin (or failing that, Referer) is this app
+func (app *App) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		ref, err := url.Parse(r.Header.Get("Referer"))
+		if err != nil || len(ref.Host) == 0 {
+			// neither header is set, browsers always send one of them cross-site
+			// so this is a non-browser client
+			return true
+		}
+		origin = ref.Scheme + "://" + ref.Host
+	}
+	return origin == app.AppURL("")
+}
+
+// CSRFMiddleware guard every state-changing request made with the Auth cookie,
+// the origin has to be this app and the csrf cookie has to be echoed back
+// in the X-CSRF-Token header or a csrf form field
+func (app *App) CSRFMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c ctx) error {
+			r := c.Request()
+			switch r.Method {
+			case "GET", "HEAD", "OPTIONS", "TRACE":
+				return next(c)
+			}
+			if CSRFExempt[r.URL.Path] {
+				return next(c)
+			}
+
+			if !app.sameOrigin(r) {
+				if app.DevMode {
+					fmt.Println("CSRF - cross origin request rejected: ", r.Method, r.URL.Path, r.Header.Get("Origin"))
+				}
+				return CSRFRejectedError(c)
+			}
+
+			if _, err := c.Cookie("Auth"); err != nil {
+				// without the auth cookie there's nothing to forge
+				return next(c)
+			}
+
+			cookie, err := c.Cookie(CSRFCookie)
+			if err != nil || len(cookie.Value) == 0 {
+				return CSRFRejectedError(c)
+			}
+			token := r.Header.Get(CSRFHeader)
+			if len(token) == 0 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+				token = c.FormValue(CSRFField)
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+				if app.DevMode {
+					fmt.Println("CSRF - token mismatch: ", r.Method, r.URL.Path)
+				}
+				return CSRFRejectedError(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+func initCSRF(app *App) {
+	app.Server.GET("/csrf", func(c ctx) error {
+		c.Response().Header().Set("Cache-Control", "no-store")
+		return c.JSON(200, obj{"token": app.csrfToken(c), "header": CSRFHeader})
+	})
+}
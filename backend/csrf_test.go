@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSameOrigin(t *testing.T) {
+	app, _ := testApp(t, "csrf")
+	self := app.AppURL("")
+	cases := []struct {
+		name    string
+		origin  string
+		referer string
+		want    bool
+	}{
+		{"same origin", self, "", true},
+		{"other origin", "https://evil.test", "", false},
+		{"origin wins over referer", "https://evil.test", self + "/writ/x", false},
+		{"plain http origin", strings.Replace(self, "https://", "http://", 1), "", false},
+		{"subdomain", "https://evil." + app.Conf.Domain, "", false},
+		{"same referer", "", self + "/writ/x?y=1", true},
+		{"other referer", "", "https://evil.test/" + app.Conf.Domain, false},
+		{"null origin", "null", "", false},
+		{"neither, not a browser", "", "", true},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("POST", "/writ", nil)
+		if len(tc.origin) > 0 {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if len(tc.referer) > 0 {
+			req.Header.Set("Referer", tc.referer)
+		}
+		if got := app.sameOrigin(req); got != tc.want {
+			t.Errorf("%s: same origin %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	app, _ := testApp(t, "csrf")
+	self := app.AppURL("")
+	token := "a csrf token that's 32 long...."
+	auth := &http.Cookie{Name: "Auth", Value: "not checked before csrf"}
+	csrf := &http.Cookie{Name: CSRFCookie, Value: token}
+
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		origin  string
+		cookies []*http.Cookie
+		header  string
+		form    string
+		// rejected whether it got csrf's 403
+		rejected bool
+	}{
+		{"gets aren't checked", "GET", "/csrf", "https://evil.test", []*http.Cookie{auth}, "", "", false},
+		{"cookie auth without a token", "POST", "/writ", self, []*http.Cookie{auth, csrf}, "", "", true},
+		{"cookie auth without the csrf cookie", "POST", "/writ", self, []*http.Cookie{auth}, token, "", true},
+		{"cookie auth with a wrong token", "POST", "/writ", self, []*http.Cookie{auth, csrf}, "not the token", "", true},
+		{"cookie auth with the header", "POST", "/writ", self, []*http.Cookie{auth, csrf}, token, "", false},
+		{"cookie auth with the form field", "POST", "/oauth/authorize", self, []*http.Cookie{auth, csrf}, "", token, false},
+		{"deletes are checked too", "DELETE", "/me", self, []*http.Cookie{auth, csrf}, "", "", true},
+		{"cross origin with the token", "POST", "/writ", "https://evil.test", []*http.Cookie{auth, csrf}, token, "", true},
+		{"cross origin without cookies", "POST", "/auth", "https://evil.test", nil, "", "", true},
+		{"no auth cookie, nothing to forge", "POST", "/auth", self, nil, "", "", false},
+		{"token endpoint from another origin", "POST", "/oauth/token", "https://client.test", []*http.Cookie{auth}, "", "", false},
+		{"csp reports", "POST", "/csp-report", "https://evil.test", nil, "", "", false},
+	}
+	for _, tc := range cases {
+		var body *strings.Reader
+		if len(tc.form) > 0 {
+			body = strings.NewReader(url.Values{CSRFField: {tc.form}}.Encode())
+		} else {
+			body = strings.NewReader("{}")
+		}
+		req := httptest.NewRequest(tc.method, tc.path, body)
+		if len(tc.form) > 0 {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Origin", tc.origin)
+		if len(tc.header) > 0 {
+			req.Header.Set(CSRFHeader, tc.header)
+		}
+		for _, cookie := range tc.cookies {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		app.ServeHTTP(res, req)
+		rejected := res.Code == 403 && strings.Contains(res.Body.String(), "csrf")
+		if rejected != tc.rejected {
+			t.Errorf("%s: got %d %s", tc.name, res.Code, res.Body.String())
+		}
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	app, _ := testApp(t, "csrf")
+
+	res := httptest.NewRecorder()
+	app.ServeHTTP(res, httptest.NewRequest("GET", "/csrf", nil))
+	var cookie *http.Cookie
+	for _, c := range res.Result().Cookies() {
+		if c.Name == CSRFCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || len(cookie.Value) != 32 || cookie.HttpOnly {
+		t.Fatalf("bad csrf cookie %v", cookie)
+	}
+	if !strings.Contains(res.Body.String(), cookie.Value) {
+		t.Errorf("the token %q isn't in the body %s", cookie.Value, res.Body.String())
+	}
+
+	// an existing token is kept
+	req := httptest.NewRequest("GET", "/csrf", nil)
+	req.AddCookie(cookie)
+	res = httptest.NewRecorder()
+	app.ServeHTTP(res, req)
+	if len(res.Result().Cookies()) != 0 || !strings.Contains(res.Body.String(), cookie.Value) {
+		t.Errorf("a fresh token was handed out over %q: %s", cookie.Value, res.Body.String())
+	}
+}
@@ -2,44 +2,36 @@ package backend
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"time"
 
 	"github.com/arangodb/go-driver"
-	"github.com/arangodb/go-driver/http"
+	arangohttp "github.com/arangodb/go-driver/http"
 )
 
 var (
-	// DB central arangodb database for querying
-	DB driver.Database
-	// Users arangodb collection containing user data
-	Users driver.Collection
-	// Writs arangodb writ collection containing writs
-	Writs driver.Collection
-	// RateLimits arangodb ratelimits collection
-	RateLimits driver.Collection
 	// ErrBadDBConnection bad database connection, try different details
 	ErrBadDBConnection = errors.New("bad database connection error, try different details")
-	// DBHealthTicker to see if the DB is still ok
-	DBHealthTicker *time.Ticker
-	// DBAlive does the db still live?
-	DBAlive     bool
-	dbendpoints []string
 )
 
-func setupDB(endpoints []string, dbname, username, password string) error {
+// setupDB connect to the db and get the app's core collections and their indexes ready
+func (app *App) setupDB(endpoints []string, dbname, username, password string) error {
 	fmt.Println(`Attempting ArangoDB connection...`)
 
+	tlsConfig, err := app.dbTLSConfig()
+	if err != nil {
+		fmt.Println("Bad db_ca bundle: ", err)
+		return err
+	}
+	app.pingclient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+
 	// Create an HTTP connection to the database
-	conn, err := http.NewConnection(http.ConnectionConfig{
+	conn, err := arangohttp.NewConnection(arangohttp.ConnectionConfig{
 		Endpoints: endpoints,
-		TLSConfig: &tls.Config{
-			ServerName:         AppDomain,
-			InsecureSkipVerify: true,
-		},
+		TLSConfig: tlsConfig,
 	})
 
 	if err != nil {
@@ -56,7 +48,7 @@ func setupDB(endpoints []string, dbname, username, password string) error {
 		return err
 	}
 
-	dbendpoints = endpoints
+	app.dbendpoints = endpoints
 
 	db, err := client.Database(nil, dbname)
 	if err != nil {
@@ -64,22 +56,22 @@ func setupDB(endpoints []string, dbname, username, password string) error {
 		return err
 	}
 
-	DB = db
-	users, err := DB.Collection(nil, "users")
+	app.DB = db
+	users, err := app.ensureCollection("users")
 	if err != nil {
 		fmt.Println("Could not get users collection from db:")
 		return err
 	}
-	Users = users
+	app.Users = users
 
-	writs, err := DB.Collection(nil, "writs")
+	writs, err := app.ensureCollection("writs")
 	if err != nil {
 		fmt.Println("Could not get users collection from db:")
 		return err
 	}
-	Writs = writs
+	app.Writs = writs
 
-	_, _, err = Users.EnsureHashIndex(
+	_, _, err = app.Users.EnsureHashIndex(
 		nil,
 		[]string{"username", "email", "emailmd5"},
 		&driver.EnsureHashIndexOptions{Unique: true},
@@ -88,7 +80,7 @@ func setupDB(endpoints []string, dbname, username, password string) error {
 		return err
 	}
 
-	_, _, err = Users.EnsureHashIndex(
+	_, _, err = app.Users.EnsureHashIndex(
 		nil,
 		[]string{"verifier"},
 		&driver.EnsureHashIndexOptions{Unique: true, Sparse: true},
@@ -97,7 +89,7 @@ func setupDB(endpoints []string, dbname, username, password string) error {
 		return err
 	}
 
-	_, _, err = Writs.EnsureHashIndex(
+	_, _, err = app.Writs.EnsureHashIndex(
 		nil,
 		[]string{"title", "tags", "slug"},
 		&driver.EnsureHashIndexOptions{Unique: true},
@@ -106,27 +98,57 @@ func setupDB(endpoints []string, dbname, username, password string) error {
 		return err
 	}
 
-	ratelimits, err := DB.Collection(nil, "ratelimits")
+	_, _, err = app.Writs.EnsureSkipListIndex(nil, []string{"created"}, nil)
+	if err != nil {
+		return err
+	}
+
+	ratelimits, err := app.ensureCollection("ratelimits")
 	if err != nil {
 		fmt.Println("Could not get ratelimiting collection from db:")
 		return err
 	}
-	RateLimits = ratelimits
+	app.RateLimits = ratelimits
+
+	audits, err := app.ensureCollection("audit")
+	if err != nil {
+		fmt.Println("Could not get audit collection from db:")
+		return err
+	}
+	app.Audits = audits
+
+	spentValues, err := app.ensureCollection("spent")
+	if err != nil {
+		fmt.Println("Could not get spent collection from db:")
+		return err
+	}
+	app.Spent = spentValues
+	_, _, err = app.Spent.EnsureSkipListIndex(nil, []string{"expires"}, nil)
 
 	return err
 }
 
-var diedEmails = 0
+// ensureCollection get a collection from the db, creating it first if it doesn't exist yet
+func (app *App) ensureCollection(name string) (driver.Collection, error) {
+	exists, err := app.DB.CollectionExists(nil, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return app.DB.CreateCollection(nil, name, nil)
+	}
+	return app.DB.Collection(nil, name)
+}
 
-func dbdiedEmergencyEmail(msg string, die bool) {
-	if diedEmails != 0 {
+func (app *App) dbdiedEmergencyEmail(msg string, die bool) {
+	if app.diedEmails != 0 {
 		return
 	}
-	diedEmails++
+	app.diedEmails++
 	fmt.Println("Server.. Going.. Down, hang ten we might be reborn! - \n\t", msg)
-	mail := MakeEmail()
-	mail.To(MaintainerEmails...)
-	mail.Subject("the/a " + AppDomain + " database has died, you need to fix it asap!")
+	mail := app.Emailer.Make()
+	mail.To(app.Conf.MaintainerEmails...)
+	mail.Subject("the/a " + app.Conf.Domain + " database has died, you need to fix it asap!")
 	mail.Plain().Set(`
 	msg:
 	` + msg + `
@@ -141,7 +163,7 @@ func dbdiedEmergencyEmail(msg string, die bool) {
 
 	Hurry up!!
 	`)
-	SendEmail(mail)
+	app.Emailer.Send(mail)
 
 	if die {
 		fmt.Println("the Database is kaput!!!")
@@ -149,31 +171,37 @@ func dbdiedEmergencyEmail(msg string, die bool) {
 	}
 }
 
-func startDBHealthCheck() {
-	DBHealthTicker = time.NewTicker(20 * time.Second)
+// startDBHealthCheck ping the db every 20s until the app stops, if it dies try to bring it
+// back (shutting the app down first) or email the maintainers
+func (app *App) startDBHealthCheck(shutdown func()) {
+	ticker := time.NewTicker(20 * time.Second)
 	go func() {
-		for range DBHealthTicker.C {
-			for _, endpoint := range dbendpoints {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+			for _, endpoint := range app.dbendpoints {
 				start := time.Now()
-				DBAlive = Ping(endpoint)
+				app.DBAlive = app.Ping(endpoint)
 
-				if !DBAlive {
+				if !app.DBAlive {
 					if time.Since(start) < 8*time.Millisecond {
 						go func() {
-							DBHealthTicker.Stop()
-							redirectServer.Close()
-							Server.Close()
+							shutdown()
 
-							err := exeC(`nohup bash -c "nohup arangod -c /etc/arangodb3/arangod.conf &" && (sleep 10 && cd /var/app && sudo ./main) & `)
+							err := app.exeC(`nohup bash -c "nohup arangod -c /etc/arangodb3/arangod.conf &" && (sleep 10 && cd /var/app && sudo ./main) & `)
 							if err != nil {
 								fmt.Println("could not redeem self in the face of hardship!: ", err)
-								dbdiedEmergencyEmail("unable to self recusitate! :(", true)
+								app.dbdiedEmergencyEmail("unable to self recusitate! :(", true)
 							}
 
-							dbdiedEmergencyEmail("something really bad happened with the db", true)
+							app.dbdiedEmergencyEmail("something really bad happened with the db", true)
 						}()
 					} else {
-						dbdiedEmergencyEmail("it seems the DB is remote, only you can save us now!", true)
+						app.dbdiedEmergencyEmail("it seems the DB is remote, only you can save us now!", true)
 					}
 				}
 			}
@@ -183,10 +211,10 @@ func startDBHealthCheck() {
 }
 
 // Query query the app's DB with AQL, bindvars, and map that to an output
-func Query(query string, vars obj) ([]obj, error) {
+func (app *App) Query(query string, vars obj) ([]obj, error) {
 	var objects []obj
 	ctx := driver.WithQueryCount(context.Background())
-	cursor, err := DB.Query(ctx, query, vars)
+	cursor, err := app.DB.Query(ctx, query, vars)
 	if err == nil {
 		defer cursor.Close()
 		objects = []obj{}
@@ -203,9 +231,9 @@ func Query(query string, vars obj) ([]obj, error) {
 }
 
 // QueryOne query the app's DB with AQL, bindvars, and map that to an output
-func QueryOne(query string, vars obj, result interface{}) error {
+func (app *App) QueryOne(query string, vars obj, result interface{}) error {
 	ctx := driver.WithQueryCount(context.Background())
-	cursor, err := DB.Query(ctx, query, vars)
+	cursor, err := app.DB.Query(ctx, query, vars)
 	if err == nil {
 		_, err = cursor.ReadDocument(ctx, result)
 		cursor.Close()
@@ -17,52 +17,88 @@ import (
 	"github.com/driusan/dkim"
 )
 
-// EmailSettings - email configuration and setup to send authtokens and stuff
+// Emailer - email configuration and setup to send authtokens and stuff,
+// one per App so instances can mail from different accounts
+type Emailer struct {
+	Address  string
+	Server   string
+	Port     string
+	FromName string
+	Email    string
+	Password string
+	// Domain the app's domain, message ids end in it
+	Domain string
+
+	auth      smtp.Auth
+	signature dkim.Signature
+	dkimKey   *rsa.PrivateKey
+}
+
 var (
-	SMTPAuth      smtp.Auth
-	DKIMSignature dkim.Signature
-	EmailConf     = struct {
-		Address  string
-		Server   string
-		Port     string
-		FromName string
-		Email    string
-		Password string
-	}{}
-	PrivateDKIMkey *rsa.PrivateKey
 	// ErrInvalidEmail bad email
 	ErrInvalidEmail = errors.New(`invalid email address`)
 )
 
-// startEmailer - initialize the blog's email configuration
-func startEmailer() {
-	SMTPAuth = smtp.PlainAuth("", EmailConf.Email, EmailConf.Password, EmailConf.Server)
+// NewEmailer - initialize the blog's email configuration from the admin_email
+// section of the config and a pem encoded dkim key
+func NewEmailer(conf *Config, dkimKey []byte) (*Emailer, error) {
+	e := &Emailer{
+		Email:    conf.AdminEmail.Email,
+		Server:   conf.AdminEmail.Server,
+		Port:     string(conf.AdminEmail.Port),
+		Password: conf.AdminEmail.Password,
+		FromName: conf.AdminEmail.Name,
+		Domain:   conf.Domain,
+	}
+	e.Address = e.Server + ":" + e.Port
+	e.auth = smtp.PlainAuth("", e.Email, e.Password, e.Server)
 
-	block, _ := pem.Decode(DKIMKey)
+	block, _ := pem.Decode(dkimKey)
+	if block == nil {
+		return nil, errors.New("the provided dkim key is bad, it isn't pem encoded")
+	}
 	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
-		fmt.Println("the provided dkim key is bad, fix it")
-		panic(err)
+		return nil, fmt.Errorf("the provided dkim key is bad, fix it: %v", err)
 	}
-	PrivateDKIMkey = key
+	e.dkimKey = key
 
-	DKIMSignature, err = dkim.NewSignature(
+	e.signature, err = dkim.NewSignature(
 		"relaxed/relaxed",
 		"mail",
-		EmailConf.Server,
+		e.Server,
 		[]string{"From", "Date", "Subject", "To"},
 	)
 	if err != nil {
-		fmt.Println("couldn't build a dkim signature")
-		panic(err)
+		return nil, fmt.Errorf("couldn't build a dkim signature: %v", err)
 	}
+	return e, nil
+}
+
+// Make builds a new mailyak instance
+func (e *Emailer) Make() *mailyak.MailYak {
+	return mailyak.New(e.Address, e.auth)
+}
+
+// Send send a dkim signed mailyak email
+func (e *Emailer) Send(m *mailyak.MailYak) error {
+	m.From(e.Email)
+	m.FromName(e.FromName)
+	mid, err := generateMessageID(e.Domain)
+	if err == nil {
+		m.AddHeader("Message-Id", mid)
+	}
+	return m.SignAndSend(e.signature, e.dkimKey)
+}
 
-	// Send a little test email
-	mail := MakeEmail()
-	mail.Subject(AppDomain + " server startup notification")
-	mail.To(MaintainerEmails...)
+// sendStartupNotification let the maintainers know the server is (re)starting
+func (app *App) sendStartupNotification() error {
+	appName := app.Conf.AppName
+	mail := app.Emailer.Make()
+	mail.Subject(app.Conf.Domain + " server startup notification")
+	mail.To(app.Conf.MaintainerEmails...)
 	mail.HTML().Set(`
-		The ` + AppName + ` Server is starting up.
+		The ` + appName + ` Server is starting up.
 		Everything looks good so far.
 		The startup may have been caused by a crash of some sort,
 		so do check up on that.
@@ -72,35 +108,9 @@ func startEmailer() {
 		That is all.
 		
 		Yours truly
-		The ` + AppName + ` Server.
+		The ` + appName + ` Server.
 	`)
-	err = SendEmail(mail)
-	if err != nil {
-		fmt.Println("emails aren't sending, whats wrong?", err)
-		os.Exit(2)
-	}
-
-	fmt.Println(`SMTP Emailer Started`)
-}
-
-func stopEmailer() {
-	//	EmailPool.Close()
-}
-
-// MakeEmail builds a new mailyak instance
-func MakeEmail() *mailyak.MailYak {
-	return mailyak.New(EmailConf.Address, SMTPAuth)
-}
-
-// SendEmail send a dkim signed mailyak email
-func SendEmail(m *mailyak.MailYak) error {
-	m.From(EmailConf.Email)
-	m.FromName(EmailConf.FromName)
-	mid, err := generateMessageID()
-	if err == nil {
-		m.AddHeader("Message-Id", mid)
-	}
-	return m.SignAndSend(DKIMSignature, PrivateDKIMkey)
+	return app.Emailer.Send(mail)
 }
 
 var maxBigInt = big.NewInt(math.MaxInt64)
@@ -113,14 +123,14 @@ var maxBigInt = big.NewInt(math.MaxInt64)
 // - The nanoseconds since Epoch
 // - The calling PID
 // - A cryptographically random int64
-// - The sending hostname
-func generateMessageID() (string, error) {
+// - The sending domain
+func generateMessageID(domain string) (string, error) {
 	t := time.Now().UnixNano()
 	pid := os.Getpid()
 	rint, err := rand.Int(rand.Reader, maxBigInt)
 	if err != nil {
 		return "", err
 	}
-	msgid := fmt.Sprintf("<%d.%d.%d@%s>", t, pid, rint, AppDomain)
+	msgid := fmt.Sprintf("<%d.%d.%d@%s>", t, pid, rint, domain)
 	return msgid, nil
 }
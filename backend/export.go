@@ -0,0 +1,224 @@
+package backend
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// exportSource one file in a user's data export, the query that fills it
+// and the vars it binds, arangodb won't take vars a query doesn't use
+type exportSource struct {
+	Name  string
+	Query string
+	Vars  func(*User) obj
+}
+
+func exportByKey(user *User) obj {
+	return obj{"key": user.Key}
+}
+
+func exportByEmail(user *User) obj {
+	return obj{"email": user.Email}
+}
+
+var (
+	// ExportSources everything the site stores about a user, one json file each
+	ExportSources = []exportSource{
+		{"account.json", `FOR u IN users FILTER u._key == @key RETURN UNSET(u, "verifier", "logincode", "totp")`, exportByKey},
+		{"writs.json", `FOR writ IN writs FILTER writ.authorkey == @key RETURN UNSET(writ, "likedby", "viewedby")`, exportByKey},
+		{"liked.json", `FOR writ IN writs FILTER @key IN writ.likedby RETURN KEEP(writ, "title", "slug", "created")`, exportByKey},
+		{"viewed.json", `FOR writ IN writs FILTER @key IN writ.viewedby RETURN KEEP(writ, "title", "slug", "created")`, exportByKey},
+		{"passkeys.json", `FOR c IN credentials FILTER c.userkey == @key RETURN UNSET(c, "publickey")`, exportByKey},
+		{"activity.json", `FOR a IN audit FILTER a.actorkey == @key || a.target == CONCAT("users/", @key) SORT a.created RETURN a`, exportByKey},
+		{"ratelimits.json", `FOR l IN ratelimits FILTER l._key == @email RETURN l`, exportByEmail},
+	}
+	// ExportThreshold exports with more documents than this get built in the background and emailed
+	ExportThreshold = 500
+	exportTTL       = time.Hour
+)
+
+// exportSize how many documents a user's export would hold, counted in the db
+// so deciding where to build it doesn't mean fetching it all first
+func (app *App) exportSize(user *User) (int, error) {
+	total := 0
+	for _, source := range ExportSources {
+		var count int
+		if err := app.QueryOne("RETURN LENGTH("+source.Query+")", source.Vars(user), &count); err != nil {
+			return total, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// gatherExport run every export source for a user
+func (app *App) gatherExport(user *User) (map[string][]obj, int, error) {
+	data := map[string][]obj{}
+	total := 0
+	for _, source := range ExportSources {
+		docs, err := app.Query(source.Query, source.Vars(user))
+		if err != nil {
+			return data, total, err
+		}
+		data[source.Name] = docs
+		total += len(docs)
+	}
+	return data, total, nil
+}
+
+// writeExport zip up an export's files
+func writeExport(w io.Writer, data map[string][]obj) error {
+	archive := zip.NewWriter(w)
+	for _, source := range ExportSources {
+		f, err := archive.Create(source.Name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(data[source.Name]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// buildExportInBackground gather an export, write it to disk and email the user a download link,
+// it's swept away once exportTTL has passed
+func (app *App) buildExportInBackground(user User) {
+	data, _, err := app.gatherExport(&user)
+	if err != nil {
+		fmt.Println("data export - couldn't gather export for ", user.Username, ": ", err)
+		return
+	}
+
+	name := user.Key + "-" + RandStr(16) + ".zip"
+	location := filepath.Join(app.ExportsFolder, name)
+
+	f, err := os.Create(location)
+	if err == nil {
+		err = writeExport(f, data)
+		f.Close()
+	}
+	if err != nil {
+		fmt.Println("data export - couldn't write export for ", user.Username, ": ", err)
+		os.Remove(location)
+		return
+	}
+	token, err := app.Exportinator.Encode(user.Key + "|" + name)
+	if err != nil {
+		fmt.Println("data export - couldn't make a download token: ", err)
+		return
+	}
+
+	mail := app.Emailer.Make()
+	mail.To(user.Email)
+	mail.Subject("Your " + app.Conf.AppName + " data export is ready")
+	mail.HTML().Set(`
+		<h4>Hi ` + user.Username + `, your data export is ready</h4>
+		<p><a href="` + app.AppURL("/me/export/"+token) + `">download it here</a>,
+		the link expires in an hour.</p>
+	`)
+	err = app.Emailer.Send(mail)
+	if err != nil {
+		fmt.Println("data export - couldn't email ", user.Username, ": ", err)
+	}
+}
+
+// sweepExports remove exports older than exportTTL, their links have expired anyway
+func (app *App) sweepExports() {
+	files, err := ioutil.ReadDir(app.ExportsFolder)
+	if err != nil {
+		fmt.Println("data export - couldn't read the exports folder: ", err)
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || time.Since(file.ModTime()) < exportTTL {
+			continue
+		}
+		if err := os.Remove(filepath.Join(app.ExportsFolder, file.Name())); err != nil {
+			fmt.Println("data export - couldn't remove an expired export: ", err)
+		}
+	}
+}
+
+// startExportSweeping sweep expired exports every 10 minutes until the app stops
+func (app *App) startExportSweeping() {
+	ticker := time.NewTicker(10 * time.Minute)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+			app.sweepExports()
+		}
+	}()
+}
+
+func initExport(app *App) {
+	app.ExportsFolder = app.Conf.Exports
+	if len(app.ExportsFolder) == 0 {
+		app.ExportsFolder = "./private/exports"
+	}
+	critCheck(os.MkdirAll(app.ExportsFolder, 0700))
+	// exports left over from before a restart
+	app.sweepExports()
+
+	app.Exportinator = NewBranca(deriveKey("data exports", app.Conf.VerifierSecret))
+	app.Exportinator.SetTTL(uint32(exportTTL.Seconds()))
+
+	app.Server.GET("/me/export", app.AuthHandle(func(c ctx, user *User) error {
+		total, err := app.exportSize(user)
+		if err != nil {
+			if app.DevMode {
+				fmt.Println("data export - error counting: ", err)
+			}
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "user.export", "users/"+user.Key, nil, obj{"documents": total})
+
+		if total > ExportThreshold {
+			go app.buildExportInBackground(*user)
+			return c.JSON(202, obj{
+				"ok":  true,
+				"msg": "your export is being put together, we'll email you a download link",
+			})
+		}
+
+		data, _, err := app.gatherExport(user)
+		if err != nil {
+			if app.DevMode {
+				fmt.Println("data export - error: ", err)
+			}
+			return ServerDBError(c)
+		}
+
+		res := c.Response()
+		res.Header().Set("Content-Type", "application/zip")
+		res.Header().Set("Content-Disposition", `attachment; filename="`+app.Conf.AppName+`-export.zip"`)
+		res.WriteHeader(200)
+		return writeExport(res, data)
+	}))
+
+	app.Server.GET("/me/export/:token", func(c ctx) error {
+		tk, err := app.Exportinator.Decode(c.Param("token"))
+		if err != nil {
+			return UnauthorizedError(c)
+		}
+		parts := strings.SplitN(tk.Payload, "|", 2)
+		if len(parts) != 2 || filepath.Base(parts[1]) != parts[1] {
+			return UnauthorizedError(c)
+		}
+		return c.Attachment(filepath.Join(app.ExportsFolder, parts[1]), app.Conf.AppName+"-export.zip")
+	})
+}
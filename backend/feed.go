@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// FeedLength how many of the newest writs a feed carries
+var FeedLength = 20
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Link       atomLink       `xml:"link"`
+	Author     atomAuthor     `xml:"author"`
+	Summary    string         `xml:"summary,omitempty"`
+	Content    atomContent    `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// WritFeed an atom feed of the newest writs, newest first, written to sit as feed.xml beside its
+// listing's index.html. Links are relative, root leads back to the site's root from there, while
+// ids stay the live urls so readers don't see the same writ twice between the site and a mirror.
+func (app *App) WritFeed(title, id, root string, writs []Writ) ([]byte, error) {
+	feed := atomFeed{
+		Title: title,
+		ID:    id,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: "feed.xml"},
+			{Rel: "alternate", Type: "text/html", Href: "index.html"},
+		},
+		Entries: []atomEntry{},
+	}
+
+	var updated time.Time
+	for i := range writs {
+		if i == FeedLength {
+			break
+		}
+		writ := &writs[i]
+		entry := atomEntry{
+			Title:     writ.Title,
+			ID:        "https://" + app.Conf.Domain + "/writ/" + writ.Slug,
+			Published: writ.Created.UTC().Format(time.RFC3339),
+			Updated:   writ.lastEdited().UTC().Format(time.RFC3339),
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: root + "/writ/" + writ.Slug + "/index.html"},
+			Author:    atomAuthor{writ.Author},
+			Summary:   writ.Description,
+			Content:   atomContent{"html", writ.Content},
+		}
+		for _, tag := range writ.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{tag})
+		}
+		if writ.lastEdited().After(updated) {
+			updated = writ.lastEdited()
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"encoding/xml"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritFeedLinksAreRelative(t *testing.T) {
+	app, _ := testApp(t, "feed")
+	writs := []Writ{{Title: "A Writ", Slug: "a-writ", Author: "saul", Created: time.Now(), Tags: []string{"intro"}}}
+	cases := []struct {
+		name, root, at, page string
+	}{
+		{"index feed", ".", "https://mirror.test/archive/feed.xml", "https://mirror.test/archive/writ/a-writ/index.html"},
+		{"tag feed", "../..", "https://mirror.test/archive/tag/intro/feed.xml", "https://mirror.test/archive/writ/a-writ/index.html"},
+		{"off the disk", "../..", "file:///srv/site/tag/intro/feed.xml", "file:///srv/site/writ/a-writ/index.html"},
+	}
+	for _, tc := range cases {
+		data, err := app.WritFeed("a feed", "https://"+app.Conf.Domain+"/feed.xml", tc.root, writs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var feed atomFeed
+		if err := xml.Unmarshal(data, &feed); err != nil || len(feed.Entries) != 1 {
+			t.Fatalf("%s: %v\n%s", tc.name, err, data)
+		}
+		hrefs := []string{feed.Entries[0].Link.Href}
+		for _, link := range feed.Links {
+			hrefs = append(hrefs, link.Href)
+		}
+		for _, href := range hrefs {
+			if strings.Contains(href, app.Conf.Domain) || strings.Contains(href, "://") {
+				t.Errorf("%s: %q points off the mirror", tc.name, href)
+			}
+		}
+		at, _ := url.Parse(tc.at)
+		page, _ := url.Parse(feed.Entries[0].Link.Href)
+		if got := at.ResolveReference(page).String(); got != tc.page {
+			t.Errorf("%s: the entry leads to %s, want %s", tc.name, got, tc.page)
+		}
+		if id := feed.Entries[0].ID; id != "https://"+app.Conf.Domain+"/writ/a-writ" {
+			t.Errorf("%s: entry id %q isn't the live url", tc.name, id)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML read the plain subset of yaml configs and front matter use:
+// nested maps by indentation, "- item" lists, [a, b] flow lists,
+// quoted or bare scalars, | and > block strings and # comments
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	lines := []yamlLine{}
+	for i, raw := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+		if strings.Contains(raw, "\t") && len(strings.TrimLeft(raw, " ")) != len(strings.TrimLeft(raw, " \t")) {
+			return nil, fmt.Errorf("yaml line %d: tabs can't be used for indentation", i+1)
+		}
+		text := strings.TrimRight(raw, " ")
+		lines = append(lines, yamlLine{
+			number: i + 1,
+			indent: len(text) - len(strings.TrimLeft(text, " ")),
+			text:   strings.TrimLeft(text, " "),
+		})
+	}
+	p := &yamlParser{lines: lines}
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return map[string]interface{}{}, nil
+	}
+	value, err := p.block(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	tree, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("yaml: the document should be a map of keys")
+	}
+	return tree, nil
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) {
+		text := p.lines[p.pos].text
+		if len(text) != 0 && !strings.HasPrefix(text, "#") && text != "---" {
+			return
+		}
+		p.pos++
+	}
+}
+
+// block a map or list whose lines all sit at indent
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if strings.HasPrefix(p.lines[p.pos].text, "- ") || p.lines[p.pos].text == "-" {
+		return p.list(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	tree := map[string]interface{}{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		} else if line.indent > indent {
+			return nil, fmt.Errorf("yaml line %d: unexpected indentation", line.number)
+		}
+		key, rest, err := splitYAMLKey(line)
+		if err != nil {
+			return nil, err
+		}
+		p.pos++
+		tree[key], err = p.value(rest, indent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+func (p *yamlParser) list(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.lines[p.pos]
+		if line.indent < indent || !(strings.HasPrefix(line.text, "- ") || line.text == "-") {
+			break
+		} else if line.indent > indent {
+			return nil, fmt.Errorf("yaml line %d: unexpected indentation", line.number)
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		if _, _, err := splitYAMLKey(yamlLine{text: rest}); err == nil && !strings.HasPrefix(rest, `"`) && !strings.HasPrefix(rest, "'") {
+			// "- key: value" starts a map, its other keys line up with the first
+			p.lines[p.pos] = yamlLine{number: line.number, indent: indent + 2, text: rest}
+			item, err := p.mapping(indent + 2)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+		p.pos++
+		item, err := p.value(rest, indent)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// value what follows a key or dash, either inline or as a more indented block
+func (p *yamlParser) value(rest string, indent int) (interface{}, error) {
+	rest = stripYAMLComment(rest)
+	if rest == "|" || rest == ">" || rest == "|-" || rest == ">-" {
+		return p.blockString(rest, indent), nil
+	}
+	if len(rest) != 0 {
+		return yamlScalar(rest)
+	}
+	p.skipBlank()
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return p.block(p.lines[p.pos].indent)
+	}
+	if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && strings.HasPrefix(p.lines[p.pos].text, "- ") {
+		// lists are allowed to sit at their key's indentation
+		return p.list(indent)
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) blockString(style string, indent int) string {
+	parts := []string{}
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if len(line.text) != 0 && line.indent <= indent {
+			break
+		}
+		if blockIndent < 0 && len(line.text) != 0 {
+			blockIndent = line.indent
+		}
+		if len(line.text) == 0 {
+			parts = append(parts, "")
+		} else {
+			parts = append(parts, strings.Repeat(" ", line.indent-blockIndent)+line.text)
+		}
+	}
+	for len(parts) != 0 && len(parts[len(parts)-1]) == 0 {
+		parts = parts[:len(parts)-1]
+	}
+	joiner := "\n"
+	if strings.HasPrefix(style, ">") {
+		joiner = " "
+	}
+	out := strings.Join(parts, joiner)
+	if !strings.HasSuffix(style, "-") {
+		out += "\n"
+	}
+	return out
+}
+
+func splitYAMLKey(line yamlLine) (string, string, error) {
+	text := line.text
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+		end := strings.Index(text[1:], text[:1])
+		if end < 0 || !strings.HasPrefix(text[end+2:], ":") {
+			return "", "", fmt.Errorf("yaml line %d: expected a key", line.number)
+		}
+		return text[1 : end+1], strings.TrimSpace(text[end+3:]), nil
+	}
+	i := strings.Index(text, ": ")
+	if i < 0 && strings.HasSuffix(text, ":") {
+		i = len(text) - 1
+	}
+	if i <= 0 {
+		return "", "", fmt.Errorf("yaml line %d: expected a key", line.number)
+	}
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), nil
+}
+
+func stripYAMLComment(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote != 0 && text[i] == quote:
+			quote = 0
+		case quote == 0 && (text[i] == '"' || text[i] == '\''):
+			quote = text[i]
+		case quote == 0 && text[i] == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimSpace(text[:i])
+		}
+	}
+	return strings.TrimSpace(text)
+}
+
+// yamlScalar a single inline value
+func yamlScalar(text string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'") && strings.HasSuffix(text, "'") && len(text) >= 2:
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]"):
+		items := []interface{}{}
+		for _, part := range splitFlow(text[1 : len(text)-1]) {
+			item, err := yamlScalar(part)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	switch strings.ToLower(text) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off":
+		return false, nil
+	case "null", "~":
+		return nil, nil
+	}
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f, nil
+	}
+	return text, nil
+}
+
+// splitFlow split comma separated items, leaving commas inside quotes or brackets alone
+func splitFlow(text string) []string {
+	parts := []string{}
+	depth, quote, start := 0, byte(0), 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(text[start:]); len(last) != 0 {
+		parts = append(parts, last)
+	}
+	return parts
+}
+
+// parseTOML read the subset of toml configs use: [tables], dotted keys,
+// strings, numbers, booleans, (multi-line) arrays, inline tables and # comments
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	tree := map[string]interface{}{}
+	table := tree
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		text := stripTOMLComment(lines[i])
+		if len(text) == 0 {
+			continue
+		}
+		if strings.HasPrefix(text, "[[") {
+			return nil, fmt.Errorf("toml line %d: arrays of tables aren't supported", i+1)
+		}
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			var err error
+			table, err = tomlTable(tree, splitTOMLKey(text[1:len(text)-1]))
+			if err != nil {
+				return nil, fmt.Errorf("toml line %d: %v", i+1, err)
+			}
+			continue
+		}
+
+		eq := strings.Index(text, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("toml line %d: expected key = value", i+1)
+		}
+		raw := strings.TrimSpace(text[eq+1:])
+		// arrays can carry on over several lines
+		for unclosedBrackets(raw) > 0 && i+1 < len(lines) {
+			i++
+			raw += " " + stripTOMLComment(lines[i])
+		}
+		value, err := tomlValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("toml line %d: %v", i+1, err)
+		}
+		path := splitTOMLKey(text[:eq])
+		parent, err := tomlTable(table, path[:len(path)-1])
+		if err != nil {
+			return nil, fmt.Errorf("toml line %d: %v", i+1, err)
+		}
+		parent[path[len(path)-1]] = value
+	}
+	return tree, nil
+}
+
+// unclosedBrackets how many more [ than ] there are, outside of quotes
+func unclosedBrackets(text string) int {
+	depth, quote := 0, byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth
+}
+
+func stripTOMLComment(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		switch {
+		case quote != 0 && text[i] == '\\' && quote == '"':
+			i++
+		case quote != 0 && text[i] == quote:
+			quote = 0
+		case quote == 0 && (text[i] == '"' || text[i] == '\''):
+			quote = text[i]
+		case quote == 0 && text[i] == '#':
+			return strings.TrimSpace(text[:i])
+		}
+	}
+	return strings.TrimSpace(text)
+}
+
+func splitTOMLKey(key string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(key, ".") {
+		parts = append(parts, strings.Trim(strings.TrimSpace(part), `"'`))
+	}
+	return parts
+}
+
+// tomlTable find or make the nested table at a path
+func tomlTable(tree map[string]interface{}, path []string) (map[string]interface{}, error) {
+	for _, key := range path {
+		next, ok := tree[key]
+		if !ok {
+			made := map[string]interface{}{}
+			tree[key] = made
+			tree = made
+			continue
+		}
+		table, ok := next.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(key + " is already a value, not a table")
+		}
+		tree = table
+	}
+	return tree, nil
+}
+
+func tomlValue(text string) (interface{}, error) {
+	switch {
+	case len(text) == 0:
+		return nil, errors.New("missing value")
+	case strings.HasPrefix(text, `"`):
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'") && strings.HasSuffix(text, "'") && len(text) >= 2:
+		return text[1 : len(text)-1], nil
+	case strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]"):
+		items := []interface{}{}
+		for _, part := range splitFlow(text[1 : len(text)-1]) {
+			item, err := tomlValue(part)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case strings.HasPrefix(text, "{") && strings.HasSuffix(text, "}"):
+		table := map[string]interface{}{}
+		for _, part := range splitFlow(text[1 : len(text)-1]) {
+			eq := strings.Index(part, "=")
+			if eq <= 0 {
+				return nil, errors.New("expected key = value in inline table")
+			}
+			value, err := tomlValue(strings.TrimSpace(part[eq+1:]))
+			if err != nil {
+				return nil, err
+			}
+			path := splitTOMLKey(part[:eq])
+			parent, err := tomlTable(table, path[:len(path)-1])
+			if err != nil {
+				return nil, err
+			}
+			parent[path[len(path)-1]] = value
+		}
+		return table, nil
+	case text == "true":
+		return true, nil
+	case text == "false":
+		return false, nil
+	}
+	clean := strings.Replace(text, "_", "", -1)
+	if n, err := strconv.ParseInt(clean, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(clean, 64); err == nil {
+		return f, nil
+	}
+	return nil, errors.New("can't read value " + text)
+}
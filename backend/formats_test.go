@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+type m = map[string]interface{}
+type l = []interface{}
+
+func TestParseYAML(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want m
+	}{
+		{"empty", "", m{}},
+		{"only comments", "# nothing\n\n---\n", m{}},
+		{"scalars", "name: saul\nport: 8080\nratio: 0.5\nnothing: ~\nempty:\n",
+			m{"name": "saul", "port": int64(8080), "ratio": 0.5, "nothing": nil, "empty": nil}},
+		{"yaml 1.1 booleans", "a: yes\nb: No\nc: on\nd: OFF\ne: true\nf: False\n",
+			m{"a": true, "b": false, "c": true, "d": false, "e": true, "f": false}},
+		{"quoted booleans stay strings", "a: \"yes\"\nb: 'no'\nc: \"true\"\n",
+			m{"a": "yes", "b": "no", "c": "true"}},
+		{"quoted numbers stay strings", "password: \"123\"\nport: '443'\n",
+			m{"password": "123", "port": "443"}},
+		{"double quote escapes", `text: "tab\there \"quoted\""`, m{"text": "tab\there \"quoted\""}},
+		{"single quote escapes", `text: 'it''s'`, m{"text": "it's"}},
+		{"quoted keys", "\"db name\": saul\n'db:user': root\n", m{"db name": "saul", "db:user": "root"}},
+		{"trailing comments", "a: 1 # one\nb: \"# not a comment\" # but this is\nc: x#y\n",
+			m{"a": int64(1), "b": "# not a comment", "c": "x#y"}},
+		{"escaped quote before a comment", `a: "say \"hi\" # still text" # comment`,
+			m{"a": `say "hi" # still text`}},
+		{"escaped quote then a hash", `a: "1\" # 2"`, m{"a": `1" # 2`}},
+		{"urls", "url: https://saul.app:443/path\n", m{"url": "https://saul.app:443/path"}},
+		{"nesting", "admin_email:\n  email: a@b.c\n  port: 587\n  deeper:\n    x: 1\ntop: 2\n",
+			m{"admin_email": m{"email": "a@b.c", "port": int64(587), "deeper": m{"x": int64(1)}}, "top": int64(2)}},
+		{"block lists", "domains:\n  - saul.app\n  - www.saul.app\n", m{"domains": l{"saul.app", "www.saul.app"}}},
+		{"unindented block lists", "domains:\n- saul.app\n- 'www.saul.app'\nafter: 1\n",
+			m{"domains": l{"saul.app", "www.saul.app"}, "after": int64(1)}},
+		{"flow lists", "a: [1, two, \"three, four\", [5]]\nb: []\n",
+			m{"a": l{int64(1), "two", "three, four", l{int64(5)}}, "b": l{}}},
+		{"lists of maps", "users:\n  - name: a\n    admin: yes\n  - name: b\n",
+			m{"users": l{m{"name": "a", "admin": true}, m{"name": "b"}}}},
+		{"literal block", "text: |\n  one\n    two\n\n  three\nnext: 1\n",
+			m{"text": "one\n  two\n\nthree\n", "next": int64(1)}},
+		{"folded block", "text: >-\n  one\n  two\n", m{"text": "one two"}},
+		{"crlf", "a: 1\r\nb: 2\r\n", m{"a": int64(1), "b": int64(2)}},
+	}
+	for _, tc := range cases {
+		got, err := parseYAML([]byte(tc.in))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+	}{
+		{"tab indentation", "a:\n\tb: 1\n"},
+		{"not a map", "- a\n- b\n"},
+		{"missing key", "just text\n"},
+		{"stray indentation", "a: 1\n  b: 2\n"},
+		{"unterminated quote", "a: \"open\n"},
+	}
+	for _, tc := range cases {
+		if _, err := parseYAML([]byte(tc.in)); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want m
+	}{
+		{"empty", "", m{}},
+		{"scalars", "name = \"saul\"\nport = 8080\nratio = 0.5\nbig = 1_000_000\non = true\noff = false\n",
+			m{"name": "saul", "port": int64(8080), "ratio": 0.5, "big": int64(1000000), "on": true, "off": false}},
+		{"quoted numbers stay strings", "password = \"123\"\n", m{"password": "123"}},
+		{"literal strings", `path = 'C:\saul\app'`, m{"path": `C:\saul\app`}},
+		{"escapes", `text = "tab\there \"quoted\""`, m{"text": "tab\there \"quoted\""}},
+		{"comments", "# top\na = 1 # one\nb = \"# not a comment\" # but this is\nc = 'x#y'\n",
+			m{"a": int64(1), "b": "# not a comment", "c": "x#y"}},
+		{"escaped quote before a comment", `a = "say \"hi\" # still text" # comment`,
+			m{"a": `say "hi" # still text`}},
+		{"tables", "top = 1\n[admin_email]\nemail = \"a@b.c\"\nport = 587\n[admin_email.deeper]\nx = 1\n",
+			m{"top": int64(1), "admin_email": m{"email": "a@b.c", "port": int64(587), "deeper": m{"x": int64(1)}}}},
+		{"dotted keys", "tls.min_version = \"1.2\"\n[ratelimit]\npolicies.auth.limit = 5\n",
+			m{"tls": m{"min_version": "1.2"}, "ratelimit": m{"policies": m{"auth": m{"limit": int64(5)}}}}},
+		{"quoted table keys", "[ratelimit.routes]\n\"/auth\" = \"auth\"\n",
+			m{"ratelimit": m{"routes": m{"/auth": "auth"}}}},
+		{"arrays", "a = [1, \"two, three\", [4]]\nb = []\n", m{"a": l{int64(1), "two, three", l{int64(4)}}, "b": l{}}},
+		{"multi-line arrays", "domains = [\n  \"saul.app\", # main\n  \"www.saul.app\",\n]\nafter = 1\n",
+			m{"domains": l{"saul.app", "www.saul.app"}, "after": int64(1)}},
+		{"brackets inside strings", "a = [\"[\", \"x\"]\nb = 2\n", m{"a": l{"[", "x"}, "b": int64(2)}},
+		{"inline tables", "limit = { auth = 5, window = \"1m\", nested.x = true }\n",
+			m{"limit": m{"auth": int64(5), "window": "1m", "nested": m{"x": true}}}},
+		{"crlf", "a = 1\r\nb = 2\r\n", m{"a": int64(1), "b": int64(2)}},
+	}
+	for _, tc := range cases {
+		got, err := parseTOML([]byte(tc.in))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+	}{
+		{"arrays of tables", "[[servers]]\n"},
+		{"missing value", "a =\n"},
+		{"missing key", "= 1\n"},
+		{"bare words", "a = yes\n"},
+		{"value then table", "a = 1\n[a]\n"},
+		{"unterminated string", "a = \"open\n"},
+	}
+	for _, tc := range cases {
+		if _, err := parseTOML([]byte(tc.in)); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/tidwall/gjson"
+)
+
+// SecurityHeaders the security headers sent with every response
+type SecurityHeaders struct {
+	HSTSMaxAge        int64
+	HSTSSubdomains    bool
+	CSP               map[string]string
+	ReportOnly        bool
+	ReferrerPolicy    string
+	PermissionsPolicy string
+}
+
+// CSPReport a content security policy violation as reported by a browser
+type CSPReport struct {
+	Key       string      `json:"_key,omitempty"`
+	Report    interface{} `json:"report"`
+	UserAgent string      `json:"useragent,omitempty"`
+	IP        string      `json:"ip,omitempty"`
+	Created   time.Time   `json:"created"`
+}
+
+// DefaultSecurityHeaders the security headers every App starts from, before the config's "security" section
+func DefaultSecurityHeaders() SecurityHeaders {
+	return SecurityHeaders{
+		HSTSMaxAge:     60 * 60 * 24 * 365,
+		HSTSSubdomains: true,
+		CSP: map[string]string{
+			"default-src":     "'self'",
+			"script-src":      "'self' 'nonce-{nonce}'",
+			"style-src":       "'self' 'unsafe-inline' https://fonts.googleapis.com",
+			"font-src":        "'self' data: https://fonts.gstatic.com",
+			"img-src":         "'self' data: https:",
+			"connect-src":     "'self'",
+			"object-src":      "'none'",
+			"base-uri":        "'self'",
+			"form-action":     "'self'",
+			"frame-ancestors": "'none'",
+		},
+		ReferrerPolicy:    "strict-origin-when-cross-origin",
+		PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+	}
+}
+
+var (
+	// CSPNonceKey where the request's csp nonce lives in the echo context
+	CSPNonceKey = "cspnonce"
+	// MaxCSPReportSize reports bigger than this are dropped
+	MaxCSPReportSize int64 = 16 * 1024
+)
+
+// CSPNonce the csp nonce for this request, scripts in rendered pages need it
+func CSPNonce(c ctx) string {
+	nonce, _ := c.Get(CSPNonceKey).(string)
+	return nonce
+}
+
+func newCSPNonce() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// policy build the Content-Security-Policy header value for a nonce
+func (s *SecurityHeaders) policy(nonce string) string {
+	directives := make([]string, 0, len(s.CSP))
+	for name := range s.CSP {
+		directives = append(directives, name)
+	}
+	sort.Strings(directives)
+
+	policy := ""
+	for _, name := range directives {
+		value := strings.Replace(s.CSP[name], "{nonce}", nonce, -1)
+		policy += name + " " + value + "; "
+	}
+	return policy + "report-uri /csp-report"
+}
+
+// frameOptions the X-Frame-Options matching the csp's frame-ancestors, for browsers without csp,
+// it can only say none or self, so anything else leaves it to frame-ancestors
+func (s *SecurityHeaders) frameOptions() string {
+	switch strings.TrimSpace(s.CSP["frame-ancestors"]) {
+	case "'none'":
+		return "DENY"
+	case "'self'":
+		return "SAMEORIGIN"
+	}
+	return ""
+}
+
+// SecurityHeadersMiddleware set HSTS, CSP (with a fresh nonce), referrer and permissions policies,
+// HSTS is left off in dev mode
+func SecurityHeadersMiddleware(s *SecurityHeaders, devMode bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c ctx) error {
+			nonce := newCSPNonce()
+			c.Set(CSPNonceKey, nonce)
+
+			h := c.Response().Header()
+			if !devMode && s.HSTSMaxAge > 0 {
+				hsts := "max-age=" + strconv.FormatInt(s.HSTSMaxAge, 10)
+				if s.HSTSSubdomains {
+					hsts += "; includeSubDomains"
+				}
+				h.Set("Strict-Transport-Security", hsts)
+			}
+			if s.ReportOnly {
+				h.Set("Content-Security-Policy-Report-Only", s.policy(nonce))
+			} else {
+				h.Set("Content-Security-Policy", s.policy(nonce))
+			}
+			h.Set("X-Content-Type-Options", "nosniff")
+			if frameOptions := s.frameOptions(); len(frameOptions) != 0 {
+				h.Set("X-Frame-Options", frameOptions)
+			}
+			if len(s.ReferrerPolicy) != 0 {
+				h.Set("Referrer-Policy", s.ReferrerPolicy)
+			}
+			if len(s.PermissionsPolicy) != 0 {
+				h.Set("Permissions-Policy", s.PermissionsPolicy)
+			}
+			return next(c)
+		}
+	}
+}
+
+// configureSecurityHeaders apply the "security" section of the config over the defaults
+func (app *App) configureSecurityHeaders() {
+	conf := app.Conf.Security
+	if conf.HSTSMaxAge != nil {
+		app.Security.HSTSMaxAge = *conf.HSTSMaxAge
+	}
+	if conf.HSTSSubdomains != nil {
+		app.Security.HSTSSubdomains = *conf.HSTSSubdomains
+	}
+	if conf.CSPReportOnly != nil {
+		app.Security.ReportOnly = *conf.CSPReportOnly
+	}
+	if conf.ReferrerPolicy != nil {
+		app.Security.ReferrerPolicy = *conf.ReferrerPolicy
+	}
+	if conf.PermissionsPolicy != nil {
+		app.Security.PermissionsPolicy = *conf.PermissionsPolicy
+	}
+	if conf.FrameAncestors != nil {
+		app.Security.CSP["frame-ancestors"] = *conf.FrameAncestors
+	}
+	for name, value := range conf.CSP {
+		if len(value) == 0 {
+			delete(app.Security.CSP, name)
+		} else {
+			app.Security.CSP[name] = value
+		}
+	}
+}
+
+func initSecurityHeaders(app *App) {
+	app.configureSecurityHeaders()
+	app.Server.Use(SecurityHeadersMiddleware(&app.Security, app.DevMode))
+}
+
+func initCSPReports(app *App) {
+	var err error
+	app.CSPReports, err = app.ensureCollection("cspreports")
+	critCheck(err)
+
+	app.Server.POST("/csp-report", func(c ctx) error {
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, MaxCSPReportSize))
+		if err != nil || len(body) == 0 {
+			return c.NoContent(400)
+		}
+		report := CSPReport{
+			UserAgent: c.Request().UserAgent(),
+			IP:        ClientIP(c),
+			Created:   time.Now(),
+		}
+		parsed := gjson.ParseBytes(body)
+		if v := parsed.Get("csp-report"); v.Exists() {
+			report.Report = v.Value()
+		} else {
+			report.Report = parsed.Value()
+		}
+		if report.Report == nil {
+			return c.NoContent(400)
+		}
+		_, err = app.CSPReports.CreateDocument(context.Background(), &report)
+		if err != nil && app.DevMode {
+			fmt.Println("couldn't store csp report: ", err)
+		}
+		return c.NoContent(204)
+	})
+
+	app.Server.GET("/admin/csp-reports", app.AdminHandle(func(c ctx, admin *User) error {
+		reports, err := app.Query(`FOR r IN cspreports SORT r.created DESC LIMIT 500 RETURN r`, obj{})
+		if err != nil {
+			return ServerDBError(c)
+		}
+		return c.JSON(200, reports)
+	}))
+}
@@ -0,0 +1,39 @@
+package backend
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestFrameOptions(t *testing.T) {
+	cases := []struct {
+		name           string
+		frameAncestors string
+		want           string
+	}{
+		{"none", "'none'", "DENY"},
+		{"self", "'self'", "SAMEORIGIN"},
+		{"self with spaces", " 'self' ", "SAMEORIGIN"},
+		{"other origins", "'self' https://embed.test", ""},
+		{"unset", "", ""},
+	}
+	for _, tc := range cases {
+		s := DefaultSecurityHeaders()
+		if len(tc.frameAncestors) == 0 {
+			delete(s.CSP, "frame-ancestors")
+		} else {
+			s.CSP["frame-ancestors"] = tc.frameAncestors
+		}
+
+		e := echo.New()
+		res := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest("GET", "/", nil), res)
+		SecurityHeadersMiddleware(&s, false)(func(c ctx) error { return nil })(c)
+
+		if got := res.Header().Get("X-Frame-Options"); got != tc.want {
+			t.Errorf("%s: X-Frame-Options %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
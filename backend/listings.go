@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ListingPageSize how many writs a listing page shows
+var ListingPageSize int64 = 12
+
+type listingTag struct {
+	Name string
+	Href string
+}
+
+type listingWrit struct {
+	Title       string
+	Author      string
+	Created     string
+	Description string
+	Href        string
+	Tags        []listingTag
+}
+
+// listingWrits writs as list.html shows them, the hrefs say where each writ and tag lives
+func listingWrits(writs []Writ, writHref, tagHref func(string) string) []listingWrit {
+	items := make([]listingWrit, len(writs))
+	for i, writ := range writs {
+		items[i] = listingWrit{
+			Title:       writ.Title,
+			Author:      writ.Author,
+			Created:     writ.Created.Format("1 Jan 2006"),
+			Description: writ.Description,
+			Href:        writHref(writ.Slug),
+		}
+		for _, tag := range writ.Tags {
+			items[i].Tags = append(items[i].Tags, listingTag{tag, tagHref(tag)})
+		}
+	}
+	return items
+}
+
+func liveWritHref(slug string) string {
+	return "/writ/" + slug
+}
+
+func liveTagHref(tag string) string {
+	return "/tag/" + url.PathEscape(tag)
+}
+
+// cursorURL a listing's path picking up at a cursor, the first page goes without one
+func cursorURL(path, cursor string) string {
+	if len(cursor) == 0 {
+		return path
+	}
+	return path + "?cursor=" + url.QueryEscape(cursor)
+}
+
+// listingPage render one page of the writs q finds, newest first, linking to the pages
+// either side with rel prev/next
+func listingPage(app *App, c ctx, title string, q *writQuery) error {
+	q.Cursor = c.QueryParam("cursor")
+	q.PageSize = ListingPageSize
+	q.Omissions = append(q.Omissions, "content", "injection")
+	if app.Viewer(c) != nil {
+		q.IncludeMembersOnly = true
+	}
+
+	page, err := q.ExecPage(app)
+	if err == ErrBadCursor {
+		return app.Templates.Error(c, 400, err.Error())
+	} else if err != nil {
+		return app.Templates.Error(c, 503, "the writs couldn't be fetched right now, try again in a bit")
+	}
+	if len(q.Cursor) != 0 && len(page.Writs) == 0 {
+		return app.Templates.Error(c, 404, "there's nothing more here")
+	}
+
+	path := c.Request().URL.Path
+	data := obj{
+		"Title":     title,
+		"Root":      "",
+		"Canonical": app.AppURL(cursorURL(path, q.Cursor)),
+		"Writs":     listingWrits(page.Writs, liveWritHref, liveTagHref),
+	}
+	if path != "/" {
+		data["Home"] = "/"
+	}
+	if len(page.Prev) != 0 {
+		data["Prev"] = cursorURL(path, page.Prev)
+	}
+	if len(page.Next) != 0 {
+		data["Next"] = cursorURL(path, page.Next)
+	}
+	return app.Templates.Page(c, 200, "list.html", data)
+}
+
+func initListings(app *App) {
+	cached := app.Responses.Middleware(listingCacheGroup)
+
+	// replaces the static index.html, which stays reachable as /index.html
+	app.Server.GET("/", func(c ctx) error {
+		return listingPage(app, c, app.Conf.AppName, &writQuery{})
+	}, cached)
+
+	app.Server.GET("/tag/:tag", func(c ctx) error {
+		tag, err := url.PathUnescape(c.Param("tag"))
+		if err != nil || len(tag) == 0 {
+			return app.Templates.Error(c, 400, "that isn't a tag")
+		}
+		return listingPage(app, c, app.Conf.AppName+" - "+tag, &writQuery{Tags: []string{tag}})
+	}, cached)
+
+	app.Server.GET("/author/:username", func(c ctx) error {
+		username := c.Param("username")
+		if !validUsername(username) {
+			return app.Templates.Error(c, 400, "that isn't a username")
+		}
+		if _, err := app.UserByUsername(username); err != nil {
+			return app.Templates.Error(c, 404, "there's no author by that name")
+		}
+		return listingPage(app, c, app.Conf.AppName+" - writs by "+username, &writQuery{Author: username})
+	}, cached)
+
+	app.Server.GET("/archive/:year/:month", func(c ctx) error {
+		year, err := strconv.Atoi(c.Param("year"))
+		if err != nil || year < 1970 || year > 9999 {
+			return app.Templates.Error(c, 400, "that isn't a year")
+		}
+		month, err := strconv.Atoi(c.Param("month"))
+		if err != nil || month < 1 || month > 12 {
+			return app.Templates.Error(c, 400, "that isn't a month")
+		}
+		start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		return listingPage(app, c, app.Conf.AppName+" - "+start.Format("January 2006"), &writQuery{
+			Between: Timeframe{Start: start, End: start.AddDate(0, 1, 0)},
+		})
+	}, cached)
+}
@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/arangodb/go-driver"
+)
+
+var (
+	// ErrLoginCodeLockout too many wrong login codes for this email
+	ErrLoginCodeLockout = errors.New("too many wrong login codes, try again later")
+	// LoginCodeDigits how long one-time login codes are
+	LoginCodeDigits = 6
+	// LoginCodeAttempts how many wrong codes may be tried before the email is locked out
+	LoginCodeAttempts int64 = 5
+	// LoginCodeLockout how long a lockout lasts
+	LoginCodeLockout = 15 * time.Minute
+)
+
+// GenerateLoginCode make a random numeric one-time login code
+func GenerateLoginCode() string {
+	max := big.NewInt(10)
+	code := make([]byte, LoginCodeDigits)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+	return string(code)
+}
+
+func hashLoginCode(key, code string) string {
+	sum := sha256.Sum256([]byte(key + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// loginCodeLockedOut whether an email's wrong guesses have it locked out at now,
+// the lockout runs for LoginCodeLockout from the guess that hit the limit
+func loginCodeLockedOut(attempts ratelimit, now time.Time) bool {
+	return attempts.Count >= LoginCodeAttempts && now.Before(time.Unix(attempts.Start, 0).Add(LoginCodeLockout))
+}
+
+// loginCodeLocked whether an email is locked out of trying login codes,
+// when the attempts can't be read it's locked to be safe
+func (app *App) loginCodeLocked(attemptsKey string) bool {
+	var attempts ratelimit
+	_, err := app.RateLimits.ReadDocument(context.Background(), attemptsKey, &attempts)
+	if driver.IsNotFound(err) {
+		return false
+	}
+	if err != nil {
+		if app.DevMode {
+			fmt.Println("VerifyLoginCode - trouble reading attempts: ", err)
+		}
+		return true
+	}
+	return loginCodeLockedOut(attempts, time.Now())
+}
+
+// failLoginCode count a wrong guess against an email, counting starts over once
+// LoginCodeLockout has passed since the last count began
+func (app *App) failLoginCode(attemptsKey string) {
+	_, err := app.DB.Query(
+		driver.WithWaitForSync(context.Background()),
+		`UPSERT {_key: @key}
+		INSERT {_key: @key, start: @now, count: 1}
+		UPDATE @now - OLD.start > @lockout ? {start: @now, count: 1} : {
+			count: OLD.count + 1,
+			start: OLD.count + 1 >= @attempts ? @now : OLD.start
+		} IN ratelimits`,
+		obj{
+			"key":      attemptsKey,
+			"now":      time.Now().Unix(),
+			"lockout":  int64(LoginCodeLockout.Seconds()),
+			"attempts": LoginCodeAttempts,
+		},
+	)
+	if err != nil && app.DevMode {
+		fmt.Println("VerifyLoginCode - trouble counting a wrong code: ", err)
+	}
+}
+
+// VerifyLoginCode log a user in with the code from their auth email instead of the link,
+// only wrong guesses count against the email in the ratelimits collection, a right one clears them
+func (app *App) VerifyLoginCode(email, code string) (*User, error) {
+	attemptsKey := "logincode:" + email
+	if app.loginCodeLocked(attemptsKey) {
+		return nil, ErrLoginCodeLockout
+	}
+
+	user, err := app.checkLoginCode(email, code)
+	if err != nil {
+		app.failLoginCode(attemptsKey)
+		return nil, err
+	}
+
+	_, err = app.RateLimits.RemoveDocument(context.Background(), attemptsKey)
+	if err != nil && !driver.IsNotFound(err) && app.DevMode {
+		fmt.Println("VerifyLoginCode - trouble resetting attempts: ", err)
+	}
+
+	err = user.completeVerification(app)
+	return &user, err
+}
+
+// checkLoginCode find the user a login code belongs to
+func (app *App) checkLoginCode(email, code string) (User, error) {
+	if len(code) != LoginCodeDigits {
+		return User{}, ErrUnauthorized
+	}
+
+	user, err := app.UserByEmail(email)
+	if err != nil || len(user.LoginCode) == 0 || len(user.Verifier) == 0 {
+		return User{}, ErrUnauthorized
+	}
+
+	// the code lives and dies with the verifier it was sent alongside
+	if _, err = app.Verinator.Decode(user.Verifier); err != nil {
+		return User{}, ErrUnauthorized
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashLoginCode(user.Key, code)), []byte(user.LoginCode)) != 1 {
+		return User{}, ErrUnauthorized
+	}
+	return user, nil
+}
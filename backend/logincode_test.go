@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerateLoginCode(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		code := GenerateLoginCode()
+		if len(code) != LoginCodeDigits {
+			t.Fatalf("%q is %d digits long, want %d", code, len(code), LoginCodeDigits)
+		}
+		for _, r := range code {
+			if r < '0' || r > '9' {
+				t.Fatalf("%q has a non digit in it", code)
+			}
+		}
+		seen[code] = true
+	}
+	if len(seen) < 45 {
+		t.Errorf("only %d different codes out of 50", len(seen))
+	}
+}
+
+func TestHashLoginCode(t *testing.T) {
+	hash := hashLoginCode("1234", "000111")
+	if len(hash) != 64 {
+		t.Errorf("hash %q isn't hex sha256", hash)
+	}
+	if hash != hashLoginCode("1234", "000111") {
+		t.Error("the same key and code hashed differently")
+	}
+	if hash == hashLoginCode("1234", "000112") {
+		t.Error("a different code hashed the same")
+	}
+	if hash == hashLoginCode("1235", "000111") {
+		t.Error("the same code for another user hashed the same")
+	}
+	if hash == hashLoginCode("123", "4:000111") {
+		t.Error("moving the separator hashed the same")
+	}
+}
+
+func TestLoginCodeLockedOut(t *testing.T) {
+	now := time.Now()
+	at := func(ago time.Duration) int64 { return now.Add(-ago).Unix() }
+	cases := []struct {
+		name     string
+		attempts ratelimit
+		want     bool
+	}{
+		{"no wrong guesses", ratelimit{}, false},
+		{"a few wrong guesses", ratelimit{Start: at(time.Minute), Count: LoginCodeAttempts - 1}, false},
+		{"hit the limit", ratelimit{Start: at(0), Count: LoginCodeAttempts}, true},
+		{"over the limit", ratelimit{Start: at(time.Minute), Count: LoginCodeAttempts + 3}, true},
+		{"nearly served the lockout", ratelimit{Start: at(LoginCodeLockout - time.Minute), Count: LoginCodeAttempts}, true},
+		{"served the lockout", ratelimit{Start: at(LoginCodeLockout + time.Second), Count: LoginCodeAttempts}, false},
+	}
+	for _, tc := range cases {
+		if got := loginCodeLockedOut(tc.attempts, now); got != tc.want {
+			t.Errorf("%s: locked out %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
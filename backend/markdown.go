@@ -0,0 +1,472 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Machiel/slugify"
+	"github.com/arangodb/go-driver"
+)
+
+// MarkdownWrit a writ as it's kept on disk: one markdown file with yaml front matter
+//
+//	---
+//	title: "Hello World"
+//	slug: "hello-world"
+//	tags: ["intro", "meta"]
+//	description: "the first one"
+//	public: true
+//	membersonly: false
+//	author: "saul"
+//	updated: "2019-01-02T15:04:05Z"
+//	---
+//	# the markdown itself
+//
+// updated is when the writ was last edited in the db as of the last export or sync,
+// it's how sync tells which side changed
+type MarkdownWrit struct {
+	Title       string
+	Slug        string
+	Tags        []string
+	Description string
+	Public      bool
+	MembersOnly bool
+	Author      string
+	Updated     time.Time
+	Markdown    string
+}
+
+// SyncConflict a writ that changed both on disk and in the db since the last sync
+type SyncConflict struct {
+	Slug   string `json:"slug"`
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// SyncReport what an import, export or sync did, by slug
+type SyncReport struct {
+	Imported  []string       `json:"imported"`
+	Exported  []string       `json:"exported"`
+	Unchanged int            `json:"unchanged"`
+	Conflicts []SyncConflict `json:"conflicts"`
+	Errors    []string       `json:"errors"`
+}
+
+// sync modes
+const (
+	SyncImport = "import"
+	SyncExport = "export"
+	SyncBoth   = "sync"
+)
+
+var (
+	// ErrNoFrontMatter the file doesn't open with a --- fenced front matter block
+	ErrNoFrontMatter = errors.New("markdown writ is missing its --- front matter ---")
+	// ErrBadSyncMode the mode isn't one of import, export or sync
+	ErrBadSyncMode = errors.New("sync mode should be import, export or sync")
+	// ErrBadSyncPreference conflicts can only be settled in favour of the db or the files
+	ErrBadSyncPreference = errors.New("prefer should be db, files or nothing")
+)
+
+// ParseMarkdownWrit split a file into its front matter and markdown
+func ParseMarkdownWrit(data []byte) (MarkdownWrit, error) {
+	var mw MarkdownWrit
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	if !strings.HasPrefix(text, "---\n") {
+		return mw, ErrNoFrontMatter
+	}
+	end := strings.Index(text[4:], "\n---")
+	if end == -1 {
+		return mw, ErrNoFrontMatter
+	}
+	head, body := text[4:4+end], text[4+end+4:]
+	if i := strings.IndexByte(body, '\n'); i != -1 && len(strings.TrimSpace(body[:i])) == 0 {
+		body = body[i+1:]
+	}
+
+	tree, err := parseYAML([]byte(head))
+	if err != nil {
+		return mw, err
+	}
+	for key, value := range tree {
+		switch key {
+		case "title":
+			mw.Title = frontMatterString(value)
+		case "slug":
+			mw.Slug = frontMatterString(value)
+		case "description":
+			mw.Description = frontMatterString(value)
+		case "author":
+			mw.Author = frontMatterString(value)
+		case "tags":
+			list, ok := value.([]interface{})
+			if !ok {
+				// tags: one-tag
+				list = []interface{}{value}
+			}
+			for _, tag := range list {
+				if tag := frontMatterString(tag); len(tag) != 0 {
+					mw.Tags = append(mw.Tags, tag)
+				}
+			}
+		case "public", "membersonly":
+			flag, ok := value.(bool)
+			if !ok {
+				return mw, fmt.Errorf("front matter %s should be true or false", key)
+			}
+			if key == "public" {
+				mw.Public = flag
+			} else {
+				mw.MembersOnly = flag
+			}
+		case "updated":
+			mw.Updated, err = time.Parse(time.RFC3339, frontMatterString(value))
+			if err != nil {
+				return mw, fmt.Errorf("front matter updated should be an RFC 3339 time: %v", err)
+			}
+		default:
+			return mw, fmt.Errorf("unknown front matter key %q", key)
+		}
+	}
+	mw.Markdown = strings.TrimSpace(body)
+
+	if len(mw.Title) == 0 {
+		return mw, errors.New("front matter needs a title")
+	}
+	if len(mw.Slug) == 0 {
+		mw.Slug = slugify.Slugify(mw.Title)
+	}
+	return mw, nil
+}
+
+// frontMatterString numbers and such as they were written, so tags: [go, 2019] works
+func frontMatterString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return strings.TrimSpace(s)
+	}
+	return fmt.Sprint(value)
+}
+
+// Bytes the file's contents, strings are always quoted so they read back the same
+func (mw *MarkdownWrit) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	buf.WriteString("title: " + strconv.Quote(mw.Title) + "\n")
+	buf.WriteString("slug: " + strconv.Quote(mw.Slug) + "\n")
+	tags := make([]string, len(mw.Tags))
+	for i, tag := range mw.Tags {
+		tags[i] = strconv.Quote(tag)
+	}
+	buf.WriteString("tags: [" + strings.Join(tags, ", ") + "]\n")
+	if len(mw.Description) != 0 {
+		buf.WriteString("description: " + strconv.Quote(mw.Description) + "\n")
+	}
+	buf.WriteString("public: " + strconv.FormatBool(mw.Public) + "\n")
+	buf.WriteString("membersonly: " + strconv.FormatBool(mw.MembersOnly) + "\n")
+	buf.WriteString("author: " + strconv.Quote(mw.Author) + "\n")
+	if !mw.Updated.IsZero() {
+		buf.WriteString("updated: " + strconv.Quote(mw.Updated.UTC().Format(time.RFC3339)) + "\n")
+	}
+	buf.WriteString("---\n\n")
+	buf.WriteString(mw.Markdown)
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// markdownWritOf a stored writ as a MarkdownWrit
+func markdownWritOf(w *Writ) MarkdownWrit {
+	return MarkdownWrit{
+		Title:       w.Title,
+		Slug:        w.Slug,
+		Tags:        w.Tags,
+		Description: w.Description,
+		Public:      w.Public,
+		MembersOnly: w.MembersOnly,
+		Author:      w.Author,
+		Updated:     w.lastEdited(),
+		Markdown:    strings.TrimSpace(w.Markdown),
+	}
+}
+
+// matches does the file say the same thing as the stored writ
+func (mw *MarkdownWrit) matches(w *Writ) bool {
+	return mw.Title == w.Title &&
+		mw.Slug == w.Slug &&
+		strings.Join(mw.Tags, "\n") == strings.Join(w.Tags, "\n") &&
+		mw.Description == w.Description &&
+		mw.Public == w.Public &&
+		mw.MembersOnly == w.MembersOnly &&
+		mw.Markdown == strings.TrimSpace(w.Markdown)
+}
+
+// writ what InitWrit needs to create the writ, or to update current with it
+func (mw *MarkdownWrit) writ(current *Writ) Writ {
+	w := Writ{
+		Title:       mw.Title,
+		Slug:        mw.Slug,
+		Tags:        mw.Tags,
+		Description: mw.Description,
+		Public:      mw.Public,
+		MembersOnly: mw.MembersOnly,
+		Author:      mw.Author,
+		Markdown:    mw.Markdown,
+	}
+	if current != nil {
+		w.Key = current.Key
+		w.Author = current.Author
+		w.Edits = current.Edits
+		w.NoComments = current.NoComments
+	}
+	return w
+}
+
+// applyFrontMatter set the slug and description a file gives its writ, InitWritBy won't
+// touch the slug unless the title changes and can't clear a description, without this
+// such files would never match their writs and every sync would import them again
+func (app *App) applyFrontMatter(mw *MarkdownWrit, key string) error {
+	stored, err := app.WritByKey(key)
+	if err != nil {
+		return err
+	}
+	if stored.Slug == mw.Slug && stored.Description == mw.Description {
+		return nil
+	}
+	changes := obj{"slug": mw.Slug, "description": nil}
+	if len(mw.Description) != 0 {
+		changes["description"] = mw.Description
+	}
+	ctx := driver.WithKeepNull(driver.WithWaitForSync(context.Background(), true), false)
+	if _, err = app.Writs.UpdateDocument(ctx, key, changes); err != nil {
+		return err
+	}
+	app.invalidateWrits(stored.Slug, mw.Slug)
+	return nil
+}
+
+// lastEdited when the writ last changed in the db
+func (writ *Writ) lastEdited() time.Time {
+	if len(writ.Edits) != 0 {
+		return writ.Edits[len(writ.Edits)-1]
+	}
+	return writ.Created
+}
+
+// allWrits every writ, private and members only ones included
+func (app *App) allWrits() ([]Writ, error) {
+	writs := []Writ{}
+	ctx := driver.WithQueryCount(context.Background())
+	cursor, err := app.DB.Query(ctx, `FOR writ IN writs SORT writ.created RETURN writ`, obj{})
+	if err != nil {
+		return writs, err
+	}
+	defer cursor.Close()
+	for {
+		var writ Writ
+		_, err = cursor.ReadDocument(ctx, &writ)
+		if driver.IsNoMoreDocuments(err) {
+			return writs, nil
+		} else if err != nil {
+			return writs, err
+		}
+		writs = append(writs, writ)
+	}
+}
+
+type markdownFile struct {
+	path string
+	writ MarkdownWrit
+}
+
+// readMarkdownDir parse every .md file in dir, files that don't parse end up in report.Errors
+func readMarkdownDir(dir string, report *SyncReport) ([]markdownFile, error) {
+	files := []markdownFile{}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.md"))
+	if err != nil {
+		return files, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			var mw MarkdownWrit
+			if mw, err = ParseMarkdownWrit(data); err == nil {
+				files = append(files, markdownFile{path, mw})
+				continue
+			}
+		}
+		report.Errors = append(report.Errors, filepath.Base(path)+": "+err.Error())
+	}
+	return files, nil
+}
+
+// writeMarkdownWrit write a stored writ out as <slug>.md, replacing the file it came from
+// if the slug has since changed
+func writeMarkdownWrit(dir, previous string, w *Writ) error {
+	mw := markdownWritOf(w)
+	path := filepath.Join(dir, w.Slug+".md")
+	if err := ioutil.WriteFile(path, mw.Bytes(), 0644); err != nil {
+		return err
+	}
+	if len(previous) != 0 && previous != path {
+		return os.Remove(previous)
+	}
+	return nil
+}
+
+// SyncMarkdown reconcile a directory of markdown writs with the db by slug.
+//
+// import pushes every file that differs into the db through InitWrit, export writes every
+// writ out, and sync does both: new files get imported, writs without a file get exported,
+// and a writ that differs is imported if the db hasn't changed since the file's updated time.
+// If both changed it's reported as a conflict, unless prefer says which side wins: db or files.
+// c is the request that asked for it, if any, for the audit log.
+func (app *App) SyncMarkdown(c ctx, actor *User, dir, mode, prefer string) (SyncReport, error) {
+	report := SyncReport{
+		Imported:  []string{},
+		Exported:  []string{},
+		Conflicts: []SyncConflict{},
+		Errors:    []string{},
+	}
+	if mode != SyncImport && mode != SyncExport && mode != SyncBoth {
+		return report, ErrBadSyncMode
+	}
+	if prefer != "" && prefer != "db" && prefer != "files" {
+		return report, ErrBadSyncPreference
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return report, err
+	}
+
+	writs, err := app.allWrits()
+	if err != nil {
+		return report, err
+	}
+	bySlug := map[string]*Writ{}
+	for i := range writs {
+		bySlug[writs[i].Slug] = &writs[i]
+	}
+
+	export := func(w *Writ, previous string) {
+		if err := writeMarkdownWrit(dir, previous, w); err != nil {
+			report.Errors = append(report.Errors, w.Slug+": "+err.Error())
+			return
+		}
+		report.Exported = append(report.Exported, w.Slug)
+	}
+
+	importFile := func(file markdownFile, current *Writ) {
+		w := file.writ.writ(current)
+		if current == nil && len(w.Author) == 0 && actor != nil {
+			w.Author = actor.Username
+		}
+		err := app.InitWritBy(c, actor, &w)
+		if err == nil {
+			err = app.applyFrontMatter(&file.writ, w.Key)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, file.writ.Slug+": "+err.Error())
+			return
+		}
+		report.Imported = append(report.Imported, file.writ.Slug)
+		if mode == SyncBoth {
+			// bring the file's updated time up to date
+			if stored, err := app.WritByKey(w.Key); err == nil {
+				if err = writeMarkdownWrit(dir, file.path, &stored); err != nil {
+					report.Errors = append(report.Errors, stored.Slug+": "+err.Error())
+				}
+				bySlug[stored.Slug] = &stored
+			}
+		}
+	}
+
+	if mode == SyncExport {
+		for i := range writs {
+			export(&writs[i], "")
+		}
+		return report, nil
+	}
+
+	files, err := readMarkdownDir(dir, &report)
+	if err != nil {
+		return report, err
+	}
+	onDisk := map[string]bool{}
+	for _, file := range files {
+		onDisk[file.writ.Slug] = true
+		current := bySlug[file.writ.Slug]
+		switch {
+		case current == nil:
+			importFile(file, nil)
+		case file.writ.matches(current):
+			report.Unchanged++
+		case mode == SyncImport || prefer == "files" || !current.lastEdited().Truncate(time.Second).After(file.writ.Updated):
+			importFile(file, current)
+		case prefer == "db":
+			export(current, file.path)
+		default:
+			report.Conflicts = append(report.Conflicts, SyncConflict{
+				Slug:   current.Slug,
+				File:   filepath.Base(file.path),
+				Reason: "changed in the db at " + current.lastEdited().Format(time.RFC3339) + " after the file was last synced",
+			})
+		}
+	}
+
+	if mode == SyncBoth {
+		for i := range writs {
+			if !onDisk[writs[i].Slug] {
+				export(&writs[i], "")
+			}
+		}
+	}
+	return report, nil
+}
+
+func initMarkdownSync(app *App) {
+	app.WritsDir = app.Conf.WritsDir
+	if len(app.WritsDir) == 0 {
+		app.WritsDir = "./writs"
+	}
+
+	app.Server.POST("/admin/writs/sync", app.AdminHandle(func(c ctx, admin *User) error {
+		body := struct {
+			Mode   string `json:"mode"`
+			Prefer string `json:"prefer"`
+		}{}
+		if err := UnmarshalJSONBody(c, &body); err != nil {
+			return BadRequestError(c)
+		}
+		if len(body.Mode) == 0 {
+			body.Mode = SyncBoth
+		}
+		report, err := app.SyncMarkdown(c, admin, app.WritsDir, body.Mode, body.Prefer)
+		if err == ErrBadSyncMode || err == ErrBadSyncPreference {
+			return JSONErr(c, 400, err.Error())
+		}
+		if err != nil {
+			if app.DevMode {
+				fmt.Println("markdown sync failed: ", err)
+			}
+			return JSONErr(c, 500, "couldn't sync the writs directory")
+		}
+		app.Audit(c, admin, "writ.sync", "writs", nil, obj{
+			"mode":      body.Mode,
+			"imported":  len(report.Imported),
+			"exported":  len(report.Exported),
+			"conflicts": len(report.Conflicts),
+		})
+		return c.JSON(200, report)
+	}))
+}
@@ -0,0 +1,164 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMarkdownWritRoundTrip(t *testing.T) {
+	updated := time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)
+	cases := []struct {
+		name string
+		mw   MarkdownWrit
+	}{
+		{"plain", MarkdownWrit{
+			Title: "Hello World", Slug: "hello-world", Tags: []string{"intro", "meta"},
+			Description: "the first one", Public: true, Author: "saul", Updated: updated,
+			Markdown: "# hello\n\nworld",
+		}},
+		{"no description or updated time", MarkdownWrit{
+			Title: "Draft", Slug: "draft", Tags: []string{"wip"}, MembersOnly: true, Author: "saul",
+			Markdown: "not done",
+		}},
+		{"awkward strings", MarkdownWrit{
+			Title:       `"Quoted": a title # with a hash`,
+			Slug:        "a-custom-slug",
+			Tags:        []string{"2019", "yes", "a, b", "it's"},
+			Description: "tab\there \\ backslash, 'single' and \"double\" quotes",
+			Author:      "saul",
+			Updated:     updated,
+			Markdown:    "---\nnot front matter\n---\n\n```yaml\nkey: value\n```",
+		}},
+		{"unicode", MarkdownWrit{
+			Title: "Ünïcödé ✓", Slug: "unicode", Tags: []string{"日本語"}, Description: "naïve café",
+			Author: "saul", Markdown: "emoji 🎉",
+		}},
+	}
+	for _, tc := range cases {
+		parsed, err := ParseMarkdownWrit(tc.mw.Bytes())
+		if err != nil {
+			t.Errorf("%s: %v\n%s", tc.name, err, tc.mw.Bytes())
+			continue
+		}
+		if !reflect.DeepEqual(parsed, tc.mw) {
+			t.Errorf("%s: read back as\n%#v\nwant\n%#v", tc.name, parsed, tc.mw)
+		}
+		if again := parsed.Bytes(); string(again) != string(tc.mw.Bytes()) {
+			t.Errorf("%s: written twice differently\n%s\n%s", tc.name, tc.mw.Bytes(), again)
+		}
+	}
+}
+
+func TestParseMarkdownWritErrors(t *testing.T) {
+	cases := map[string]string{
+		"no front matter":   "# just markdown\n",
+		"unclosed":          "---\ntitle: x\n",
+		"no title":          "---\ntags: [a]\n---\nbody\n",
+		"unknown key":       "---\ntitle: x\ncolour: red\n---\nbody\n",
+		"public not a bool": "---\ntitle: x\npublic: maybe\n---\nbody\n",
+		"bad updated":       "---\ntitle: x\nupdated: yesterday\n---\nbody\n",
+	}
+	for name, file := range cases {
+		if _, err := ParseMarkdownWrit([]byte(file)); err == nil {
+			t.Errorf("%s: parsed without an error", name)
+		}
+	}
+}
+
+// syncTestApp an app whose fake db can answer the queries syncing needs
+func syncTestApp(t *testing.T) (*App, *fakeArango) {
+	app, db := testApp(t, "sync")
+	db.put("users", obj{"_key": "saul", "username": "saul", "email": "saul@sync.test", "roles": []Role{VerifiedUser, Admin}})
+
+	where := func(collection, field string) func(map[string]map[string]obj, obj) []obj {
+		return func(docs map[string]map[string]obj, vars obj) []obj {
+			found := []obj{}
+			for _, doc := range docs[collection] {
+				if doc[field] == vars[field] {
+					found = append(found, doc)
+				}
+			}
+			return found
+		}
+	}
+	db.answer("FOR u IN users FILTER u.username == @username", where("users", "username"))
+	db.answer("writ.title == @title", where("writs", "title"))
+	db.answer("FOR writ IN writs SORT writ.created RETURN writ", func(docs map[string]map[string]obj, vars obj) []obj {
+		all := []obj{}
+		for _, doc := range docs["writs"] {
+			all = append(all, doc)
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i]["created"].(string) < all[j]["created"].(string) })
+		return all
+	})
+	return app, db
+}
+
+func writeMarkdownFile(t *testing.T, dir string, mw MarkdownWrit) {
+	if err := ioutil.WriteFile(filepath.Join(dir, mw.Slug+".md"), mw.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncMarkdownSettles(t *testing.T) {
+	app, db := syncTestApp(t)
+	dir := t.TempDir()
+	mw := MarkdownWrit{
+		Title:       "Hello World",
+		Slug:        "not-the-title-slug",
+		Tags:        []string{"intro"},
+		Description: "the first one",
+		Author:      "saul",
+		Markdown:    "# hello",
+	}
+	writeMarkdownFile(t, dir, mw)
+
+	stored := func() obj {
+		t.Helper()
+		for _, doc := range db.docs["writs"] {
+			return doc
+		}
+		t.Fatal("no writ was stored")
+		return nil
+	}
+	sync := func(step string, imported int) {
+		t.Helper()
+		report, err := app.SyncMarkdown(nil, nil, dir, SyncImport, "")
+		if err != nil || len(report.Errors) != 0 {
+			t.Fatalf("%s: %v %v", step, err, report.Errors)
+		}
+		if len(report.Imported) != imported || report.Unchanged != 1-imported {
+			t.Errorf("%s: imported %v with %d unchanged", step, report.Imported, report.Unchanged)
+		}
+	}
+
+	sync("first sync", 1)
+	if doc := stored(); doc["slug"] != mw.Slug || doc["description"] != mw.Description {
+		t.Fatalf("stored %v", doc)
+	}
+	sync("second sync", 0)
+
+	// the title stays put, so InitWritBy alone would keep the old slug and description
+	mw.Slug = "a-new-slug"
+	mw.Description = ""
+	writeMarkdownFile(t, dir, mw)
+	if err := os.Remove(filepath.Join(dir, "not-the-title-slug.md")); err != nil {
+		t.Fatal(err)
+	}
+	sync("slug and description changed", 1)
+	doc := stored()
+	if _, has := doc["description"]; has || doc["slug"] != "a-new-slug" {
+		t.Fatalf("stored %v", doc)
+	}
+	edits := len(doc["edits"].([]interface{}))
+
+	sync("after the change", 0)
+	if again := len(stored()["edits"].([]interface{})); again != edits {
+		t.Errorf("an unchanged file added edits, %d then %d", edits, again)
+	}
+}
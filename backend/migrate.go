@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+)
+
+// Migration a one-off change to the db, run once and remembered in the migrations collection
+type Migration struct {
+	Name string
+	Run  func(app *App) error
+}
+
+// AppCollections every collection the app keeps its data in
+var AppCollections = []string{
+	"users", "writs", "ratelimits", "audit", "cspreports",
+	"oauthclients", "credentials", "migrations",
+}
+
+// Migrations in the order they run, add new ones to the end
+var Migrations = []Migration{
+	{"collections", func(app *App) error {
+		for _, name := range AppCollections {
+			if _, err := app.ensureCollection(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"writ-author-keys", func(app *App) error {
+		_, err := app.DB.Query(context.Background(),
+			`FOR writ IN writs FILTER writ.authorkey == null
+				FOR u IN users FILTER u.username == writ.author
+				UPDATE writ WITH {authorkey: u._key} IN writs`,
+			obj{},
+		)
+		return err
+	}},
+}
+
+// RunMigrations run every migration that hasn't run yet, returning the names of those it ran
+func (app *App) RunMigrations() ([]string, error) {
+	ran := []string{}
+	migrations, err := app.ensureCollection("migrations")
+	if err != nil {
+		return ran, err
+	}
+	for _, migration := range Migrations {
+		exists, err := migrations.DocumentExists(nil, migration.Name)
+		if err != nil {
+			return ran, err
+		}
+		if exists {
+			continue
+		}
+		if err = migration.Run(app); err != nil {
+			return ran, fmt.Errorf("migration %s failed: %v", migration.Name, err)
+		}
+		_, err = migrations.CreateDocument(nil, obj{"_key": migration.Name, "ran": time.Now()})
+		if err != nil {
+			return ran, err
+		}
+		ran = append(ran, migration.Name)
+	}
+	return ran, nil
+}
+
+type backupLine struct {
+	Collection string          `json:"collection"`
+	Doc        json.RawMessage `json:"doc"`
+}
+
+// Backup write every document of every app collection as gzipped json lines
+func (app *App) Backup(out io.Writer) (int, error) {
+	zw := gzip.NewWriter(out)
+	enc := json.NewEncoder(zw)
+	count := 0
+
+	collections, err := app.DB.Collections(nil)
+	if err != nil {
+		return count, err
+	}
+	for _, col := range collections {
+		if strings.HasPrefix(col.Name(), "_") {
+			continue
+		}
+		ctx := driver.WithQueryCount(context.Background())
+		cursor, err := app.DB.Query(ctx, `FOR doc IN @@col RETURN doc`, obj{"@col": col.Name()})
+		if err != nil {
+			return count, err
+		}
+		for {
+			var doc json.RawMessage
+			_, err = cursor.ReadDocument(ctx, &doc)
+			if driver.IsNoMoreDocuments(err) {
+				break
+			} else if err != nil {
+				cursor.Close()
+				return count, err
+			}
+			if err = enc.Encode(backupLine{col.Name(), doc}); err != nil {
+				cursor.Close()
+				return count, err
+			}
+			count++
+		}
+		cursor.Close()
+	}
+	return count, zw.Close()
+}
+
+// Restore load a Backup back in, documents that already exist are replaced
+func (app *App) Restore(in io.Reader) (int, error) {
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+
+	count := 0
+	batches := map[string][]json.RawMessage{}
+	flush := func(name string) error {
+		col, err := app.ensureCollection(name)
+		if err != nil {
+			return err
+		}
+		stats, err := col.ImportDocuments(context.Background(), batches[name], &driver.ImportDocumentOptions{
+			OnDuplicate: driver.ImportOnDuplicateReplace,
+			Complete:    true,
+		})
+		if err != nil {
+			return err
+		}
+		count += int(stats.Created + stats.Updated)
+		batches[name] = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line backupLine
+		if err = json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return count, err
+		}
+		batches[line.Collection] = append(batches[line.Collection], line.Doc)
+		if len(batches[line.Collection]) >= 500 {
+			if err = flush(line.Collection); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return count, err
+	}
+	for name, batch := range batches {
+		if len(batch) != 0 {
+			if err = flush(name); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
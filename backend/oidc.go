@@ -0,0 +1,540 @@
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+)
+
+var (
+	// ErrBadJWT the jwt is malformed, badly signed or expired
+	ErrBadJWT = errors.New("invalid or expired jwt")
+	// OIDCScopes the scopes clients may ask for
+	OIDCScopes = []string{"openid", "profile", "email", "roles"}
+	// RoleNames how roles are named outside of the app
+	RoleNames = map[Role]string{
+		UnverifiedUser: "unverified",
+		VerifiedUser:   "verified",
+		Admin:          "admin",
+	}
+
+	oidcTokenTTL   = time.Hour
+	oidcCodeTTL    = time.Minute
+	oidcConsentTTL = 10 * time.Minute
+)
+
+// OAuthClient an app registered to sign users in with their accounts here
+type OAuthClient struct {
+	Key          string    `json:"_key,omitempty"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"secrethash,omitempty"`
+	RedirectURIs []string  `json:"redirecturis"`
+	CreatedBy    string    `json:"createdby,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+// oauthGrant what a user agreed to let a client do, carried in consent tokens and codes
+type oauthGrant struct {
+	// Type grantConsent or grantCode, so neither can stand in for the other
+	Type          string `json:"t"`
+	Client        string `json:"c"`
+	User          string `json:"u"`
+	RedirectURI   string `json:"r"`
+	Scope         string `json:"s"`
+	Nonce         string `json:"n,omitempty"`
+	State         string `json:"st,omitempty"`
+	CodeChallenge string `json:"cc"`
+	AuthTime      int64  `json:"at,omitempty"`
+}
+
+// OAuthClientByID get a registered oauth client
+func (app *App) OAuthClientByID(id string) (OAuthClient, error) {
+	var client OAuthClient
+	_, err := app.OAuthClients.ReadDocument(context.Background(), id, &client)
+	return client, err
+}
+
+// AllowsRedirect check a redirect uri was registered for the client, exactly
+func (client *OAuthClient) AllowsRedirect(uri string) bool {
+	for _, allowed := range client.RedirectURIs {
+		if allowed == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate check the client's secret, public clients have none and rely on PKCE
+func (client *OAuthClient) Authenticate(secret string) bool {
+	if len(client.SecretHash) == 0 {
+		return true
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(client.SecretHash)) == 1
+}
+
+// RoleNames the user's roles as names
+func (user *User) RoleNames() []string {
+	names := []string{}
+	for _, role := range user.Roles {
+		if name, ok := RoleNames[role]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// loadOIDCKey read the signing key, or make and save one if there isn't one yet
+func loadOIDCKey(location string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		fmt.Println("no oidc signing key at ", location, ", generating one")
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		return key, ioutil.WriteFile(location, data, 0600)
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("oidc signing key isn't pem encoded")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// SignJWT make an RS256 jwt with the oidc key
+func (app *App) SignJWT(claims obj) (string, error) {
+	header, err := json.Marshal(obj{"alg": "RS256", "typ": "JWT", "kid": app.oidcKeyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signing := b64url.EncodeToString(header) + "." + b64url.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, app.OIDCKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signing + "." + b64url.EncodeToString(sig), nil
+}
+
+// VerifyJWT check a jwt we signed and return its claims if it hasn't expired
+func (app *App) VerifyJWT(token string) (obj, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrBadJWT
+	}
+	sig, err := b64url.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrBadJWT
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(&app.OIDCKey.PublicKey, crypto.SHA256, digest[:], sig) != nil {
+		return nil, ErrBadJWT
+	}
+	payload, err := b64url.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrBadJWT
+	}
+	claims := obj{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrBadJWT
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || int64(exp) < time.Now().Unix() {
+		return nil, ErrBadJWT
+	}
+	return claims, nil
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcUserClaims the claims about a user that the granted scope allows
+func oidcUserClaims(user *User, scope string) obj {
+	claims := obj{"sub": user.Key}
+	if hasScope(scope, "profile") {
+		claims["preferred_username"] = user.Username
+		claims["name"] = user.Username
+	}
+	if hasScope(scope, "email") {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.Verified()
+	}
+	if hasScope(scope, "roles") {
+		claims["roles"] = user.RoleNames()
+	}
+	return claims
+}
+
+const (
+	grantConsent = "consent"
+	grantCode    = "code"
+)
+
+// encodeGrant put a grant into a branca token as a kind of token
+func encodeGrant(b *Branca, kind string, grant *oauthGrant) (string, error) {
+	grant.Type = kind
+	data, err := json.Marshal(grant)
+	if err != nil {
+		return "", err
+	}
+	return b.Encode(string(data))
+}
+
+// decodeGrant get a grant back out of a branca token, it has to be the kind asked for
+func decodeGrant(b *Branca, kind, token string) (*oauthGrant, error) {
+	tk, err := b.Decode(token)
+	if err != nil {
+		return nil, err
+	}
+	var grant oauthGrant
+	if err = json.Unmarshal([]byte(tk.Payload), &grant); err != nil {
+		return nil, err
+	}
+	if grant.Type != kind {
+		return nil, ErrInvalidToken
+	}
+	return &grant, nil
+}
+
+// oauthRedirect send the user back to the client with some parameters
+func oauthRedirect(c ctx, redirectURI string, params url.Values) error {
+	sep := "?"
+	if strings.Contains(redirectURI, "?") {
+		sep = "&"
+	}
+	return c.Redirect(302, redirectURI+sep+params.Encode())
+}
+
+func oauthError(c ctx, code int, kind, description string) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(code, obj{"error": kind, "error_description": description})
+}
+
+func initOIDC(app *App) {
+	var err error
+	app.OAuthClients, err = app.ensureCollection("oauthclients")
+	critCheck(err)
+
+	keyfile := app.Conf.OIDCKey
+	if len(keyfile) == 0 {
+		keyfile = "./private/oidc.pem"
+	}
+	app.OIDCKey, err = loadOIDCKey(keyfile)
+	critCheck(err)
+	der, err := x509.MarshalPKIXPublicKey(&app.OIDCKey.PublicKey)
+	critCheck(err)
+	kid := sha256.Sum256(der)
+	app.oidcKeyID = b64url.EncodeToString(kid[:12])
+
+	app.Consentinator = NewBranca(deriveKey("oauth consents", app.Conf.VerifierSecret))
+	app.Consentinator.SetTTL(uint32(oidcConsentTTL.Seconds()))
+	app.Grantinator = NewBranca(deriveKey("oauth codes", app.Conf.VerifierSecret))
+	app.Grantinator.SetTTL(uint32(oidcCodeTTL.Seconds()))
+
+	issuer := app.AppURL("")
+
+	app.Server.GET("/.well-known/openid-configuration", func(c ctx) error {
+		return c.JSON(200, obj{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/oauth/authorize",
+			"token_endpoint":                        issuer + "/oauth/token",
+			"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+			"jwks_uri":                              issuer + "/oauth/jwks",
+			"scopes_supported":                      OIDCScopes,
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+			"claims_supported": []string{
+				"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+				"name", "preferred_username", "email", "email_verified", "roles",
+			},
+		})
+	})
+
+	app.Server.GET("/oauth/jwks", func(c ctx) error {
+		pub := app.OIDCKey.PublicKey
+		return c.JSON(200, obj{"keys": []obj{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": app.oidcKeyID,
+			"n":   b64url.EncodeToString(pub.N.Bytes()),
+			"e":   b64url.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}}})
+	})
+
+	app.Server.GET("/oauth/authorize", func(c ctx) error {
+		client, err := app.OAuthClientByID(c.QueryParam("client_id"))
+		if err != nil {
+			return oauthError(c, 400, "invalid_client", "unknown client")
+		}
+		redirectURI := c.QueryParam("redirect_uri")
+		if !client.AllowsRedirect(redirectURI) {
+			return oauthError(c, 400, "invalid_request", "redirect_uri isn't registered for this client")
+		}
+
+		state := c.QueryParam("state")
+		fail := func(kind, description string) error {
+			return oauthRedirect(c, redirectURI, url.Values{
+				"error":             {kind},
+				"error_description": {description},
+				"state":             {state},
+			})
+		}
+		if c.QueryParam("response_type") != "code" {
+			return fail("unsupported_response_type", "only the code flow is supported")
+		}
+		challenge := c.QueryParam("code_challenge")
+		if len(challenge) < 43 || c.QueryParam("code_challenge_method") != "S256" {
+			return fail("invalid_request", "PKCE with S256 is required")
+		}
+		scope := c.QueryParam("scope")
+		if !hasScope(scope, "openid") {
+			return fail("invalid_scope", "the openid scope is required")
+		}
+		granted := []string{}
+		for _, s := range strings.Fields(scope) {
+			for _, supported := range OIDCScopes {
+				if s == supported {
+					granted = append(granted, s)
+				}
+			}
+		}
+
+		vars := obj{
+			"AppName": app.Conf.AppName,
+			"Domain":  app.Conf.Domain,
+			"Client":  client.Name,
+			"Scopes":  granted,
+		}
+		user, err := app.CredentialCheck(c)
+		if err == nil {
+			consent, err := encodeGrant(app.Consentinator, grantConsent, &oauthGrant{
+				Client:        client.Key,
+				User:          user.Key,
+				RedirectURI:   redirectURI,
+				Scope:         strings.Join(granted, " "),
+				Nonce:         c.QueryParam("nonce"),
+				State:         state,
+				CodeChallenge: challenge,
+			})
+			if err != nil {
+				return ServerDBError(c)
+			}
+			vars["User"] = user.Username
+			vars["Consent"] = consent
+			vars["CSRF"] = app.csrfToken(c)
+		}
+
+		return app.Templates.Page(c, 200, "consent.html", vars)
+	})
+
+	app.Server.POST("/oauth/authorize", app.AuthHandle(func(c ctx, user *User) error {
+		grant, err := decodeGrant(app.Consentinator, grantConsent, c.FormValue("consent"))
+		if err != nil || grant.User != user.Key {
+			return UnauthorizedError(c)
+		}
+		if c.FormValue("approve") != "yes" {
+			return oauthRedirect(c, grant.RedirectURI, url.Values{
+				"error": {"access_denied"},
+				"state": {grant.State},
+			})
+		}
+
+		// when the user logged in, not when they consented
+		grant.AuthTime = user.AuthTime.Unix()
+		code, err := encodeGrant(app.Grantinator, grantCode, grant)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "oauth.consent", "oauthclients/"+grant.Client, nil, obj{"scope": grant.Scope})
+		params := url.Values{"code": {code}}
+		if len(grant.State) > 0 {
+			params.Set("state", grant.State)
+		}
+		return oauthRedirect(c, grant.RedirectURI, params)
+	}))
+
+	app.Server.POST("/oauth/token", func(c ctx) error {
+		if c.FormValue("grant_type") != "authorization_code" {
+			return oauthError(c, 400, "unsupported_grant_type", "only authorization_code is supported")
+		}
+
+		clientID, secret, hasBasic := c.Request().BasicAuth()
+		if !hasBasic {
+			clientID = c.FormValue("client_id")
+			secret = c.FormValue("client_secret")
+		}
+		client, err := app.OAuthClientByID(clientID)
+		if err != nil || !client.Authenticate(secret) {
+			return oauthError(c, 401, "invalid_client", "client authentication failed")
+		}
+
+		code := c.FormValue("code")
+		grant, err := decodeGrant(app.Grantinator, grantCode, code)
+		if err != nil || grant.Client != client.Key || grant.RedirectURI != c.FormValue("redirect_uri") {
+			return oauthError(c, 400, "invalid_grant", "the code is invalid or expired")
+		}
+		verifier := sha256.Sum256([]byte(c.FormValue("code_verifier")))
+		if b64url.EncodeToString(verifier[:]) != grant.CodeChallenge {
+			return oauthError(c, 400, "invalid_grant", "code_verifier doesn't match")
+		}
+		if !app.spendOnce("oauthcode:"+code, oidcCodeTTL) {
+			return oauthError(c, 400, "invalid_grant", "the code was already used")
+		}
+
+		user, err := app.UserByKey(grant.User)
+		if err != nil || grant.AuthTime == 0 || user.Standing(time.Unix(grant.AuthTime, 0)) != nil {
+			return oauthError(c, 400, "invalid_grant", "the user can no longer sign in")
+		}
+
+		now := time.Now()
+		idClaims := oidcUserClaims(&user, grant.Scope)
+		idClaims["iss"] = issuer
+		idClaims["aud"] = client.Key
+		idClaims["iat"] = now.Unix()
+		idClaims["exp"] = now.Add(oidcTokenTTL).Unix()
+		idClaims["auth_time"] = grant.AuthTime
+		if len(grant.Nonce) > 0 {
+			idClaims["nonce"] = grant.Nonce
+		}
+		idToken, err := app.SignJWT(idClaims)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		accessToken, err := app.SignJWT(obj{
+			"iss":       issuer,
+			"sub":       user.Key,
+			"aud":       issuer + "/oauth/userinfo",
+			"client_id": client.Key,
+			"scope":     grant.Scope,
+			"iat":       now.Unix(),
+			"exp":       now.Add(oidcTokenTTL).Unix(),
+		})
+		if err != nil {
+			return ServerDBError(c)
+		}
+
+		app.Audit(c, &user, "oauth.token", "oauthclients/"+client.Key, nil, nil)
+		c.Response().Header().Set("Cache-Control", "no-store")
+		return c.JSON(200, obj{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   int64(oidcTokenTTL.Seconds()),
+			"id_token":     idToken,
+			"scope":        grant.Scope,
+		})
+	})
+
+	app.Server.GET("/oauth/userinfo", func(c ctx) error {
+		auth := c.Request().Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return oauthError(c, 401, "invalid_token", "a bearer token is required")
+		}
+		claims, err := app.VerifyJWT(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil || claims["aud"] != issuer+"/oauth/userinfo" {
+			return oauthError(c, 401, "invalid_token", "the token is invalid or expired")
+		}
+		sub, _ := claims["sub"].(string)
+		scope, _ := claims["scope"].(string)
+		user, err := app.UserByKey(sub)
+		if err != nil || user.Standing(time.Now()) != nil {
+			return oauthError(c, 401, "invalid_token", "the user can no longer sign in")
+		}
+		return c.JSON(200, oidcUserClaims(&user, scope))
+	})
+
+	app.Server.GET("/admin/oauth/clients", app.AdminHandle(func(c ctx, admin *User) error {
+		clients, err := app.Query(`FOR c IN oauthclients SORT c.created RETURN UNSET(c, "secrethash")`, obj{})
+		if err != nil {
+			return ServerDBError(c)
+		}
+		return c.JSON(200, clients)
+	}))
+
+	app.Server.POST("/admin/oauth/clients", app.AdminHandle(func(c ctx, admin *User) error {
+		var body struct {
+			Name         string   `json:"name"`
+			RedirectURIs []string `json:"redirecturis"`
+			Public       bool     `json:"public"`
+		}
+		if err := UnmarshalJSONBody(c, &body); err != nil || len(body.Name) == 0 || len(body.RedirectURIs) == 0 {
+			return BadRequestError(c)
+		}
+		for _, uri := range body.RedirectURIs {
+			u, err := url.Parse(uri)
+			if err != nil || !u.IsAbs() || len(u.Fragment) != 0 {
+				return JSONErr(c, 400, "redirect uris must be absolute and have no fragment")
+			}
+		}
+
+		client := OAuthClient{
+			Name:         body.Name,
+			RedirectURIs: body.RedirectURIs,
+			CreatedBy:    admin.Key,
+			Created:      time.Now(),
+		}
+		secret := ""
+		if !body.Public {
+			secret = RandStr(48)
+			sum := sha256.Sum256([]byte(secret))
+			client.SecretHash = hex.EncodeToString(sum[:])
+		}
+		meta, err := app.OAuthClients.CreateDocument(driver.WithWaitForSync(context.Background()), &client)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, admin, "oauth.client.create", "oauthclients/"+meta.Key, nil, obj{
+			"name":         client.Name,
+			"redirecturis": client.RedirectURIs,
+		})
+		return c.JSON(200, obj{"ok": true, "client_id": meta.Key, "client_secret": secret})
+	}))
+
+	app.Server.DELETE("/admin/oauth/clients/:id", app.AdminHandle(func(c ctx, admin *User) error {
+		client, err := app.OAuthClientByID(c.Param("id"))
+		if err != nil {
+			return JSONErr(c, 404, "no such client")
+		}
+		_, err = app.OAuthClients.RemoveDocument(driver.WithWaitForSync(context.Background()), client.Key)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, admin, "oauth.client.delete", "oauthclients/"+client.Key, obj{"name": client.Name}, nil)
+		return c.JSON(200, obj{"ok": true})
+	}))
+}
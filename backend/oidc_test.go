@@ -0,0 +1,238 @@
+package backend
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testRedirect = "https://client.test/callback"
+	testVerifier = "a code verifier that is long enough to be a proper one"
+)
+
+func testChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return b64url.EncodeToString(sum[:])
+}
+
+// oidcTestApp an app with a user and a public client, and an auth cookie for the user
+// that logged in an hour ago
+func oidcTestApp(t *testing.T) (*App, *http.Cookie, time.Time) {
+	app, db := testApp(t, "oidc")
+	db.put("users", obj{"_key": "someone", "username": "someone", "email": "someone@oidc.test", "roles": []Role{VerifiedUser}})
+	db.put("oauthclients", obj{"_key": "client", "name": "a client", "redirecturis": []string{testRedirect}})
+
+	loggedIn := time.Now().Add(-time.Hour).Truncate(time.Second)
+	token, err := app.Tokenator.Encode(authTokenPayload(&User{Key: "someone", AuthTime: loggedIn}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, &http.Cookie{Name: "Auth", Value: token}, loggedIn
+}
+
+func testGrant() *oauthGrant {
+	return &oauthGrant{
+		Client:        "client",
+		User:          "someone",
+		RedirectURI:   testRedirect,
+		Scope:         "openid email",
+		Nonce:         "a nonce",
+		State:         "a state",
+		CodeChallenge: testChallenge(testVerifier),
+	}
+}
+
+// consent approve a consent token the way the consent page's form does
+func consent(app *App, auth *http.Cookie, token string) *httptest.ResponseRecorder {
+	form := url.Values{"consent": {token}, "approve": {"yes"}, CSRFField: {"a csrf token that's 32 long...."}}
+	req := httptest.NewRequest("POST", "/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", app.AppURL(""))
+	req.AddCookie(auth)
+	req.AddCookie(&http.Cookie{Name: CSRFCookie, Value: form.Get(CSRFField)})
+	res := httptest.NewRecorder()
+	app.ServeHTTP(res, req)
+	return res
+}
+
+// redeem trade a code for tokens
+func redeem(app *App, code, verifier string) (int, obj) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"client"},
+		"code":          {code},
+		"redirect_uri":  {testRedirect},
+		"code_verifier": {verifier},
+	}
+	req := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	app.ServeHTTP(res, req)
+	body := obj{}
+	json.Unmarshal(res.Body.Bytes(), &body)
+	return res.Code, body
+}
+
+// verifyWithJWKS check an id token's RS256 signature with the key the jwks endpoint publishes
+func verifyWithJWKS(t *testing.T, app *App, token string) obj {
+	res := httptest.NewRecorder()
+	app.ServeHTTP(res, httptest.NewRequest("GET", "/oauth/jwks", nil))
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &jwks); err != nil || len(jwks.Keys) != 1 {
+		t.Fatalf("bad jwks: %s", res.Body.String())
+	}
+	jwk := jwks.Keys[0]
+	n, _ := b64url.DecodeString(jwk.N)
+	e, _ := b64url.DecodeString(jwk.E)
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("%q isn't a jwt", token)
+	}
+	var header, claims obj
+	rawHeader, _ := b64url.DecodeString(parts[0])
+	rawClaims, _ := b64url.DecodeString(parts[1])
+	json.Unmarshal(rawHeader, &header)
+	json.Unmarshal(rawClaims, &claims)
+	if header["alg"] != "RS256" || jwk.Alg != "RS256" || header["kid"] != jwk.Kid {
+		t.Fatalf("header %v doesn't match the jwk %+v", header, jwk)
+	}
+	sig, _ := b64url.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatalf("the id token's signature doesn't check out against the jwks: %v", err)
+	}
+	return claims
+}
+
+func TestOIDCCodeFlow(t *testing.T) {
+	app, auth, loggedIn := oidcTestApp(t)
+
+	token, err := encodeGrant(app.Consentinator, grantConsent, testGrant())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := consent(app, auth, token)
+	if res.Code != 302 {
+		t.Fatalf("consenting: %d %s", res.Code, res.Body.String())
+	}
+	location, err := url.Parse(res.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(location.String(), testRedirect+"?") {
+		t.Fatalf("redirected to %q", res.Header().Get("Location"))
+	}
+	if location.Query().Get("state") != "a state" {
+		t.Errorf("state %q didn't make it back", location.Query().Get("state"))
+	}
+	code := location.Query().Get("code")
+
+	if status, body := redeem(app, code, "not the "+testVerifier); status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("a wrong verifier got %d %v", status, body)
+	}
+	if status, body := redeem(app, code, ""); status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("no verifier got %d %v", status, body)
+	}
+
+	status, body := redeem(app, code, testVerifier)
+	if status != 200 {
+		t.Fatalf("redeeming: %d %v", status, body)
+	}
+	idToken, _ := body["id_token"].(string)
+	claims := verifyWithJWKS(t, app, idToken)
+	want := obj{
+		"iss":       app.AppURL(""),
+		"aud":       "client",
+		"sub":       "someone",
+		"nonce":     "a nonce",
+		"email":     "someone@oidc.test",
+		"auth_time": float64(loggedIn.Unix()),
+	}
+	for claim, value := range want {
+		if claims[claim] != value {
+			t.Errorf("id token %s is %v, want %v", claim, claims[claim], value)
+		}
+	}
+	if _, ok := claims["preferred_username"]; ok {
+		t.Error("the profile scope wasn't granted but its claims are there")
+	}
+
+	if status, body := redeem(app, code, testVerifier); status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("a replayed code got %d %v", status, body)
+	}
+}
+
+func TestOIDCTokenSeparation(t *testing.T) {
+	app, auth, _ := oidcTestApp(t)
+
+	consentToken, err := encodeGrant(app.Consentinator, grantConsent, testGrant())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := redeem(app, consentToken, testVerifier); status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("a consent token redeemed as a code got %d %v", status, body)
+	}
+
+	// even sealed with the right key, the kind inside has to match
+	mislabeled, err := encodeGrant(app.Grantinator, grantConsent, testGrant())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := redeem(app, mislabeled, testVerifier); status != 400 || body["error"] != "invalid_grant" {
+		t.Errorf("a consent grant sealed as a code got %d %v", status, body)
+	}
+
+	code, err := encodeGrant(app.Grantinator, grantCode, testGrant())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := consent(app, auth, code); res.Code == 302 {
+		t.Errorf("a code was taken as consent, redirected to %s", res.Header().Get("Location"))
+	}
+}
+
+func TestOIDCRequiresS256(t *testing.T) {
+	app, _, _ := oidcTestApp(t)
+	cases := []struct {
+		name      string
+		challenge string
+		method    string
+	}{
+		{"no challenge", "", ""},
+		{"plain", testVerifier, "plain"},
+		{"no method", testChallenge(testVerifier), ""},
+		{"short challenge", "tooshort", "S256"},
+	}
+	for _, tc := range cases {
+		q := url.Values{
+			"client_id":             {"client"},
+			"redirect_uri":          {testRedirect},
+			"response_type":         {"code"},
+			"scope":                 {"openid"},
+			"state":                 {"a state"},
+			"code_challenge":        {tc.challenge},
+			"code_challenge_method": {tc.method},
+		}
+		res := httptest.NewRecorder()
+		app.ServeHTTP(res, httptest.NewRequest("GET", "/oauth/authorize?"+q.Encode(), nil))
+		location, _ := url.Parse(res.Header().Get("Location"))
+		if res.Code != 302 || location.Query().Get("error") != "invalid_request" {
+			t.Errorf("%s: got %d %q", tc.name, res.Code, res.Header().Get("Location"))
+		}
+	}
+}
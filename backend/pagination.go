@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// WritPage one page of a keyset paginated writQuery, newest first
+type WritPage struct {
+	Writs []Writ `json:"writs"`
+	// Next cursor for the older writs after this page, empty on the last page
+	Next string `json:"next,omitempty"`
+	// Prev cursor for the newer writs before this page, empty on the first page
+	Prev string `json:"prev,omitempty"`
+	// Total how many writs the query finds across all pages, only counted when asked for
+	Total *int64 `json:"total,omitempty"`
+}
+
+// writCursor where a page starts, the writs after (or Before) this (created, _key) position
+type writCursor struct {
+	Created time.Time `json:"c"`
+	Key     string    `json:"k"`
+	Before  bool      `json:"b,omitempty"`
+}
+
+var (
+	// WritPageSize how many writs a page has when the query doesn't say
+	WritPageSize int64 = 20
+	// ErrBadCursor the cursor wasn't made by this app, or was tampered with
+	ErrBadCursor = errors.New("that cursor isn't valid, start again from the first page")
+)
+
+// cursorKey a branca key for cursors derived from the token secret, so a cursor
+// can never pass for an auth token or the other way around
+func cursorKey(secret string) string {
+	return deriveKey("writ cursors", secret)
+}
+
+func (cursor writCursor) encode(app *App) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return app.Cursorinator.Encode(string(data))
+}
+
+func (app *App) decodeWritCursor(token string) (writCursor, error) {
+	var cursor writCursor
+	tk, err := app.Cursorinator.Decode(token)
+	if err != nil {
+		return cursor, ErrBadCursor
+	}
+	if err = json.Unmarshal([]byte(tk.Payload), &cursor); err != nil || len(cursor.Key) == 0 {
+		return cursor, ErrBadCursor
+	}
+	return cursor, nil
+}
+
+// count how many writs match the query's filters, regardless of paging
+func (q *writQuery) count(app *App) (int64, error) {
+	var total int64
+	query := "FOR writ IN writs " + q.filter() + "COLLECT WITH COUNT INTO total RETURN total"
+	err := app.QueryOne(query, q.Vars, &total)
+	return total, err
+}
+
+// ExecPage execute a writQuery a page at a time, sorted on (created, _key) and picking up
+// after q.Cursor rather than skipping an offset, so deep pages stay fast and don't shift
+// when new writs come out. q.Limit is ignored, q.PageSize writs come back per page.
+func (q *writQuery) ExecPage(app *App) (WritPage, error) {
+	page := WritPage{Writs: []Writ{}}
+	size := q.PageSize
+	if size < 1 {
+		size = WritPageSize
+	}
+	if len(q.Cursor) != 0 {
+		position, err := app.decodeWritCursor(q.Cursor)
+		if err != nil {
+			return page, err
+		}
+		q.position = &position
+	}
+
+	if q.CountTotal {
+		total, err := q.count(app)
+		if err != nil {
+			return page, err
+		}
+		page.Total = &total
+	}
+
+	// the cursors need every writ's key and creation date, even if they're left out after
+	hide := map[string]bool{"_key": !q.EditorMode}
+	omissions := []string{}
+	for _, field := range q.Omissions {
+		if field == "_key" || field == "created" {
+			hide[field] = true
+			continue
+		}
+		omissions = append(omissions, field)
+	}
+	q.Omissions = omissions
+	q.keyset = true
+	// one extra to know whether there's more past this page
+	q.Limit = []int64{0, size + 1}
+
+	writs, err := q.Exec(app)
+	if err != nil {
+		return page, err
+	}
+	more := int64(len(writs)) > size
+	if more {
+		writs = writs[:size]
+	}
+
+	backwards := q.position != nil && q.position.Before
+	if backwards {
+		for i, j := 0, len(writs)-1; i < j; i, j = i+1, j-1 {
+			writs[i], writs[j] = writs[j], writs[i]
+		}
+	}
+
+	if len(writs) != 0 {
+		first, last := writs[0], writs[len(writs)-1]
+		if (backwards && more) || (!backwards && q.position != nil) {
+			if page.Prev, err = (writCursor{first.Created, first.Key, true}).encode(app); err != nil {
+				return page, err
+			}
+		}
+		// going backwards, the writ the cursor came from is still further on
+		if backwards || more {
+			if page.Next, err = (writCursor{last.Created, last.Key, false}).encode(app); err != nil {
+				return page, err
+			}
+		}
+	}
+
+	for i := range writs {
+		if hide["_key"] {
+			writs[i].Key = ""
+		}
+		if hide["created"] {
+			writs[i].Created = time.Time{}
+		}
+	}
+	page.Writs = writs
+	return page, nil
+}
@@ -0,0 +1,181 @@
+package backend
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritCursorRoundTrip(t *testing.T) {
+	app, _ := testApp(t, "cursors")
+	created := time.Date(2019, 3, 4, 5, 6, 7, 890, time.UTC)
+	for _, cursor := range []writCursor{
+		{Created: created, Key: "abc"},
+		{Created: created, Key: "abc", Before: true},
+		{Key: "no-date"},
+	} {
+		token, err := cursor.encode(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := app.decodeWritCursor(token)
+		if err != nil || !got.Created.Equal(cursor.Created) || got.Key != cursor.Key || got.Before != cursor.Before {
+			t.Errorf("%+v came back as %+v, %v", cursor, got, err)
+		}
+	}
+}
+
+func TestWritCursorRejected(t *testing.T) {
+	app, _ := testApp(t, "cursors")
+	other := NewBranca(cursorKey(fmt.Sprintf("%-32s", "another token secret")))
+
+	good, err := (writCursor{Created: time.Now(), Key: "abc"}).encode(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := []byte(good)
+	if tampered[len(tampered)/2] == 'a' {
+		tampered[len(tampered)/2] = 'b'
+	} else {
+		tampered[len(tampered)/2] = 'a'
+	}
+	elsewhere, _ := other.Encode(`{"c":"2019-01-01T00:00:00Z","k":"abc"}`)
+	authToken, _ := app.Tokenator.Encode(`{"c":"2019-01-01T00:00:00Z","k":"abc"}`)
+	noKey, _ := app.Cursorinator.Encode(`{"c":"2019-01-01T00:00:00Z"}`)
+	notJSON, _ := app.Cursorinator.Encode("abc")
+
+	cases := map[string]string{
+		"tampered":             string(tampered),
+		"truncated":            good[:len(good)-4],
+		"from another app":     elsewhere,
+		"an auth token":        authToken,
+		"without a key":        noKey,
+		"not json":             notJSON,
+		"garbage":              "not a cursor at all",
+		"an offset, like ?p=2": "2",
+	}
+	for name, token := range cases {
+		if _, err := app.decodeWritCursor(token); err != ErrBadCursor {
+			t.Errorf("%s: got %v", name, err)
+		}
+		q := &writQuery{Cursor: token}
+		if _, err := q.ExecPage(app); err != ErrBadCursor {
+			t.Errorf("%s: paging got %v", name, err)
+		}
+	}
+}
+
+// answerKeyset answer ExecPage's queries the way arango would, keyset filter, sort and limit included
+func answerKeyset(db *fakeArango) {
+	page := func(before bool) func(map[string]map[string]obj, obj) []obj {
+		return func(docs map[string]map[string]obj, vars obj) []obj {
+			at := func(doc obj) (time.Time, string) {
+				created, _ := time.Parse(time.RFC3339Nano, doc["created"].(string))
+				return created, doc["_key"].(string)
+			}
+			// newer sorts before older, going backwards it's the other way around
+			newer := func(a, b obj) bool {
+				ac, ak := at(a)
+				bc, bk := at(b)
+				return ac.After(bc) || (ac.Equal(bc) && ak > bk)
+			}
+			found := []obj{}
+			for _, doc := range docs["writs"] {
+				if key, ok := vars["cursorKey"].(string); ok {
+					created, _ := time.Parse(time.RFC3339Nano, vars["cursorCreated"].(string))
+					cursor := obj{"created": created.Format(time.RFC3339Nano), "_key": key}
+					if (before && !newer(doc, cursor)) || (!before && !newer(cursor, doc)) {
+						continue
+					}
+				}
+				found = append(found, doc)
+			}
+			sort.Slice(found, func(i, j int) bool { return newer(found[i], found[j]) != before })
+			if size, ok := vars["pagesize"].(float64); ok && int(size) < len(found) {
+				found = found[:int(size)]
+			}
+			return found
+		}
+	}
+	// the backwards filter has to be matched before the plain sort
+	db.answer("writ._key > @cursorKey", page(true))
+	db.answer("SORT writ.created DESC, writ._key DESC", page(false))
+}
+
+func TestExecPageEqualCreated(t *testing.T) {
+	app, db := testApp(t, "paging")
+	answerKeyset(db)
+
+	// a batch imported at once shares its created time, the keys keep them in order
+	batch := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	want := []string{}
+	add := func(key string, created time.Time) {
+		db.put("writs", obj{"_key": key, "title": key, "slug": key, "public": true, "created": created.Format(time.RFC3339Nano)})
+	}
+	add("newest", batch.Add(time.Hour))
+	want = append(want, "newest")
+	for i := 5; i > 0; i-- {
+		key := fmt.Sprintf("batch-%d", i)
+		add(key, batch)
+		want = append(want, key)
+	}
+	add("oldest", batch.Add(-time.Hour))
+	want = append(want, "oldest")
+
+	walk := func(cursor string) WritPage {
+		t.Helper()
+		q := &writQuery{Cursor: cursor, PageSize: 2, EditorMode: true}
+		page, err := q.ExecPage(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	keys := func(page WritPage) string {
+		out := []string{}
+		for _, writ := range page.Writs {
+			out = append(out, writ.Key)
+		}
+		return strings.Join(out, ",")
+	}
+
+	pages := []WritPage{walk("")}
+	if len(pages[0].Prev) != 0 {
+		t.Error("the first page has a prev link")
+	}
+	for len(pages[len(pages)-1].Next) != 0 {
+		if len(pages) > len(want) {
+			t.Fatal("the next links never run out")
+		}
+		pages = append(pages, walk(pages[len(pages)-1].Next))
+	}
+	got := []string{}
+	for _, page := range pages {
+		for _, writ := range page.Writs {
+			got = append(got, writ.Key)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("walking next got\n%v\nwant\n%v", got, want)
+	}
+
+	// and back again, every prev link leads to the page that came before it
+	for i := len(pages) - 1; i > 0; i-- {
+		if len(pages[i].Prev) == 0 {
+			t.Fatalf("page %d (%s) has no prev link", i, keys(pages[i]))
+		}
+		prev := walk(pages[i].Prev)
+		if keys(prev) != keys(pages[i-1]) {
+			t.Errorf("prev from page %d (%s) got %s, want %s", i, keys(pages[i]), keys(prev), keys(pages[i-1]))
+		}
+		if i == 1 && len(prev.Prev) != 0 {
+			t.Error("going back to the first page, it still has a prev link")
+		}
+		if len(prev.Next) == 0 {
+			t.Errorf("going back to page %d, it lost its next link", i-1)
+		}
+	}
+}
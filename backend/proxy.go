@@ -0,0 +1,279 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var (
+	// ClientIPKey where the request's resolved client ip lives in the echo context
+	ClientIPKey = "clientip"
+	// ProxyHeaderTimeout how long a trusted peer gets to send its PROXY protocol header
+	ProxyHeaderTimeout = 5 * time.Second
+
+	// ErrBadProxyHeader the PROXY protocol header was malformed
+	ErrBadProxyHeader = errors.New("malformed PROXY protocol header")
+
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ClientIP the request's client ip, as resolved through any trusted proxies
+func ClientIP(c ctx) string {
+	if ip, ok := c.Get(ClientIPKey).(string); ok {
+		return ip
+	}
+	return peerIP(c.Request().RemoteAddr)
+}
+
+func peerIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// isTrustedProxy is the ip one of the configured proxies
+func (app *App) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range app.TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor the hops listed in a Forwarded header, or failing that X-Forwarded-For, nearest last
+func forwardedFor(h map[string][]string) []string {
+	hops := []string{}
+	for _, value := range h["Forwarded"] {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+					continue
+				}
+				node := strings.Trim(pair[4:], `"`)
+				if strings.HasPrefix(node, "[") {
+					// [2001:db8::1]:4711
+					node = strings.TrimPrefix(strings.SplitN(node, "]", 2)[0], "[")
+				} else if host, _, err := net.SplitHostPort(node); err == nil {
+					node = host
+				}
+				hops = append(hops, node)
+			}
+		}
+	}
+	if len(hops) != 0 {
+		return hops
+	}
+	for _, value := range h["X-Forwarded-For"] {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); len(hop) != 0 {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// resolveClientIP walk back from the connecting peer through trusted proxies,
+// the first hop that isn't a trusted proxy is the client
+func (app *App) resolveClientIP(remoteAddr string, h map[string][]string) string {
+	ip := peerIP(remoteAddr)
+	if !app.isTrustedProxy(ip) {
+		return ip
+	}
+	hops := forwardedFor(h)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// unknown or obfuscated identifiers can't be trusted any further
+			break
+		}
+		ip = hops[i]
+		if !app.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// ClientIPMiddleware resolve the real client ip once, and make echo's RealIP (and so the logger) agree with it
+func (app *App) ClientIPMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c ctx) error {
+			r := c.Request()
+			ip := app.resolveClientIP(r.RemoteAddr, r.Header)
+			c.Set(ClientIPKey, ip)
+			r.Header.Del("X-Forwarded-For")
+			r.Header.Set("X-Real-IP", ip)
+			return next(c)
+		}
+	}
+}
+
+// configureProxies read the "trusted_proxies" list of cidrs (or lone ips) and the "proxy_protocol" switch
+func (app *App) configureProxies() {
+	app.TrustedProxies = nil
+	for _, entry := range app.Conf.TrustedProxies {
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			fmt.Println("trusted_proxies: ", entry, " is not a valid cidr or ip")
+			critCheck(err)
+		}
+		app.TrustedProxies = append(app.TrustedProxies, network)
+	}
+	app.ProxyProtocol = app.Conf.ProxyProtocol
+}
+
+func initProxies(app *App) {
+	app.configureProxies()
+	app.Server.Pre(app.ClientIPMiddleware())
+}
+
+// proxyListener accept connections that may start with a PROXY protocol (v1 or v2) header,
+// the app says which peers are trusted to send one
+type proxyListener struct {
+	net.Listener
+	app *App
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), app: l.app}, nil
+}
+
+// proxyConn a connection whose remote address comes from its PROXY header,
+// read lazily so a slow peer can't hold up the accept loop
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	app    *App
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (p *proxyConn) init() {
+	p.once.Do(func() {
+		p.remote = p.Conn.RemoteAddr()
+		if !p.app.isTrustedProxy(peerIP(p.remote.String())) {
+			return
+		}
+		p.Conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+		defer p.Conn.SetReadDeadline(time.Time{})
+
+		var addr net.Addr
+		addr, p.err = readProxyHeader(p.reader)
+		if p.err != nil {
+			if p.app.DevMode {
+				fmt.Println("PROXY protocol - bad header from ", p.remote, ": ", p.err)
+			}
+			return
+		}
+		if addr != nil {
+			p.remote = addr
+		}
+	})
+}
+
+func (p *proxyConn) Read(b []byte) (int, error) {
+	p.init()
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.reader.Read(b)
+}
+
+func (p *proxyConn) RemoteAddr() net.Addr {
+	p.init()
+	return p.remote
+}
+
+// readProxyHeader parse a v1 or v2 PROXY protocol header,
+// a nil address means the proxy sent a LOCAL/UNKNOWN connection
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(start, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	start, err = r.Peek(6)
+	if err != nil || string(start) != "PROXY " {
+		return nil, ErrBadProxyHeader
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil || len(line) > 107 || !strings.HasSuffix(line, "\r\n") {
+		return nil, ErrBadProxyHeader
+	}
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, ErrBadProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	if header[12]&0x0F == 0 {
+		// LOCAL, the proxy talking for itself
+		return nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, ErrBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, ErrBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyTestApp(trusted ...string) *App {
+	app := &App{Conf: &Config{TrustedProxies: trusted}}
+	app.configureProxies()
+	return app
+}
+
+func TestResolveClientIP(t *testing.T) {
+	app := proxyTestApp("10.0.0.0/8", "192.0.2.1", "fd00::/8")
+	cases := []struct {
+		name   string
+		peer   string
+		header map[string][]string
+		want   string
+	}{
+		{"untrusted peer, no headers", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer spoofing x-forwarded-for", "203.0.113.7:5000",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.7"},
+		{"untrusted peer spoofing forwarded", "203.0.113.7:5000",
+			map[string][]string{"Forwarded": {"for=1.2.3.4"}}, "203.0.113.7"},
+		{"untrusted peer listing a trusted proxy", "203.0.113.7:5000",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4, 10.0.0.2"}}, "203.0.113.7"},
+		{"trusted peer, no headers", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"trusted peer", "10.0.0.1:5000",
+			map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}, "203.0.113.7"},
+		{"lone trusted ip", "192.0.2.1:5000",
+			map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}, "203.0.113.7"},
+		{"next to the lone trusted ip isn't trusted", "192.0.2.2:5000",
+			map[string][]string{"X-Forwarded-For": {"203.0.113.7"}}, "192.0.2.2"},
+		{"client spoofing hops before the proxy", "10.0.0.1:5000",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4, 203.0.113.7"}}, "203.0.113.7"},
+		{"a chain of trusted proxies", "10.0.0.1:5000",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4, 203.0.113.7, 10.0.0.3, 10.0.0.2"}}, "203.0.113.7"},
+		{"every hop trusted", "10.0.0.1:5000",
+			map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"several header lines", "10.0.0.1:5000",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4", "203.0.113.7"}}, "203.0.113.7"},
+		{"garbage hop stops the walk", "10.0.0.1:5000",
+			map[string][]string{"X-Forwarded-For": {"203.0.113.7, not-an-ip"}}, "10.0.0.1"},
+		{"garbage behind a trusted hop", "10.0.0.1:5000",
+			map[string][]string{"X-Forwarded-For": {"203.0.113.7, bogus, 10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded", "10.0.0.1:5000",
+			map[string][]string{"Forwarded": {"for=203.0.113.7;proto=https;by=10.0.0.1"}}, "203.0.113.7"},
+		{"forwarded with a port", "10.0.0.1:5000",
+			map[string][]string{"Forwarded": {`for="203.0.113.7:4711"`}}, "203.0.113.7"},
+		{"forwarded ipv6", "[fd00::1]:443",
+			map[string][]string{"Forwarded": {`for=1.2.3.4, For="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"forwarded wins over x-forwarded-for", "10.0.0.1:5000",
+			map[string][]string{"Forwarded": {"for=203.0.113.7"}, "X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.7"},
+		{"forwarded unknown", "10.0.0.1:5000",
+			map[string][]string{"Forwarded": {"for=unknown"}}, "10.0.0.1"},
+		{"forwarded obfuscated", "10.0.0.1:5000",
+			map[string][]string{"Forwarded": {"for=1.2.3.4, for=_hidden"}}, "10.0.0.1"},
+	}
+	for _, tc := range cases {
+		if got := app.resolveClientIP(tc.peer, tc.header); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// proxyV2 a v2 header, command is LOCAL (0) or PROXY (1), family is 1 for ipv4 and 2 for ipv6
+func proxyV2(version, command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, version<<4|command, family<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func v2Addrs(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	addrs := append(append([]byte{}, src...), dst...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, srcPort)
+	binary.BigEndian.PutUint16(ports[2:], dstPort)
+	return append(addrs, ports...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := v2Addrs(net.ParseIP("203.0.113.7").To4(), net.ParseIP("10.0.0.1").To4(), 56324, 443)
+	v6 := v2Addrs(net.ParseIP("2001:db8::7"), net.ParseIP("fd00::1"), 56324, 443)
+	cases := []struct {
+		name   string
+		header []byte
+		want   string
+		err    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"), "203.0.113.7:56324", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 fd00::1 56324 443\r\n"), "[2001:db8::7]:56324", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN 1.2.3.4 5.6.7.8 1 2\r\n"), "", false},
+		{"v1 no carriage return", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\n"), "", true},
+		{"v1 no line end", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443"), "", true},
+		{"v1 bad protocol", []byte("PROXY UDP4 203.0.113.7 10.0.0.1 56324 443\r\n"), "", true},
+		{"v1 bad ip", []byte("PROXY TCP4 203.0.113.999 10.0.0.1 56324 443\r\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 port 443\r\n"), "", true},
+		{"v1 missing fields", []byte("PROXY TCP4 203.0.113.7 10.0.0.1\r\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 100) + " 10.0.0.1 1 2\r\n"), "", true},
+		{"v1 lowercase", []byte("proxy TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"), "", true},
+		{"no header at all", []byte("GET / HTTP/1.1\r\n\r\n"), "", true},
+		{"empty", []byte{}, "", true},
+		{"v2 tcp4", proxyV2(2, 1, 1, v4), "203.0.113.7:56324", false},
+		{"v2 tcp6", proxyV2(2, 1, 2, v6), "[2001:db8::7]:56324", false},
+		{"v2 tcp4 with tlvs", proxyV2(2, 1, 1, append(v4, 0x04, 0, 1, 'x')), "203.0.113.7:56324", false},
+		{"v2 local", proxyV2(2, 0, 1, v4), "", false},
+		{"v2 unspecified family", proxyV2(2, 1, 0, nil), "", false},
+		{"v2 wrong version", proxyV2(1, 1, 1, v4), "", true},
+		{"v2 tcp4 too short", proxyV2(2, 1, 1, v4[:8]), "", true},
+		{"v2 tcp6 too short", proxyV2(2, 1, 2, v4), "", true},
+		{"v2 length past the end", append(proxyV2(2, 1, 1, nil)[:14], 0xff, 0xff), "", true},
+		{"v2 signature only", proxyV2Signature, "", true},
+	}
+	for _, tc := range cases {
+		r := bufio.NewReader(bytes.NewReader(append(tc.header, "GET / HTTP/1.1\r\n"...)))
+		addr, err := readProxyHeader(r)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, wanted one: %v", tc.name, err, tc.err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tc.want {
+			t.Errorf("%s: address %q, want %q", tc.name, got, tc.want)
+		}
+		if err == nil {
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("%s: the header wasn't all consumed, %q is left", tc.name, rest)
+			}
+		}
+	}
+}
+
+// TestProxyListener only trusted peers get their PROXY header read, anyone else's is just data
+func TestProxyListener(t *testing.T) {
+	cases := []struct {
+		name    string
+		trusted []string
+		remote  string
+		data    string
+		err     bool
+	}{
+		{"trusted", []string{"127.0.0.1"}, "203.0.113.7:56324", "hello", false},
+		{"untrusted", []string{"10.0.0.0/8"}, "127.0.0.1", "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\nhello", false},
+		{"trusted with a bad header", []string{"127.0.0.1"}, "127.0.0.1", "", true},
+	}
+	for _, tc := range cases {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &proxyListener{Listener: inner, app: proxyTestApp(tc.trusted...)}
+
+		header := "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"
+		if tc.err {
+			header = "PROXY TCP4 nonsense\r\n"
+		}
+		go func() {
+			conn, err := net.Dial("tcp", inner.Addr().String())
+			if err == nil {
+				conn.Write([]byte(header + "hello"))
+				conn.Close()
+			}
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(conn)
+		if (err != nil) != tc.err || string(data) != tc.data {
+			t.Errorf("%s: read %q, %v", tc.name, data, err)
+		}
+		if remote := conn.RemoteAddr().String(); !strings.HasPrefix(remote, tc.remote) {
+			t.Errorf("%s: remote %s, want %s", tc.name, remote, tc.remote)
+		}
+		conn.Close()
+		inner.Close()
+	}
+}
@@ -3,9 +3,14 @@ package backend
 import (
 	"context"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/arangodb/go-driver"
+	"github.com/labstack/echo"
 )
 
 type ratelimit struct {
@@ -18,9 +23,9 @@ type ratelimit struct {
 //
 // nb. maxcount starts from 0
 // to limit your user to 3 consecutive emails, set maxcount to 2
-func ratelimitEmail(email string, maxcount int64, duration time.Duration) bool {
+func (app *App) ratelimitEmail(email string, maxcount int64, duration time.Duration) bool {
 	var limit ratelimit
-	err := QueryOne(
+	err := app.QueryOne(
 		`UPSERT {_key: @key}
 		INSERT {_key: @key, start: @start, count: 0}
 		UPDATE {count: OLD.count + 1} IN ratelimits OPTIONS {waitForSync: true}
@@ -29,30 +34,30 @@ func ratelimitEmail(email string, maxcount int64, duration time.Duration) bool {
 		&limit,
 	)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("email ratelimits error: something happened ", err)
 		}
 		return false
 	}
 
-	if DevMode {
+	if app.DevMode {
 		fmt.Println(email, " - this email's ratelimiting expires then: ", time.Unix(limit.Start, 0).Add(duration))
 	}
 
 	if time.Since(time.Unix(limit.Start, 0).Add(duration)) > 0 {
-		_, err := RateLimits.RemoveDocument(driver.WithWaitForSync(context.Background()), email)
-		if DevMode && err != nil {
+		_, err := app.RateLimits.RemoveDocument(driver.WithWaitForSync(context.Background()), email)
+		if app.DevMode && err != nil {
 			fmt.Println("email ratelimits error: trouble resetting ", err)
 		}
 		return err == nil
 	} else if limit.Count > maxcount {
-		_, err := DB.Query(
+		_, err := app.DB.Query(
 			driver.WithWaitForSync(context.Background()),
 			`FOR l IN ratelimits FILTER l._key == @key
 			 UPDATE l WITH {count: l.count + 1, start: @start} IN ratelimits`,
 			obj{"start": time.Now().Add(5 * time.Minute).Unix(), "key": email},
 		)
-		if DevMode && err != nil {
+		if app.DevMode && err != nil {
 			fmt.Println("email ratelimits error: trouble removing entry ", err)
 		}
 		return false
@@ -60,3 +65,322 @@ func ratelimitEmail(email string, maxcount int64, duration time.Duration) bool {
 
 	return true
 }
+
+// RateLimitPolicy a token bucket, Limit tokens refilled evenly over Window,
+// keyed by "ip", "user" (falling back to ip) or "email" (set by the handler)
+type RateLimitPolicy struct {
+	Name   string
+	Limit  int64
+	Window time.Duration
+	Key    string
+}
+
+// Exempt policies without a limit don't count anything
+func (p *RateLimitPolicy) Exempt() bool {
+	return p.Limit <= 0 || p.Window <= 0
+}
+
+// rate tokens refilled per second
+func (p *RateLimitPolicy) rate() float64 {
+	return float64(p.Limit) / p.Window.Seconds()
+}
+
+// RateLimitRoute which policy guards the requests whose path starts with Prefix
+type RateLimitRoute struct {
+	Prefix string
+	Policy string
+}
+
+// RateLimitResult what taking a token from a bucket came to
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int64
+	// Reset how long till the bucket is full again, or when denied, till the next token
+	Reset time.Duration
+}
+
+// RateLimitStore somewhere token buckets are kept
+type RateLimitStore interface {
+	Take(key string, policy *RateLimitPolicy) (RateLimitResult, error)
+}
+
+// DefaultRateLimitPolicies the named rate limiting policies every App starts from
+func DefaultRateLimitPolicies() map[string]*RateLimitPolicy {
+	return map[string]*RateLimitPolicy{
+		"default":  {Name: "default", Limit: 120, Window: time.Minute, Key: "ip"},
+		"auth":     {Name: "auth", Limit: 10, Window: time.Minute, Key: "ip"},
+		"email":    {Name: "email", Limit: 5, Window: 10 * time.Minute, Key: "email"},
+		"search":   {Name: "search", Limit: 30, Window: time.Minute, Key: "user"},
+		"comments": {Name: "comments", Limit: 10, Window: time.Minute, Key: "user"},
+		"static":   {Name: "static", Key: "ip"},
+	}
+}
+
+// DefaultRateLimitRoutes request path prefixes and their policies every App starts from,
+// the longest matching prefix wins, prefixes match whole path segments only
+func DefaultRateLimitRoutes() []RateLimitRoute {
+	return []RateLimitRoute{
+		{"/auth", "auth"},
+		{"/oauth/token", "auth"},
+		{"/writ/query", "search"},
+		{"/admin/users", "search"},
+		{"/comments", "comments"},
+	}
+}
+
+var (
+	// RateLimitedError too many requests, back off for a bit
+	RateLimitedError = func(c ctx) error {
+		return JSONErr(c, 429, "too many requests, slow down and try again in a bit")
+	}
+)
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// memoryRateLimits in-process token buckets, for single instances and dev
+type memoryRateLimits struct {
+	sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func newMemoryRateLimits() *memoryRateLimits {
+	return &memoryRateLimits{buckets: map[string]*memoryBucket{}}
+}
+
+func (m *memoryRateLimits) Take(key string, policy *RateLimitPolicy) (RateLimitResult, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(policy.Limit), updated: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(policy.Limit), b.tokens+now.Sub(b.updated).Seconds()*policy.rate())
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return bucketResult(allowed, b.tokens, policy), nil
+}
+
+// prune forget buckets that have filled back up
+func (m *memoryRateLimits) prune() {
+	m.Lock()
+	defer m.Unlock()
+	for key, b := range m.buckets {
+		if time.Since(b.updated) > 2*time.Hour {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// dbRateLimits token buckets in the app's ratelimits collection, so every instance shares them,
+// while the db can't be reached each instance falls back on its own buckets
+type dbRateLimits struct {
+	app      *App
+	fallback *memoryRateLimits
+}
+
+const takeTokenQuery = `UPSERT {_key: @key}
+INSERT {_key: @key, bucket: true, tokens: @limit - 1, updated: @now, expires: @expires, allowed: true}
+UPDATE {
+	tokens: MIN([@limit, OLD.tokens + (@now - OLD.updated) * @rate]) >= 1 ?
+		MIN([@limit, OLD.tokens + (@now - OLD.updated) * @rate]) - 1 :
+		MIN([@limit, OLD.tokens + (@now - OLD.updated) * @rate]),
+	allowed: MIN([@limit, OLD.tokens + (@now - OLD.updated) * @rate]) >= 1,
+	updated: @now,
+	expires: @expires
+} IN ratelimits
+RETURN {tokens: NEW.tokens, allowed: NEW.allowed}`
+
+func (d dbRateLimits) Take(key string, policy *RateLimitPolicy) (RateLimitResult, error) {
+	var bucket struct {
+		Tokens  float64 `json:"tokens"`
+		Allowed bool    `json:"allowed"`
+	}
+	now := time.Now()
+	err := d.app.QueryOne(takeTokenQuery, obj{
+		"key":     key,
+		"limit":   policy.Limit,
+		"rate":    policy.rate(),
+		"now":     float64(now.UnixNano()) / 1e9,
+		"expires": now.Add(policy.Window).Unix(),
+	}, &bucket)
+	if err != nil {
+		fmt.Println("ratelimits error: couldn't take a token from the db, using this instance's buckets ", err)
+		return d.fallback.Take(key, policy)
+	}
+	return bucketResult(bucket.Allowed, bucket.Tokens, policy), nil
+}
+
+// prune remove buckets that have filled back up
+func (d dbRateLimits) prune() {
+	_, err := d.app.DB.Query(
+		context.Background(),
+		`FOR l IN ratelimits FILTER l.bucket == true AND l.expires < @now REMOVE l IN ratelimits`,
+		obj{"now": time.Now().Unix()},
+	)
+	if err != nil && d.app.DevMode {
+		fmt.Println("ratelimits error: trouble pruning buckets ", err)
+	}
+}
+
+func bucketResult(allowed bool, tokens float64, policy *RateLimitPolicy) RateLimitResult {
+	res := RateLimitResult{Allowed: allowed, Remaining: int64(math.Floor(tokens))}
+	missing := float64(policy.Limit) - tokens
+	if !allowed {
+		missing = 1 - tokens
+	}
+	res.Reset = time.Duration(math.Ceil(missing/policy.rate())) * time.Second
+	return res
+}
+
+// rateLimitPolicyFor the policy guarding a request
+func (app *App) rateLimitPolicyFor(c ctx) *RateLimitPolicy {
+	if c.Request().Method == "GET" && c.Path() == "/*" {
+		// echo's static file route, "/" is the listing page so it isn't one
+		return app.RateLimitPolicies["static"]
+	}
+	name, matched := "default", 0
+	path := c.Request().URL.Path
+	for _, route := range app.RateLimitRoutes {
+		if len(route.Prefix) > matched && pathUnder(path, route.Prefix) {
+			name, matched = route.Policy, len(route.Prefix)
+		}
+	}
+	if policy, ok := app.RateLimitPolicies[name]; ok {
+		return policy
+	}
+	return app.RateLimitPolicies["default"]
+}
+
+// pathUnder whether path is prefix or somewhere beneath it, /auth covers /auth/verify but not /author
+func pathUnder(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// rateLimitSubject who a request's tokens are taken from under a policy
+func (app *App) rateLimitSubject(c ctx, policy *RateLimitPolicy) string {
+	if policy.Key == "user" {
+		if cookie, err := c.Cookie("Auth"); err == nil {
+			if tk, err := app.Tokenator.Decode(cookie.Value); err == nil {
+				key, _, _ := parseAuthTokenPayload(tk.Payload)
+				return "user:" + key
+			}
+		}
+	}
+	return "ip:" + ClientIP(c)
+}
+
+// takeToken take a token from a policy's bucket for a subject, setting the RateLimit-* headers
+func (app *App) takeToken(c ctx, policy *RateLimitPolicy, subject string) bool {
+	res, err := app.RateLimiter.Take("rl:"+policy.Name+":"+subject, policy)
+	if err != nil && app.DevMode {
+		fmt.Println("ratelimits error: couldn't take a token, letting it through ", err)
+	}
+
+	h := c.Response().Header()
+	reset := strconv.FormatInt(int64(res.Reset.Seconds()), 10)
+	h.Set("RateLimit-Limit", strconv.FormatInt(policy.Limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(res.Remaining, 10))
+	h.Set("RateLimit-Reset", reset)
+	h.Set("RateLimit-Policy", strconv.FormatInt(policy.Limit, 10)+";w="+strconv.FormatInt(int64(policy.Window.Seconds()), 10))
+	if !res.Allowed {
+		h.Set("Retry-After", reset)
+	}
+	return res.Allowed
+}
+
+// RateLimitBy take a token from a named policy for a subject the handler knows about,
+// like the email someone is trying to log in with
+func (app *App) RateLimitBy(c ctx, policyName, subject string) bool {
+	policy, ok := app.RateLimitPolicies[policyName]
+	if !ok || policy.Exempt() {
+		return true
+	}
+	return app.takeToken(c, policy, policy.Key+":"+strings.ToLower(subject))
+}
+
+// RateLimitMiddleware take a token from the bucket of whichever policy guards the route
+func (app *App) RateLimitMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c ctx) error {
+			policy := app.rateLimitPolicyFor(c)
+			if policy.Exempt() || policy.Key == "email" {
+				return next(c)
+			}
+			if !app.takeToken(c, policy, app.rateLimitSubject(c, policy)) {
+				if app.DevMode {
+					fmt.Println("rate limited: ", policy.Name, ClientIP(c), c.Request().URL.Path)
+				}
+				return RateLimitedError(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// configureRateLimits apply the "ratelimit" section of the config over the defaults
+func (app *App) configureRateLimits() {
+	conf := app.Conf.RateLimit
+	for name, p := range conf.Policies {
+		policy := &RateLimitPolicy{Name: name, Key: "ip"}
+		if existing, ok := app.RateLimitPolicies[name]; ok {
+			*policy = *existing
+		}
+		if p.Limit != nil {
+			policy.Limit = *p.Limit
+		}
+		if p.Window != nil {
+			window, err := time.ParseDuration(*p.Window)
+			critCheck(err)
+			policy.Window = window
+		}
+		if p.Key != nil {
+			policy.Key = *p.Key
+		}
+		app.RateLimitPolicies[name] = policy
+	}
+	for prefix, policy := range conf.Routes {
+		app.RateLimitRoutes = append(app.RateLimitRoutes, RateLimitRoute{prefix, policy})
+	}
+	if conf.Backend != "memory" {
+		app.RateLimiter = dbRateLimits{app, newMemoryRateLimits()}
+	}
+}
+
+func initRateLimits(app *App) {
+	app.configureRateLimits()
+	app.Server.Use(app.RateLimitMiddleware())
+}
+
+func (app *App) startRateLimitPruning() {
+	ticker := time.NewTicker(10 * time.Minute)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+			switch store := app.RateLimiter.(type) {
+			case *memoryRateLimits:
+				store.prune()
+			case dbRateLimits:
+				store.prune()
+				store.fallback.prune()
+			}
+		}
+	}()
+}
@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPathUnder(t *testing.T) {
+	cases := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/auth", "/auth", true},
+		{"/auth/verify", "/auth", true},
+		{"/author", "/auth", false},
+		{"/writ/query", "/writ/query", true},
+		{"/writ", "/writ/query", false},
+		{"/anything", "/", true},
+	}
+	for _, tc := range cases {
+		if got := pathUnder(tc.path, tc.prefix); got != tc.want {
+			t.Errorf("%s under %s: %v, want %v", tc.path, tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitPolicies(t *testing.T) {
+	app, _ := testApp(t, "ratelimit")
+	cases := []struct {
+		path string
+		// policy the RateLimit-Policy header, none for exempt routes
+		policy string
+	}{
+		{"/", "120;w=60"},
+		{"/css/index.css", ""},
+		{"/writ/query", "30;w=60"},
+		{"/auth/verify", "10;w=60"},
+		{"/writ/a-writ", "120;w=60"},
+		{"/authors", ""},
+	}
+	for _, tc := range cases {
+		res := httptest.NewRecorder()
+		app.ServeHTTP(res, httptest.NewRequest("GET", tc.path, nil))
+		if got := res.Header().Get("RateLimit-Policy"); got != tc.policy {
+			t.Errorf("GET %s: policy %q, want %q", tc.path, got, tc.policy)
+		}
+	}
+}
+
+func TestDBRateLimitsFallback(t *testing.T) {
+	// the fake db answers every query with nothing, so taking a token from it fails
+	app, _ := testApp(t, "ratelimit")
+	store := dbRateLimits{app, newMemoryRateLimits()}
+	policy := &RateLimitPolicy{Name: "test", Limit: 2, Window: time.Minute, Key: "ip"}
+
+	for i, want := range []bool{true, true, false} {
+		res, err := store.Take("rl:test:ip:192.0.2.1", policy)
+		if err != nil {
+			t.Fatalf("take %d: %v", i, err)
+		}
+		if res.Allowed != want {
+			t.Errorf("take %d: allowed %v, want %v", i, res.Allowed, want)
+		}
+	}
+	if res, _ := store.Take("rl:test:ip:192.0.2.2", policy); !res.Allowed {
+		t.Error("another subject shares the fallback bucket")
+	}
+}
@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"regexp"
+
+	"github.com/arangodb/go-driver"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+var (
+	// ErrUntrustedInjection only admins may add raw html/script injections to writs
+	ErrUntrustedInjection = errors.New("only admins may set a writ's injection")
+
+	scriptTag = regexp.MustCompile(`(?i)<script\b`)
+)
+
+// sanitizePolicy the named sanitization policies writ content can be held to
+func sanitizePolicy(name string) *bluemonday.Policy {
+	switch name {
+	case "strict":
+		return bluemonday.StrictPolicy()
+	case "rich":
+		p := bluemonday.UGCPolicy()
+		// code highlighting and heading anchors need these
+		p.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-zA-Z0-9 _-]+$`)).Globally()
+		p.AllowAttrs("id").Matching(regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)).Globally()
+		p.AllowElements("figure", "figcaption", "details", "summary", "mark")
+		return p
+	}
+	return bluemonday.UGCPolicy()
+}
+
+// DefaultSanitizePolicies which bluemonday policy author markdown is sanitized with,
+// by the author's highest role, before the config's "sanitize" section
+func DefaultSanitizePolicies() map[Role]*bluemonday.Policy {
+	return map[Role]*bluemonday.Policy{
+		UnverifiedUser: sanitizePolicy("strict"),
+		VerifiedUser:   sanitizePolicy("ugc"),
+		Admin:          sanitizePolicy("rich"),
+	}
+}
+
+// PolicyFor the sanitization policy for someone with certain roles, the highest role wins
+func (app *App) PolicyFor(roles []Role) *bluemonday.Policy {
+	var best Role
+	for _, role := range roles {
+		if _, ok := app.SanitizePolicies[role]; ok && role > best {
+			best = role
+		}
+	}
+	if policy, ok := app.SanitizePolicies[best]; ok {
+		return policy
+	}
+	return app.SanitizePolicies[UnverifiedUser]
+}
+
+// configureSanitizer apply the "sanitize" section of the config, mapping role names to policy names
+func (app *App) configureSanitizer() {
+	for name, policy := range app.Conf.Sanitize {
+		for role, roleName := range RoleNames {
+			if roleName == name {
+				app.SanitizePolicies[role] = sanitizePolicy(policy)
+			}
+		}
+	}
+}
+
+// trustedInjection mark an admin's injection as safe html,
+// giving its scripts the page's csp nonce so they're allowed to run
+func trustedInjection(injection, nonce string) template.HTML {
+	if len(injection) == 0 {
+		return ""
+	}
+	return template.HTML(scriptTag.ReplaceAllString(injection, `<script nonce="`+nonce+`"`))
+}
+
+// authorRoles the roles a writ's content should be sanitized for
+func (app *App) authorRoles(authorKey string, fallback *User) []Role {
+	if len(authorKey) != 0 {
+		if author, err := app.UserByKey(authorKey); err == nil {
+			return author.Roles
+		}
+	}
+	if fallback != nil {
+		return fallback.Roles
+	}
+	return nil
+}
+
+// ResanitizeWrits re-render and re-sanitize every stored writ's content from its markdown,
+// for when the sanitization policies change
+func (app *App) ResanitizeWrits() (int, error) {
+	ctx := driver.WithQueryCount(context.Background())
+	cursor, err := app.DB.Query(ctx, `FOR writ IN writs FILTER writ.markdown != null RETURN KEEP(writ, "_key", "slug", "markdown", "authorkey")`, obj{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	count := 0
+	for {
+		var writ Writ
+		_, err = cursor.ReadDocument(ctx, &writ)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return count, err
+		}
+		writ.RenderContent(app.PolicyFor(app.authorRoles(writ.AuthorKey, nil)))
+		_, err = app.Writs.UpdateDocument(context.Background(), writ.Key, obj{"content": writ.Content})
+		if err != nil {
+			return count, err
+		}
+		app.invalidateWrits(writ.Slug)
+		count++
+	}
+	return count, nil
+}
+
+func initSanitizer(app *App) {
+	app.Server.POST("/admin/writs/resanitize", app.AdminHandle(func(c ctx, admin *User) error {
+		count, err := app.ResanitizeWrits()
+		if err != nil {
+			if app.DevMode {
+				fmt.Println("resanitizing writs - error: ", err)
+			}
+			return ServerDBError(c)
+		}
+		app.Audit(c, admin, "writ.resanitize", "writs", nil, obj{"count": count})
+		return c.JSON(200, obj{"ok": true, "count": count})
+	}))
+}
@@ -0,0 +1,236 @@
+package backend
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Machiel/slugify"
+)
+
+// staticManifest what the last static build wrote, so the next one only re-renders what changed
+type staticManifest struct {
+	Built time.Time            `json:"built"`
+	Writs map[string]time.Time `json:"writs"`
+}
+
+// StaticReport what a static build did
+type StaticReport struct {
+	Rendered int `json:"rendered"`
+	Skipped  int `json:"skipped"`
+	Removed  int `json:"removed"`
+	Tags     int `json:"tags"`
+	Assets   int `json:"assets"`
+}
+
+const staticManifestFile = ".static-manifest.json"
+
+// staticAssetSkips assets that only work against the live api, the generated index replaces them
+var staticAssetSkips = map[string]bool{"index.html": true, "admin.html": true}
+
+// publicWrits every writ anyone may read, newest first
+func (app *App) publicWrits() ([]Writ, error) {
+	writs, err := app.allWrits()
+	if err != nil {
+		return nil, err
+	}
+	public := []Writ{}
+	for i := len(writs) - 1; i >= 0; i-- {
+		if writs[i].Public && !writs[i].MembersOnly {
+			public = append(public, writs[i])
+		}
+	}
+	return public, nil
+}
+
+// BuildStaticSite render every public writ through the post.html template into out, along with
+// index and tag listings, their feeds and a copy of the assets folder. All links are relative
+// so the directory works from any path, or straight off the disk.
+// Writ pages whose Edits haven't changed since the last build are left alone unless full is set,
+// or the post template itself changed.
+func (app *App) BuildStaticSite(out string, full bool) (StaticReport, error) {
+	var report StaticReport
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return report, err
+	}
+
+	manifest := staticManifest{Writs: map[string]time.Time{}}
+	if data, err := ioutil.ReadFile(filepath.Join(out, staticManifestFile)); err == nil {
+		json.Unmarshal(data, &manifest)
+	}
+	if app.Templates.Modified().After(manifest.Built) {
+		full = true
+	}
+
+	writs, err := app.publicWrits()
+	if err != nil {
+		return report, err
+	}
+
+	built := staticManifest{Built: time.Now(), Writs: map[string]time.Time{}}
+	byTag := map[string][]Writ{}
+	tagNames := map[string]string{}
+	for i := range writs {
+		writ := &writs[i]
+		edited := writ.lastEdited()
+		built.Writs[writ.Slug] = edited
+		for _, tag := range writ.Tags {
+			tagSlug := slugify.Slugify(tag)
+			byTag[tagSlug] = append(byTag[tagSlug], *writ)
+			tagNames[tagSlug] = tag
+		}
+
+		page := filepath.Join(out, "writ", writ.Slug, "index.html")
+		if previous, ok := manifest.Writs[writ.Slug]; ok && !full && previous.Equal(edited) {
+			if _, err := os.Stat(page); err == nil {
+				report.Skipped++
+				continue
+			}
+		}
+		data := writ.pageData(app, "", "../..")
+		// static copies can't count on anything off the site, index.css falls back to system fonts
+		data["Static"] = true
+		html, err := app.Templates.Bytes("post.html", data)
+		if err != nil {
+			return report, err
+		}
+		if err := writeStaticFile(page, html); err != nil {
+			return report, err
+		}
+		report.Rendered++
+	}
+
+	// writs that were unpublished or deleted since the last build
+	for slug := range manifest.Writs {
+		if _, ok := built.Writs[slug]; !ok {
+			if err := os.RemoveAll(filepath.Join(out, "writ", slug)); err != nil {
+				return report, err
+			}
+			report.Removed++
+		}
+	}
+
+	if report.Assets, err = copyStaticAssets(app.Conf.Assets, out); err != nil {
+		return report, err
+	}
+
+	err = app.writeStaticListing(out, "index.html", ".", app.Conf.AppName, "", writs)
+	if err != nil {
+		return report, err
+	}
+	feed, err := app.WritFeed(app.Conf.AppName, "https://"+app.Conf.Domain+"/feed.xml", ".", writs)
+	if err != nil {
+		return report, err
+	}
+	if err = writeStaticFile(filepath.Join(out, "feed.xml"), feed); err != nil {
+		return report, err
+	}
+
+	// tags are cheap, so they're rebuilt from scratch every time
+	if err = os.RemoveAll(filepath.Join(out, "tag")); err != nil {
+		return report, err
+	}
+	for tagSlug, tagged := range byTag {
+		dir := filepath.Join("tag", tagSlug)
+		title := app.Conf.AppName + " - " + tagNames[tagSlug]
+		err = app.writeStaticListing(out, filepath.Join(dir, "index.html"), "../..", title, "../../index.html", tagged)
+		if err != nil {
+			return report, err
+		}
+		feed, err := app.WritFeed(title, "https://"+app.Conf.Domain+"/tag/"+tagSlug+"/feed.xml", "../..", tagged)
+		if err != nil {
+			return report, err
+		}
+		if err = writeStaticFile(filepath.Join(out, dir, "feed.xml"), feed); err != nil {
+			return report, err
+		}
+		report.Tags++
+	}
+
+	data, err := json.MarshalIndent(built, "", "  ")
+	if err != nil {
+		return report, err
+	}
+	return report, writeStaticFile(filepath.Join(out, staticManifestFile), data)
+}
+
+// writeStaticListing render a list of writs (newest first) to out/location, root leads back to out from there
+func (app *App) writeStaticListing(out, location, root, title, home string, writs []Writ) error {
+	items := listingWrits(writs, func(slug string) string {
+		return root + "/writ/" + slug + "/index.html"
+	}, func(tag string) string {
+		return root + "/tag/" + slugify.Slugify(tag) + "/index.html"
+	})
+
+	html, err := app.Templates.Bytes("list.html", obj{
+		"Title":  title,
+		"Root":   root,
+		"Home":   home,
+		"Feed":   "feed.xml",
+		"Writs":  items,
+		"Static": true,
+	})
+	if err != nil {
+		return err
+	}
+	return writeStaticFile(filepath.Join(out, location), html)
+}
+
+func writeStaticFile(location string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(location, data, 0644)
+}
+
+// copyStaticAssets copy the assets folder into out, skipping files that are already up to date
+func copyStaticAssets(assets, out string) (int, error) {
+	copied := 0
+	if len(assets) == 0 {
+		return copied, nil
+	}
+	err := filepath.Walk(assets, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(assets, path)
+		if err != nil || staticAssetSkips[rel] || strings.HasPrefix(filepath.Base(rel), ".") {
+			return err
+		}
+		dest := filepath.Join(out, rel)
+		if existing, err := os.Stat(dest); err == nil &&
+			existing.Size() == info.Size() && !existing.ModTime().Before(info.ModTime()) {
+			return nil
+		}
+		if err := copyFile(path, dest); err != nil {
+			return err
+		}
+		copied++
+		return os.Chtimes(dest, info.ModTime(), info.ModTime())
+	})
+	return copied, err
+}
+
+func copyFile(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
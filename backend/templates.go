@@ -0,0 +1,349 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Machiel/slugify"
+	"github.com/labstack/echo"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// TemplateRegistry every template the app renders, loaded from the templates directory
+// with a theme directory laid over it. Files under layouts/ and partials/ are shared by
+// every page, any other .html file is a page (html/template) and any .txt file is a plain
+// text template, both named by their path relative to the directory, like "post.html".
+type TemplateRegistry struct {
+	// Dirs where templates come from, later ones override earlier ones file by file
+	Dirs []string
+	// AppName what {{appname}} says
+	AppName string
+	// AssetsFolder where {{asset}} finds the files it hashes
+	AssetsFolder string
+	// Markdown the policy {{markdown}} sanitizes with, nil leaves it unsanitized
+	Markdown *bluemonday.Policy
+	// DevMode error pages show what went wrong
+	DevMode bool
+
+	sync.RWMutex
+	html     map[string]*htmltemplate.Template
+	text     map[string]*template.Template
+	modified time.Time
+	loadErr  error
+
+	assetsLock sync.Mutex
+	assets     map[string]assetHash
+}
+
+type assetHash struct {
+	modified time.Time
+	hash     string
+}
+
+var (
+	// TemplateReloadInterval how often templates are checked for changes in dev mode
+	TemplateReloadInterval = time.Second
+	// ErrNoSuchTemplate there's no template by that name in the templates or theme directories
+	ErrNoSuchTemplate = errors.New("there's no template by that name")
+)
+
+// NewTemplateRegistry load the templates from dirs, later ones override earlier ones
+func NewTemplateRegistry(dirs ...string) (*TemplateRegistry, error) {
+	r := &TemplateRegistry{Dirs: dirs, assets: map[string]assetHash{}}
+	return r, r.Load()
+}
+
+// funcs what every template gets to use
+func (r *TemplateRegistry) funcs() map[string]interface{} {
+	return map[string]interface{}{
+		// {{.CreateDate | date "2 Jan 2006"}}
+		"date": templateDate,
+		// {{markdown .Bio}} rendered and sanitized as strictly as an unverified user's writ
+		"markdown": func(text string) htmltemplate.HTML {
+			return htmltemplate.HTML(renderMarkdown([]byte(text), r.Markdown))
+		},
+		// {{asset "/css/index.css"}} -> /css/index.css?v=<content hash>
+		"asset":   r.asset,
+		"slug":    slugify.Slugify,
+		"join":    strings.Join,
+		"appname": func() string { return r.AppName },
+	}
+}
+
+func templateDate(layout string, value interface{}) string {
+	switch t := value.(type) {
+	case time.Time:
+		return t.Format(layout)
+	case *time.Time:
+		if t != nil {
+			return t.Format(layout)
+		}
+	case string:
+		if parsed, err := time.Parse(time.RFC3339, t); err == nil {
+			return parsed.Format(layout)
+		}
+		return t
+	}
+	return ""
+}
+
+// asset an asset's url with a hash of its contents on the end, so it can be cached forever
+func (r *TemplateRegistry) asset(path string) string {
+	location := filepath.Join(r.AssetsFolder, filepath.FromSlash(strings.TrimPrefix(path, "/")))
+	info, err := os.Stat(location)
+	if err != nil {
+		return path
+	}
+
+	r.assetsLock.Lock()
+	defer r.assetsLock.Unlock()
+	cached, ok := r.assets[path]
+	if !ok || !cached.modified.Equal(info.ModTime()) {
+		data, err := ioutil.ReadFile(location)
+		if err != nil {
+			return path
+		}
+		sum := sha256.Sum256(data)
+		cached = assetHash{info.ModTime(), hex.EncodeToString(sum[:4])}
+		r.assets[path] = cached
+	}
+	return path + "?v=" + cached.hash
+}
+
+// files every template file by name, theme files replacing the defaults,
+// and when the newest of them was last changed
+func (r *TemplateRegistry) files() (map[string]string, time.Time, error) {
+	files := map[string]string{}
+	var modified time.Time
+	for _, dir := range r.Dirs {
+		if len(dir) == 0 {
+			continue
+		}
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			ext := filepath.Ext(path)
+			if ext != ".html" && ext != ".txt" {
+				return nil
+			}
+			name, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			files[filepath.ToSlash(name)] = path
+			if info.ModTime().After(modified) {
+				modified = info.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, modified, err
+		}
+	}
+	return files, modified, nil
+}
+
+func isSharedTemplate(name string) bool {
+	return strings.HasPrefix(name, "layouts/") || strings.HasPrefix(name, "partials/")
+}
+
+// Load (re)parse every template, on failure the templates loaded before stay in use
+func (r *TemplateRegistry) Load() error {
+	err := r.load()
+	r.Lock()
+	r.loadErr = err
+	r.Unlock()
+	return err
+}
+
+func (r *TemplateRegistry) load() error {
+	files, modified, err := r.files()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sources := map[string]string{}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(files[name])
+		if err != nil {
+			return err
+		}
+		sources[name] = string(data)
+	}
+
+	htmlBase := htmltemplate.New("").Funcs(r.funcs())
+	textBase := template.New("").Funcs(r.funcs())
+	for _, name := range names {
+		if !isSharedTemplate(name) {
+			continue
+		}
+		if strings.HasSuffix(name, ".html") {
+			_, err = htmlBase.New(name).Parse(sources[name])
+		} else {
+			_, err = textBase.New(name).Parse(sources[name])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	htmlPages := map[string]*htmltemplate.Template{}
+	textPages := map[string]*template.Template{}
+	for _, name := range names {
+		if isSharedTemplate(name) {
+			continue
+		}
+		if strings.HasSuffix(name, ".html") {
+			page, err := htmlBase.Clone()
+			if err == nil {
+				_, err = page.New(name).Parse(sources[name])
+			}
+			if err != nil {
+				return err
+			}
+			htmlPages[name] = page
+		} else {
+			page, err := textBase.Clone()
+			if err == nil {
+				_, err = page.New(name).Parse(sources[name])
+			}
+			if err != nil {
+				return err
+			}
+			textPages[name] = page
+		}
+	}
+
+	r.Lock()
+	r.html, r.text, r.modified = htmlPages, textPages, modified
+	r.Unlock()
+	return nil
+}
+
+// Modified when the newest template file was last changed
+func (r *TemplateRegistry) Modified() time.Time {
+	r.RLock()
+	defer r.RUnlock()
+	return r.modified
+}
+
+// Execute render a template into w, all or nothing: w doesn't see a byte of it if it fails
+func (r *TemplateRegistry) Execute(w io.Writer, name string, data interface{}) error {
+	out, err := r.Bytes(name, data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// Bytes render a template
+func (r *TemplateRegistry) Bytes(name string, data interface{}) ([]byte, error) {
+	r.RLock()
+	htmlPage, isHTML := r.html[name]
+	textPage, isText := r.text[name]
+	r.RUnlock()
+
+	var buf bytes.Buffer
+	var err error
+	switch {
+	case isHTML:
+		err = htmlPage.ExecuteTemplate(&buf, name, data)
+	case isText:
+		err = textPage.ExecuteTemplate(&buf, name, data)
+	default:
+		err = ErrNoSuchTemplate
+	}
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %v", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Render lets echo's c.Render use the registry
+func (r *TemplateRegistry) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	return r.Execute(w, name, data)
+}
+
+// Page render a template as the response, or if it fails an error page instead of
+// half a page: the template error itself in dev mode, an apology otherwise
+func (r *TemplateRegistry) Page(c ctx, code int, name string, data interface{}) error {
+	out, err := r.Bytes(name, data)
+	if err == nil {
+		return c.HTMLBlob(code, out)
+	}
+	fmt.Println("rendering a page failed: ", err)
+
+	details := "Something went wrong putting this page together, try again in a bit."
+	if r.DevMode {
+		details = err.Error()
+		r.RLock()
+		if r.loadErr != nil {
+			details += "\n\nthe templates also failed to reload:\n" + r.loadErr.Error()
+		}
+		r.RUnlock()
+	}
+	return c.HTML(500, `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>`+r.AppName+` - error</title></head>
+<body>
+  <h3>This page couldn't be rendered</h3>
+  <pre>`+htmltemplate.HTMLEscapeString(details)+`</pre>
+</body>
+</html>`)
+}
+
+// Error render error.html as the response, for routes that answer browsers rather than scripts
+func (r *TemplateRegistry) Error(c ctx, code int, message string) error {
+	return r.Page(c, code, "error.html", obj{
+		"Title":   http.StatusText(code),
+		"Message": message,
+		"Root":    "",
+	})
+}
+
+// watch reload the templates whenever one of them changes, until done closes
+func (r *TemplateRegistry) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(TemplateReloadInterval)
+	go func() {
+		defer ticker.Stop()
+		seen := r.Modified()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			_, modified, err := r.files()
+			if err != nil || !modified.After(seen) {
+				continue
+			}
+			seen = modified
+			if err = r.Load(); err != nil {
+				fmt.Println("templates changed but didn't reload: ", err)
+			} else {
+				fmt.Println("templates reloaded")
+			}
+		}
+	}()
+}
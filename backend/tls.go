@@ -0,0 +1,221 @@
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// CertWatchInterval how often certificate files are checked for changes, unless tls.watch_interval says otherwise
+	CertWatchInterval = 30 * time.Second
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+// certWatcher serve a certificate from files, reloading it when they change on disk
+type certWatcher struct {
+	sync.RWMutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+	modified          time.Time
+	interval          time.Duration
+}
+
+func newCertWatcher(certFile, keyFile string, interval time.Duration) (*certWatcher, error) {
+	w := &certWatcher{certFile: certFile, keyFile: keyFile, interval: interval}
+	return w, w.reload()
+}
+
+// lastModified the later of the cert and key files' modification times
+func (w *certWatcher) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(w.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(w.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+func (w *certWatcher) reload() error {
+	modified, err := w.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+	w.Lock()
+	w.cert = &cert
+	w.modified = modified
+	w.Unlock()
+	return nil
+}
+
+// watch poll the files, swapping in the new certificate once both halves load,
+// a half-written renewal just keeps the old one around until the next check
+func (w *certWatcher) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			modified, err := w.lastModified()
+			w.RLock()
+			changed := err == nil && modified.After(w.modified)
+			w.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := w.reload(); err != nil {
+				fmt.Println("certificate changed but couldn't be reloaded: ", err)
+			} else {
+				fmt.Println("reloaded certificate ", w.certFile)
+			}
+		}
+	}()
+}
+
+func (w *certWatcher) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.RLock()
+	defer w.RUnlock()
+	return w.cert, nil
+}
+
+// cipherSuiteByName look up a cipher suite by its standard name, like TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+func cipherSuiteByName(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			fmt.Println("warning: tls cipher suite ", name, " is considered insecure")
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// configureTLS apply the "tls" section of the config, min_version and ciphers
+func (app *App) configureTLS() error {
+	conf := app.Conf.TLS
+	if len(conf.MinVersion) != 0 {
+		version, ok := tlsVersions[strings.TrimPrefix(conf.MinVersion, "TLS")]
+		if !ok {
+			return errors.New("tls.min_version should be one of 1.0, 1.1, 1.2 or 1.3")
+		}
+		app.TLSMinVersion = version
+	}
+	if len(conf.Ciphers) != 0 {
+		app.TLSCipherSuites = []uint16{}
+		for _, name := range conf.Ciphers {
+			id, ok := cipherSuiteByName(name)
+			if !ok {
+				return errors.New("tls.ciphers: unknown cipher suite " + name)
+			}
+			app.TLSCipherSuites = append(app.TLSCipherSuites, id)
+		}
+	}
+	if len(conf.WatchInterval) != 0 {
+		interval, err := time.ParseDuration(conf.WatchInterval)
+		if err != nil {
+			return err
+		}
+		app.CertWatchInterval = interval
+	}
+	return nil
+}
+
+// loadCABundle a cert pool holding the certificates in a pem bundle
+func loadCABundle(location string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in ca bundle " + location)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig where the https server gets its certificates:
+// ACME when it's configured, otherwise the https_cert/https_key files, watched for changes
+// until the app stops
+func (app *App) serverTLSConfig() (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion:   app.TLSMinVersion,
+		CipherSuites: app.TLSCipherSuites,
+	}
+	if app.ACME != nil {
+		app.ACME.watch(app.done)
+		conf.GetCertificate = app.ACME.GetCertificate
+		return conf, nil
+	}
+
+	certFile, keyFile := app.Conf.HTTPSCert, app.Conf.HTTPSKey
+	if !app.DevMode && (len(certFile) == 0 || len(keyFile) == 0) {
+		certFile = "/etc/letsencrypt/live/" + app.Conf.Domain + "/cert.pem"
+		keyFile = "/etc/letsencrypt/live/" + app.Conf.Domain + "/privkey.pem"
+	}
+	watcher, err := newCertWatcher(certFile, keyFile, app.CertWatchInterval)
+	if err != nil {
+		return nil, err
+	}
+	watcher.watch(app.done)
+	conf.GetCertificate = watcher.GetCertificate
+	return conf, nil
+}
+
+// insecureHandler what the plain http server does, answer ACME challenges then redirect to https
+func (app *App) insecureHandler(redirect http.Handler) http.Handler {
+	if app.ACME != nil {
+		return app.ACME.HTTPHandler(redirect)
+	}
+	return redirect
+}
+
+// dbTLSConfig verify the arangodb server against the db_ca bundle (or the system roots),
+// under the name db_server_name, the app's domain by default
+func (app *App) dbTLSConfig() (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName: app.Conf.DBServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(conf.ServerName) == 0 {
+		conf.ServerName = app.Conf.Domain
+	}
+	if bundle := app.Conf.DBCA; len(bundle) != 0 {
+		pool, err := loadCABundle(bundle)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
@@ -0,0 +1,316 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+)
+
+var (
+	// ErrNoTOTP the user hasn't enrolled in TOTP
+	ErrNoTOTP = errors.New("no totp second factor set up")
+	// ErrBadTOTPCode the code didn't check out
+	ErrBadTOTPCode = errors.New("invalid second factor code")
+	// ErrBadTOTPBootstrap the bootstrap token was wrong, spent or expired
+	ErrBadTOTPBootstrap = errors.New("invalid or expired totp bootstrap token")
+	// ErrTOTPEnabled there's already a second factor, disable it first
+	ErrTOTPEnabled = errors.New("a second factor is already set up, disable it first")
+	// ErrMFALockout too many wrong second factor codes
+	ErrMFALockout = errors.New("too many wrong second factor codes, try again later")
+	// TOTPPeriod how long each TOTP code is good for
+	TOTPPeriod int64 = 30
+	// TOTPDigits how long TOTP codes are
+	TOTPDigits = 6
+	// TOTPSkew how many periods either side of now are still accepted
+	TOTPSkew int64 = 1
+	// RecoveryCodeCount how many recovery codes a user gets on enrolling
+	RecoveryCodeCount = 10
+	// TOTPBootstrapTTL how long a cli minted bootstrap token lasts
+	TOTPBootstrapTTL = time.Hour
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// TOTPConfig a user's RFC 6238 second factor
+type TOTPConfig struct {
+	Secret        string   `json:"secret"`
+	Enabled       bool     `json:"enabled,omitempty"`
+	RecoveryCodes []string `json:"recoverycodes,omitempty"`
+	// LastCounter the last time step used, so codes can't be replayed
+	LastCounter int64 `json:"lastcounter,omitempty"`
+	// Bootstrap the hash of a one-time token from the cli that lets an admin
+	// enroll without a session that passed a second factor
+	Bootstrap        string `json:"bootstrap,omitempty"`
+	BootstrapExpires int64  `json:"bootstrapexpires,omitempty"`
+}
+
+// MFARequiredError the route needs a session that passed a second factor
+func MFARequiredError(c ctx, user *User) error {
+	enrolled := user.TOTP != nil && user.TOTP.Enabled
+	msg := "a second factor is required, verify with your authenticator app"
+	if !enrolled {
+		msg = "a second factor is required, set up an authenticator app first"
+	}
+	return c.JSON(401, obj{"err": msg, "ok": false, "mfa": true, "enrolled": enrolled})
+}
+
+// totpCode compute the code for a secret at a time step (RFC 4226 truncation)
+func totpCode(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod)
+}
+
+// checkTOTP find the time step a code belongs to, or -1 if it's no good
+func checkTOTP(secret string, code string, now time.Time) int64 {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != TOTPDigits {
+		return -1
+	}
+	counter := now.Unix() / TOTPPeriod
+	for i := -TOTPSkew; i <= TOTPSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter+i)), []byte(code)) == 1 {
+			return counter + i
+		}
+	}
+	return -1
+}
+
+func hashRecoveryCode(key, code string) string {
+	sum := sha256.Sum256([]byte(key + ":" + strings.ToLower(strings.Replace(code, "-", "", -1))))
+	return hex.EncodeToString(sum[:])
+}
+
+// TOTPURI the otpauth uri authenticator apps scan or import
+func (user *User) TOTPURI(app *App) string {
+	label := url.PathEscape(app.Conf.AppName + ":" + user.Username)
+	v := url.Values{}
+	v.Set("secret", user.TOTP.Secret)
+	v.Set("issuer", app.Conf.AppName)
+	v.Set("period", strconv.FormatInt(TOTPPeriod, 10))
+	v.Set("digits", strconv.Itoa(TOTPDigits))
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// BootstrapTOTP mint a one-time token for an admin to enroll with,
+// only its hash is stored and enrolling spends it
+func (user *User) BootstrapTOTP(app *App) (string, error) {
+	if user.TOTP != nil && user.TOTP.Enabled {
+		return "", ErrTOTPEnabled
+	}
+	token := RandStr(32)
+	err := user.Update(app,
+		`{totp: MERGE(NOT_NULL(u.totp, {}), {bootstrap: @bootstrap, bootstrapexpires: @expires})}`,
+		obj{"bootstrap": hashLoginCode(user.Key, token), "expires": time.Now().Add(TOTPBootstrapTTL).Unix()},
+	)
+	return token, err
+}
+
+// EnrollTOTP start setting up a TOTP second factor, it isn't enabled until confirmed,
+// with a bootstrap token the enrollment only happens if the token matches, spending it
+func (user *User) EnrollTOTP(app *App, bootstrap string) error {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	totp := TOTPConfig{Secret: totpEncoding.EncodeToString(secret)}
+	if len(bootstrap) == 0 {
+		return user.Update(app, `{totp: @totp}`, obj{"totp": totp})
+	}
+
+	err := user.Update(app,
+		`u.totp.bootstrap == @bootstrap && u.totp.bootstrapexpires > @now ? {totp: @totp} : {}`,
+		obj{"totp": totp, "bootstrap": hashLoginCode(user.Key, bootstrap), "now": time.Now().Unix()},
+	)
+	if err == nil && (user.TOTP == nil || user.TOTP.Secret != totp.Secret) {
+		return ErrBadTOTPBootstrap
+	}
+	return err
+}
+
+// resetMFAAttempts forget a user's wrong second factor codes after a good one
+func (app *App) resetMFAAttempts(attemptsKey string) {
+	_, err := app.RateLimits.RemoveDocument(context.Background(), attemptsKey)
+	if err != nil && !driver.IsNotFound(err) {
+		fmt.Println("VerifySecondFactor - trouble resetting attempts: ", err)
+	}
+}
+
+// ConfirmTOTP enable a pending TOTP enrollment with a first good code,
+// returns a fresh set of recovery codes which are only stored hashed
+func (user *User) ConfirmTOTP(app *App, code string) ([]string, error) {
+	if user.TOTP == nil {
+		return nil, ErrNoTOTP
+	}
+	counter := checkTOTP(user.TOTP.Secret, code, time.Now())
+	if counter < 0 {
+		return nil, ErrBadTOTPCode
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		raw := strings.ToLower(RandStr(10))
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashRecoveryCode(user.Key, codes[i])
+	}
+
+	totp := *user.TOTP
+	totp.Enabled = true
+	totp.RecoveryCodes = hashes
+	totp.LastCounter = counter
+	err := user.Update(app, `{totp: @totp}`, obj{"totp": totp})
+	return codes, err
+}
+
+// VerifySecondFactor check a TOTP or recovery code, recovery codes are single use
+func (user *User) VerifySecondFactor(app *App, code string) error {
+	if user.TOTP == nil || !user.TOTP.Enabled {
+		return ErrNoTOTP
+	}
+
+	attemptsKey := "mfa:" + user.Key
+	if !app.ratelimitEmail(attemptsKey, LoginCodeAttempts-1, LoginCodeLockout) {
+		return ErrMFALockout
+	}
+
+	code = strings.TrimSpace(code)
+	counter := checkTOTP(user.TOTP.Secret, code, time.Now())
+	if counter > user.TOTP.LastCounter {
+		err := user.Update(app, `{totp: MERGE(u.totp, {lastcounter: @counter})}`, obj{"counter": counter})
+		if err == nil {
+			app.resetMFAAttempts(attemptsKey)
+		}
+		return err
+	}
+
+	hashed := hashRecoveryCode(user.Key, code)
+	for _, recovery := range user.TOTP.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(hashed), []byte(recovery)) == 1 {
+			err := user.Update(app,
+				`{totp: MERGE(u.totp, {recoverycodes: REMOVE_VALUE(u.totp.recoverycodes, @code)})}`,
+				obj{"code": recovery},
+			)
+			if err == nil {
+				app.resetMFAAttempts(attemptsKey)
+			}
+			return err
+		}
+	}
+	return ErrBadTOTPCode
+}
+
+// secondFactorError send the right response for a failed second factor
+func secondFactorError(c ctx, err error) error {
+	switch err {
+	case ErrMFALockout:
+		return JSONErr(c, 429, err.Error())
+	case ErrNoTOTP, ErrBadTOTPCode:
+		return JSONErr(c, 401, err.Error())
+	}
+	return ServerDBError(c)
+}
+
+func initTOTP(app *App) {
+	// an email link is all it takes to get a session, so admins also need a session that
+	// passed a second factor or a bootstrap token minted with "user totp-bootstrap"
+	app.Server.POST("/me/totp/enroll", app.AuthHandle(func(c ctx, user *User) error {
+		if user.TOTP != nil && user.TOTP.Enabled {
+			return JSONErr(c, 409, ErrTOTPEnabled.Error())
+		}
+		bootstrap := ""
+		if user.isAdmin() && !user.MFA {
+			body, err := JSONbody(c)
+			if err == nil {
+				bootstrap = body.Get("bootstrap").String()
+			}
+			if len(bootstrap) == 0 {
+				return JSONErr(c, 403, "admins need a bootstrap token from the cli to set up a second factor")
+			}
+		}
+		err := user.EnrollTOTP(app, bootstrap)
+		if err == ErrBadTOTPBootstrap {
+			app.Audit(c, user, "user.totp.bootstrap.fail", "users/"+user.Key, nil, nil)
+			return JSONErr(c, 403, err.Error())
+		}
+		if err != nil {
+			return ServerDBError(c)
+		}
+		if len(bootstrap) != 0 {
+			app.Audit(c, user, "user.totp.bootstrap", "users/"+user.Key, nil, nil)
+		}
+		return c.JSON(200, obj{"ok": true, "secret": user.TOTP.Secret, "uri": user.TOTPURI(app)})
+	}))
+
+	app.Server.POST("/me/totp/confirm", app.AuthHandle(func(c ctx, user *User) error {
+		body, err := JSONbody(c)
+		if err != nil {
+			return BadRequestError(c)
+		}
+		codes, err := user.ConfirmTOTP(app, body.Get("code").String())
+		if err != nil {
+			return secondFactorError(c, err)
+		}
+		user.MFA = true
+		if err = app.issueAuthCookie(c, user); err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "user.totp.enable", "users/"+user.Key, nil, nil)
+		return c.JSON(200, obj{"ok": true, "recoverycodes": codes})
+	}))
+
+	app.Server.POST("/me/totp/disable", app.AuthHandle(func(c ctx, user *User) error {
+		body, err := JSONbody(c)
+		if err != nil {
+			return BadRequestError(c)
+		}
+		if err = user.VerifySecondFactor(app, body.Get("code").String()); err != nil {
+			return secondFactorError(c, err)
+		}
+		if err = user.Update(app, `{totp: null}`, obj{}); err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "user.totp.disable", "users/"+user.Key, nil, nil)
+		return c.JSON(200, obj{"ok": true})
+	}))
+
+	app.Server.POST("/auth/mfa", app.AuthHandle(func(c ctx, user *User) error {
+		body, err := JSONbody(c)
+		if err != nil {
+			return BadRequestError(c)
+		}
+		if err = user.VerifySecondFactor(app, body.Get("code").String()); err != nil {
+			app.Audit(c, user, "auth.mfa.fail", "users/"+user.Key, nil, nil)
+			return secondFactorError(c, err)
+		}
+		user.MFA = true
+		if err = app.issueAuthCookie(c, user); err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "auth.mfa", "users/"+user.Key, nil, nil)
+		return c.JSON(200, obj{"ok": true, "admin": user.isAdmin()})
+	}))
+}
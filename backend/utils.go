@@ -1,10 +1,10 @@
 package backend
 
 import (
-	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
-	"crypto/tls"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -13,9 +13,10 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
-	"text/template"
+	"sync"
 	"time"
 
+	"github.com/arangodb/go-driver"
 	"github.com/asaskevich/govalidator"
 	"github.com/labstack/echo"
 	"github.com/microcosm-cc/bluemonday"
@@ -28,6 +29,13 @@ var (
 	RandomDictionary = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 )
 
+// spentValues single-use values spent in memory, for when there's no db to record them in
+type spentValues struct {
+	sync.Mutex
+	m      map[string]time.Time
+	pruned time.Time
+}
+
 func validUsername(username string) bool {
 	return govalidator.Matches(username, `^[a-zA-Z0-9._-]{3,50}$`)
 }
@@ -83,17 +91,28 @@ func MD5Hash(data []byte) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-var (
-	bmPolicy = bluemonday.UGCPolicy()
-)
-
-func renderMarkdown(input []byte, sanitize bool) []byte {
-	if sanitize {
-		return bmPolicy.SanitizeBytes(blackfriday.Run(input))
+func renderMarkdown(input []byte, policy *bluemonday.Policy) []byte {
+	if policy != nil {
+		return policy.SanitizeBytes(blackfriday.Run(input))
 	}
 	return blackfriday.Run(input)
 }
 
+// deriveKey a 32 byte branca key for one purpose, made from a configured secret,
+// so tokens minted for one purpose can never pass for another's
+func deriveKey(purpose, secret string) string {
+	sum := sha256.Sum256([]byte(purpose + "|" + secret))
+	return string(sum[:])
+}
+
+// AppURL the full https url of a path on this app
+func (app *App) AppURL(path string) string {
+	if app.DevMode {
+		return "https://localhost:" + string(app.Conf.DevPort) + path
+	}
+	return "https://" + app.Conf.Domain + path
+}
+
 func sendError(errorStr string) func(c ctx) error {
 	return func(c ctx) error {
 		return JSONErr(c, 400, errorStr)
@@ -154,12 +173,6 @@ func Int64ToString(n int64) string {
 	return strconv.FormatInt(n, 10)
 }
 
-func execTemplate(temp *template.Template, vars interface{}) ([]byte, error) {
-	var buf bytes.Buffer
-	err := temp.Execute(&buf, vars)
-	return buf.Bytes(), err
-}
-
 func unix2time(unix string) (time.Time, error) {
 	var tm time.Time
 	i, err := strconv.ParseInt(unix, 10, 64)
@@ -169,25 +182,19 @@ func unix2time(unix string) (time.Time, error) {
 	return tm, err
 }
 
-var (
-	pingclient = &http.Client{Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}}
-)
-
-// Ping test any http endpoint
-func Ping(endpoint string) bool {
+// Ping test any http endpoint, with the db's tls config once setupDB has it
+func (app *App) Ping(endpoint string) bool {
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("had trouble making a new request for pinging ", endpoint, " : ", err)
 		}
 		return false
 	}
 	req.Close = true
-	res, err := pingclient.Do(req)
+	res, err := app.pingclient.Do(req)
 	if err != nil {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("had trouble sending a pinging request to ", endpoint, " : ", err)
 		}
 		return false
@@ -197,11 +204,76 @@ func Ping(endpoint string) bool {
 	return err == nil && http.StatusOK == res.StatusCode
 }
 
-func exeC(cmd string) error {
-	fmt.Println(AppName+" trying to run this command -> ", cmd)
+func (app *App) exeC(cmd string) error {
+	fmt.Println(app.Conf.AppName+" trying to run this command -> ", cmd)
 	err := exec.Command("/bin/bash", "-c", cmd).Start()
 	if err != nil {
 		fmt.Printf("command error: %s", err)
 	}
 	return err
 }
+
+// spendOnce mark a single-use value (challenge, code, ...) as used,
+// returns false if it was already used within ttl. With a db they're recorded there,
+// so a value spent on one instance is spent on all of them.
+func (app *App) spendOnce(id string, ttl time.Duration) bool {
+	if app.Spent != nil {
+		return app.spendOnceInDB(id, ttl)
+	}
+	app.spent.Lock()
+	defer app.spent.Unlock()
+	if app.spent.m == nil {
+		app.spent.m = map[string]time.Time{}
+	}
+	now := time.Now()
+	for k, expires := range app.spent.m {
+		if now.After(expires) {
+			delete(app.spent.m, k)
+		}
+	}
+	if _, used := app.spent.m[id]; used {
+		return false
+	}
+	app.spent.m[id] = now.Add(ttl)
+	return true
+}
+
+// spendOnceInDB the unique _key does the work, a second insert of the same value conflicts
+func (app *App) spendOnceInDB(id string, ttl time.Duration) bool {
+	now := time.Now()
+	app.spent.Lock()
+	prune := now.Sub(app.spent.pruned) > 10*time.Minute
+	if prune {
+		app.spent.pruned = now
+	}
+	app.spent.Unlock()
+	if prune {
+		_, err := app.DB.Query(context.Background(),
+			`FOR s IN spent FILTER s.expires < @now REMOVE s IN spent`,
+			obj{"now": now},
+		)
+		if err != nil && app.DevMode {
+			fmt.Println("spendOnce - couldn't prune spent values: ", err)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(id))
+	key := hex.EncodeToString(sum[:])
+	doc := obj{"_key": key, "expires": now.Add(ttl)}
+	_, err := app.Spent.CreateDocument(driver.WithWaitForSync(context.Background()), doc)
+	if driver.IsConflict(err) {
+		// an expired record that hasn't been pruned yet doesn't count
+		var existing struct {
+			Expires time.Time `json:"expires"`
+		}
+		if _, err := app.Spent.ReadDocument(context.Background(), key, &existing); err != nil || now.Before(existing.Expires) {
+			return false
+		}
+		_, err = app.Spent.ReplaceDocument(driver.WithWaitForSync(context.Background()), key, doc)
+		return err == nil
+	}
+	if err != nil && app.DevMode {
+		fmt.Println("spendOnce - couldn't record a spent value: ", err)
+	}
+	return err == nil
+}
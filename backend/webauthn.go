@@ -0,0 +1,450 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/arangodb/go-driver"
+)
+
+var (
+	// ErrBadWebAuthn the authenticator's response didn't check out
+	ErrBadWebAuthn = errors.New("invalid webauthn response")
+	// ErrUnknownCredential no such passkey is registered
+	ErrUnknownCredential = errors.New("unknown passkey")
+
+	b64url = base64.RawURLEncoding
+)
+
+const (
+	webauthnChallengeTTL = 5 * time.Minute
+	flagUserPresent      = 0x01
+	flagAttestedData     = 0x40
+	coseAlgES256         = -7
+)
+
+// Credential a passkey registered to a user
+type Credential struct {
+	Key       string    `json:"_key,omitempty"`
+	UserKey   string    `json:"userkey"`
+	ID        string    `json:"credid"`
+	PublicKey []byte    `json:"publickey"`
+	SignCount uint32    `json:"signcount"`
+	Name      string    `json:"name,omitempty"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastused,omitempty"`
+}
+
+// clientData the parts of a webauthn clientDataJSON that matter here
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData a parsed webauthn authenticator data blob
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    *ecdsa.PublicKey
+}
+
+// WebAuthnRPID the relying party id passkeys are bound to
+func (app *App) WebAuthnRPID() string {
+	if app.DevMode {
+		return "localhost"
+	}
+	return app.Conf.Domain
+}
+
+// WebAuthnOrigin the origin browsers will report in client data
+func (app *App) WebAuthnOrigin() string {
+	return app.AppURL("")
+}
+
+// newWebAuthnChallenge make a fresh challenge and a token binding it to a ceremony
+func (app *App) newWebAuthnChallenge(ceremony, userKey string) (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	challenge := b64url.EncodeToString(raw)
+	token, err := app.Passkeyinator.Encode(ceremony + "|" + userKey + "|" + challenge)
+	return challenge, token, err
+}
+
+// consumeWebAuthnChallenge check a challenge token and make sure it's only ever used once
+func (app *App) consumeWebAuthnChallenge(token, ceremony string) (string, string, error) {
+	tk, err := app.Passkeyinator.Decode(token)
+	if err != nil {
+		return "", "", ErrBadWebAuthn
+	}
+	parts := strings.SplitN(tk.Payload, "|", 3)
+	if len(parts) != 3 || parts[0] != ceremony {
+		return "", "", ErrBadWebAuthn
+	}
+	if !app.spendOnce("webauthn:"+parts[2], webauthnChallengeTTL) {
+		return "", "", ErrBadWebAuthn
+	}
+	return parts[1], parts[2], nil
+}
+
+// parseClientData check the client data is for the right ceremony, challenge and origin
+func parseClientData(raw []byte, ceremony, challenge, origin string) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return ErrBadWebAuthn
+	}
+	if cd.Type != ceremony || cd.Challenge != challenge || cd.Origin != origin {
+		return ErrBadWebAuthn
+	}
+	return nil
+}
+
+// parseAuthenticatorData pick apart authenticator data, including any attested credential
+func parseAuthenticatorData(raw []byte, rpID string) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, ErrBadWebAuthn
+	}
+	ad := &authenticatorData{
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) || ad.Flags&flagUserPresent == 0 {
+		return nil, ErrBadWebAuthn
+	}
+	if ad.Flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, ErrBadWebAuthn
+	}
+	idlen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idlen {
+		return nil, ErrBadWebAuthn
+	}
+	ad.CredentialID = rest[:idlen]
+
+	coseKey, _, err := decodeCBOR(rest[idlen:])
+	if err != nil {
+		return nil, ErrBadWebAuthn
+	}
+	ad.PublicKey, err = parseCOSEKey(coseKey)
+	return ad, err
+}
+
+// parseCOSEKey turn a COSE_Key into an ecdsa key, only ES256 on P-256 is supported
+func parseCOSEKey(raw interface{}) (*ecdsa.PublicKey, error) {
+	m, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrBadWebAuthn
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+	y, _ := m[int64(-3)].([]byte)
+	if kty != 2 || alg != coseAlgES256 || crv != 1 || len(x) != 32 || len(y) != 32 {
+		return nil, ErrBadWebAuthn
+	}
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, ErrBadWebAuthn
+	}
+	return key, nil
+}
+
+// VerifyRegistration check an authenticator's attestation response,
+// only "none" attestation is accepted since we don't care which make of authenticator it is
+func VerifyRegistration(rpID, origin, challenge string, clientDataJSON, attestationObject []byte) (*authenticatorData, error) {
+	if err := parseClientData(clientDataJSON, "webauthn.create", challenge, origin); err != nil {
+		return nil, err
+	}
+	raw, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, ErrBadWebAuthn
+	}
+	att, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrBadWebAuthn
+	}
+	format, _ := att["fmt"].(string)
+	authData, _ := att["authData"].([]byte)
+	if format != "none" || authData == nil {
+		return nil, ErrBadWebAuthn
+	}
+	ad, err := parseAuthenticatorData(authData, rpID)
+	if err != nil {
+		return nil, err
+	}
+	if ad.PublicKey == nil || len(ad.CredentialID) == 0 {
+		return nil, ErrBadWebAuthn
+	}
+	return ad, nil
+}
+
+// VerifyAssertion check an authenticator's signature over a login challenge,
+// returns the new signature counter
+func VerifyAssertion(rpID, origin, challenge string, cred *Credential, clientDataJSON, authData, signature []byte) (uint32, error) {
+	if err := parseClientData(clientDataJSON, "webauthn.get", challenge, origin); err != nil {
+		return 0, err
+	}
+	ad, err := parseAuthenticatorData(authData, rpID)
+	if err != nil {
+		return 0, err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, ErrBadWebAuthn
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return 0, ErrBadWebAuthn
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	if !ecdsa.VerifyASN1(key, digest[:], signature) {
+		return 0, ErrBadWebAuthn
+	}
+
+	// a counter that doesn't move forward hints at a cloned authenticator,
+	// authenticators that don't count at all always report zero
+	if (ad.SignCount != 0 || cred.SignCount != 0) && ad.SignCount <= cred.SignCount {
+		return 0, ErrBadWebAuthn
+	}
+	return ad.SignCount, nil
+}
+
+// CredentialByID find a registered passkey by its credential id
+func (app *App) CredentialByID(id string) (Credential, error) {
+	var cred Credential
+	err := app.QueryOne(`FOR c IN credentials FILTER c.credid == @id RETURN c`, obj{"id": id}, &cred)
+	return cred, err
+}
+
+// UserCredentials all the passkeys a user has registered
+func (app *App) UserCredentials(userKey string) ([]obj, error) {
+	return app.Query(
+		`FOR c IN credentials FILTER c.userkey == @key SORT c.created RETURN UNSET(c, "publickey")`,
+		obj{"key": userKey},
+	)
+}
+
+// RegisterCredential store a newly verified passkey for a user
+func (app *App) RegisterCredential(user *User, ad *authenticatorData, name string) (Credential, error) {
+	der, err := x509.MarshalPKIXPublicKey(ad.PublicKey)
+	if err != nil {
+		return Credential{}, err
+	}
+	cred := Credential{
+		UserKey:   user.Key,
+		ID:        b64url.EncodeToString(ad.CredentialID),
+		PublicKey: der,
+		SignCount: ad.SignCount,
+		Name:      name,
+		Created:   time.Now(),
+	}
+	meta, err := app.Credentials.CreateDocument(driver.WithWaitForSync(context.Background()), &cred)
+	cred.Key = meta.Key
+	return cred, err
+}
+
+type webauthnResponse struct {
+	Token             string `json:"token"`
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+}
+
+func initWebAuthn(app *App) {
+	var err error
+	app.Credentials, err = app.ensureCollection("credentials")
+	critCheck(err)
+	_, _, err = app.Credentials.EnsureHashIndex(nil, []string{"credid"}, &driver.EnsureHashIndexOptions{Unique: true})
+	critCheck(err)
+
+	app.Passkeyinator = NewBranca(deriveKey("passkey challenges", app.Conf.VerifierSecret))
+	app.Passkeyinator.SetTTL(uint32(webauthnChallengeTTL.Seconds()))
+
+	app.Server.POST("/me/passkeys/register/begin", app.AuthHandle(func(c ctx, user *User) error {
+		challenge, token, err := app.newWebAuthnChallenge("register", user.Key)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		existing, err := app.UserCredentials(user.Key)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		exclude := []obj{}
+		for _, cred := range existing {
+			exclude = append(exclude, obj{"type": "public-key", "id": cred["credid"]})
+		}
+		return c.JSON(200, obj{
+			"token": token,
+			"publicKey": obj{
+				"challenge": challenge,
+				"rp":        obj{"id": app.WebAuthnRPID(), "name": app.Conf.AppName},
+				"user": obj{
+					"id":          b64url.EncodeToString([]byte(user.Key)),
+					"name":        user.Username,
+					"displayName": user.Username,
+				},
+				"pubKeyCredParams":       []obj{{"type": "public-key", "alg": coseAlgES256}},
+				"timeout":                webauthnChallengeTTL / time.Millisecond,
+				"attestation":            "none",
+				"excludeCredentials":     exclude,
+				"authenticatorSelection": obj{"residentKey": "preferred", "userVerification": "preferred"},
+			},
+		})
+	}))
+
+	app.Server.POST("/me/passkeys/register/finish", app.AuthHandle(func(c ctx, user *User) error {
+		var res webauthnResponse
+		if err := UnmarshalJSONBody(c, &res); err != nil {
+			return BadRequestError(c)
+		}
+		userKey, challenge, err := app.consumeWebAuthnChallenge(res.Token, "register")
+		if err != nil || userKey != user.Key {
+			return UnauthorizedError(c)
+		}
+		clientDataJSON, err1 := b64url.DecodeString(res.ClientDataJSON)
+		attestation, err2 := b64url.DecodeString(res.AttestationObject)
+		if err1 != nil || err2 != nil {
+			return BadRequestError(c)
+		}
+
+		ad, err := VerifyRegistration(app.WebAuthnRPID(), app.WebAuthnOrigin(), challenge, clientDataJSON, attestation)
+		if err != nil {
+			if app.DevMode {
+				fmt.Println("passkey registration - error: ", err)
+			}
+			return UnauthorizedError(c)
+		}
+		cred, err := app.RegisterCredential(user, ad, res.Name)
+		if err != nil {
+			if driver.IsConflict(err) {
+				return JSONErr(c, 409, "that passkey is already registered")
+			}
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "user.passkey.add", "credentials/"+cred.Key, nil, obj{"name": cred.Name})
+		return c.JSON(200, obj{"ok": true, "id": cred.ID})
+	}))
+
+	app.Server.GET("/me/passkeys", app.AuthHandle(func(c ctx, user *User) error {
+		creds, err := app.UserCredentials(user.Key)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		return c.JSON(200, creds)
+	}))
+
+	app.Server.DELETE("/me/passkeys/:id", app.AuthHandle(func(c ctx, user *User) error {
+		cred, err := app.CredentialByID(c.Param("id"))
+		if err != nil || cred.UserKey != user.Key {
+			return JSONErr(c, 404, "no such passkey")
+		}
+		_, err = app.Credentials.RemoveDocument(driver.WithWaitForSync(context.Background()), cred.Key)
+		if err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, user, "user.passkey.remove", "credentials/"+cred.Key, obj{"name": cred.Name}, nil)
+		return c.JSON(200, obj{"ok": true})
+	}))
+
+	app.Server.POST("/auth/passkey/begin", func(c ctx) error {
+		challenge, token, err := app.newWebAuthnChallenge("login", "")
+		if err != nil {
+			return ServerDBError(c)
+		}
+		return c.JSON(200, obj{
+			"token": token,
+			"publicKey": obj{
+				"challenge":        challenge,
+				"rpId":             app.WebAuthnRPID(),
+				"timeout":          webauthnChallengeTTL / time.Millisecond,
+				"userVerification": "preferred",
+			},
+		})
+	})
+
+	app.Server.POST("/auth/passkey/finish", func(c ctx) error {
+		var res webauthnResponse
+		if err := UnmarshalJSONBody(c, &res); err != nil {
+			return BadRequestError(c)
+		}
+		_, challenge, err := app.consumeWebAuthnChallenge(res.Token, "login")
+		if err != nil {
+			return UnauthorizedError(c)
+		}
+		clientDataJSON, err1 := b64url.DecodeString(res.ClientDataJSON)
+		authData, err2 := b64url.DecodeString(res.AuthenticatorData)
+		signature, err3 := b64url.DecodeString(res.Signature)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return BadRequestError(c)
+		}
+
+		cred, err := app.CredentialByID(res.ID)
+		if err != nil {
+			return UnauthorizedError(c)
+		}
+		count, err := VerifyAssertion(app.WebAuthnRPID(), app.WebAuthnOrigin(), challenge, &cred, clientDataJSON, authData, signature)
+		if err != nil {
+			if app.DevMode {
+				fmt.Println("passkey login - error: ", err)
+			}
+			return UnauthorizedError(c)
+		}
+
+		user, err := app.UserByKey(cred.UserKey)
+		if err != nil {
+			return UnauthorizedError(c)
+		}
+		if err = user.Standing(time.Now()); err != nil {
+			return UnauthorizedError(c)
+		}
+
+		_, err = app.Credentials.UpdateDocument(context.Background(), cred.Key, obj{
+			"signcount": count,
+			"lastused":  time.Now(),
+		})
+		if err != nil {
+			return ServerDBError(c)
+		}
+
+		if err = app.issueAuthCookie(c, &user); err != nil {
+			return ServerDBError(c)
+		}
+		app.Audit(c, &user, "auth.login.passkey", "users/"+user.Key, nil, nil)
+		return c.JSON(200, obj{"ok": true, "admin": user.isAdmin()})
+	})
+}
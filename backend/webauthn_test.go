@@ -0,0 +1,331 @@
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+// softAuthenticator a software ES256 passkey, standing in for a browser and its authenticator
+type softAuthenticator struct {
+	t     *testing.T
+	key   *ecdsa.PrivateKey
+	id    []byte
+	count uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{t: t, key: key, id: id}
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge, origin string) []byte {
+	raw, err := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return raw
+}
+
+// authData the authenticator data header, with the attested credential when there's one
+func (a *softAuthenticator) authData(rpID string, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	out := append([]byte{}, rpIDHash[:]...)
+	out = append(out, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(out[33:37], a.count)
+	return append(out, attested...)
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return encodeCBOR([]cborPair{
+		{int64(1), int64(2)},
+		{int64(3), int64(coseAlgES256)},
+		{int64(-1), int64(1)},
+		{int64(-2), x},
+		{int64(-3), y},
+	})
+}
+
+func (a *softAuthenticator) attestedCredential() []byte {
+	out := make([]byte, 18) // a zeroed aaguid, then the credential id length
+	binary.BigEndian.PutUint16(out[16:], uint16(len(a.id)))
+	out = append(out, a.id...)
+	return append(out, a.coseKey()...)
+}
+
+// create answer a navigator.credentials.create call with "none" attestation
+func (a *softAuthenticator) create(rpID, origin, challenge string) ([]byte, []byte) {
+	authData := a.authData(rpID, flagUserPresent|flagAttestedData, a.attestedCredential())
+	attestation := encodeCBOR([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", authData},
+	})
+	return a.clientData("webauthn.create", challenge, origin), attestation
+}
+
+// get answer a navigator.credentials.get call, signing over the authenticator data and client data hash
+func (a *softAuthenticator) get(rpID, origin, challenge string) ([]byte, []byte, []byte) {
+	clientDataJSON := a.clientData("webauthn.get", challenge, origin)
+	authData := a.authData(rpID, flagUserPresent, nil)
+	return clientDataJSON, authData, a.sign(authData, clientDataJSON)
+}
+
+func (a *softAuthenticator) sign(authData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return sig
+}
+
+func (a *softAuthenticator) credential() *Credential {
+	der, err := x509.MarshalPKIXPublicKey(&a.key.PublicKey)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return &Credential{ID: b64url.EncodeToString(a.id), PublicKey: der}
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	a.count = 3
+	clientDataJSON, attestation := a.create(testRPID, testOrigin, "challenge")
+
+	ad, err := VerifyRegistration(testRPID, testOrigin, "challenge", clientDataJSON, attestation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ad.CredentialID) != string(a.id) {
+		t.Errorf("credential id %x, want %x", ad.CredentialID, a.id)
+	}
+	if ad.PublicKey.X.Cmp(a.key.X) != 0 || ad.PublicKey.Y.Cmp(a.key.Y) != 0 {
+		t.Error("public key doesn't match the authenticator's")
+	}
+	if ad.SignCount != 3 {
+		t.Errorf("sign count %d, want 3", ad.SignCount)
+	}
+}
+
+func TestVerifyRegistrationMismatches(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	clientDataJSON, attestation := a.create(testRPID, testOrigin, "challenge")
+
+	cases := []struct {
+		name                        string
+		rpID, origin, challenge     string
+		clientDataJSON, attestation []byte
+	}{
+		{"wrong challenge", testRPID, testOrigin, "other", clientDataJSON, attestation},
+		{"wrong origin", testRPID, "https://evil.example", "challenge", clientDataJSON, attestation},
+		{"wrong rp id hash", "evil.example", testOrigin, "challenge", clientDataJSON, attestation},
+		{"login client data", testRPID, testOrigin, "challenge",
+			a.clientData("webauthn.get", "challenge", testOrigin), attestation},
+		{"client data isn't json", testRPID, testOrigin, "challenge", []byte("{"), attestation},
+		{"attestation isn't cbor", testRPID, testOrigin, "challenge", clientDataJSON, []byte{0xff}},
+		{"attestation isn't a map", testRPID, testOrigin, "challenge", clientDataJSON, encodeCBOR("none")},
+		{"packed attestation", testRPID, testOrigin, "challenge", clientDataJSON, encodeCBOR([]cborPair{
+			{"fmt", "packed"},
+			{"attStmt", []cborPair{}},
+			{"authData", a.authData(testRPID, flagUserPresent|flagAttestedData, a.attestedCredential())},
+		})},
+		{"no attested credential", testRPID, testOrigin, "challenge", clientDataJSON, encodeCBOR([]cborPair{
+			{"fmt", "none"},
+			{"authData", a.authData(testRPID, flagUserPresent, nil)},
+		})},
+		{"user not present", testRPID, testOrigin, "challenge", clientDataJSON, encodeCBOR([]cborPair{
+			{"fmt", "none"},
+			{"authData", a.authData(testRPID, flagAttestedData, a.attestedCredential())},
+		})},
+	}
+	for _, tc := range cases {
+		if _, err := VerifyRegistration(tc.rpID, tc.origin, tc.challenge, tc.clientDataJSON, tc.attestation); err != ErrBadWebAuthn {
+			t.Errorf("%s: got %v, want ErrBadWebAuthn", tc.name, err)
+		}
+	}
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	full := a.authData(testRPID, flagUserPresent|flagAttestedData, a.attestedCredential())
+
+	if _, err := parseAuthenticatorData(full, testRPID); err != nil {
+		t.Fatal(err)
+	}
+	for _, cut := range []int{0, 36, 37, 54, 55 + len(a.id) - 1, len(full) - 1} {
+		if _, err := parseAuthenticatorData(full[:cut], testRPID); err != ErrBadWebAuthn {
+			t.Errorf("cut at %d: got %v, want ErrBadWebAuthn", cut, err)
+		}
+	}
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	x := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	y := make([]byte, 32)
+	a.key.Y.FillBytes(y)
+	offCurve := append([]byte{}, y...)
+	offCurve[31] ^= 1
+
+	cases := []struct {
+		name string
+		key  []cborPair
+	}{
+		{"rsa key type", []cborPair{{int64(1), int64(3)}, {int64(3), int64(coseAlgES256)}, {int64(-1), int64(1)}, {int64(-2), x}, {int64(-3), y}}},
+		{"rs256", []cborPair{{int64(1), int64(2)}, {int64(3), int64(-257)}, {int64(-1), int64(1)}, {int64(-2), x}, {int64(-3), y}}},
+		{"p-384", []cborPair{{int64(1), int64(2)}, {int64(3), int64(coseAlgES256)}, {int64(-1), int64(2)}, {int64(-2), x}, {int64(-3), y}}},
+		{"short x", []cborPair{{int64(1), int64(2)}, {int64(3), int64(coseAlgES256)}, {int64(-1), int64(1)}, {int64(-2), x[1:]}, {int64(-3), y}}},
+		{"off the curve", []cborPair{{int64(1), int64(2)}, {int64(3), int64(coseAlgES256)}, {int64(-1), int64(1)}, {int64(-2), x}, {int64(-3), offCurve}}},
+	}
+	for _, tc := range cases {
+		raw, _, err := decodeCBOR(encodeCBOR(tc.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseCOSEKey(raw); err != ErrBadWebAuthn {
+			t.Errorf("%s: got %v, want ErrBadWebAuthn", tc.name, err)
+		}
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	cred := a.credential()
+
+	a.count = 5
+	clientDataJSON, authData, sig := a.get(testRPID, testOrigin, "challenge")
+	count, err := VerifyAssertion(testRPID, testOrigin, "challenge", cred, clientDataJSON, authData, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatalf("sign count %d, want 5", count)
+	}
+	cred.SignCount = count
+
+	a.count = 6
+	clientDataJSON, authData, sig = a.get(testRPID, testOrigin, "again")
+	if count, err = VerifyAssertion(testRPID, testOrigin, "again", cred, clientDataJSON, authData, sig); err != nil || count != 6 {
+		t.Fatalf("second login: count %d, err %v", count, err)
+	}
+}
+
+func TestVerifyAssertionCounterless(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	cred := a.credential()
+	for i := 0; i < 2; i++ {
+		clientDataJSON, authData, sig := a.get(testRPID, testOrigin, "challenge")
+		if count, err := VerifyAssertion(testRPID, testOrigin, "challenge", cred, clientDataJSON, authData, sig); err != nil || count != 0 {
+			t.Fatalf("login %d: count %d, err %v", i, count, err)
+		}
+	}
+}
+
+func TestVerifyAssertionSignCountRegression(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	cred := a.credential()
+	cred.SignCount = 10
+
+	for _, count := range []uint32{0, 9, 10} {
+		a.count = count
+		clientDataJSON, authData, sig := a.get(testRPID, testOrigin, "challenge")
+		if _, err := VerifyAssertion(testRPID, testOrigin, "challenge", cred, clientDataJSON, authData, sig); err != ErrBadWebAuthn {
+			t.Errorf("count %d after 10: got %v, want ErrBadWebAuthn", count, err)
+		}
+	}
+}
+
+func TestVerifyAssertionMismatches(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	cred := a.credential()
+	clientDataJSON, authData, sig := a.get(testRPID, testOrigin, "challenge")
+
+	other := newSoftAuthenticator(t)
+	otherSig := other.sign(authData, clientDataJSON)
+	tampered := append([]byte{}, authData...)
+	tampered[36]++
+
+	cases := []struct {
+		name                    string
+		rpID, origin, challenge string
+		clientDataJSON          []byte
+		authData, sig           []byte
+		cred                    *Credential
+	}{
+		{"wrong challenge", testRPID, testOrigin, "other", clientDataJSON, authData, sig, cred},
+		{"wrong origin", testRPID, "https://evil.example", "challenge", clientDataJSON, authData, sig, cred},
+		{"wrong rp id hash", "evil.example", testOrigin, "challenge", clientDataJSON, authData, sig, cred},
+		{"registration client data", testRPID, testOrigin, "challenge",
+			a.clientData("webauthn.create", "challenge", testOrigin), authData, sig, cred},
+		{"another authenticator's signature", testRPID, testOrigin, "challenge", clientDataJSON, authData, otherSig, cred},
+		{"another authenticator's credential", testRPID, testOrigin, "challenge", clientDataJSON, authData, sig, other.credential()},
+		{"tampered authenticator data", testRPID, testOrigin, "challenge", clientDataJSON, tampered, sig, cred},
+		{"garbage signature", testRPID, testOrigin, "challenge", clientDataJSON, authData, []byte{0x30, 0x00}, cred},
+		{"garbage public key", testRPID, testOrigin, "challenge", clientDataJSON, authData, sig, &Credential{PublicKey: []byte{1, 2, 3}}},
+		{"user not present", testRPID, testOrigin, "challenge", clientDataJSON, a.authData(testRPID, 0, nil), sig, cred},
+	}
+	for _, tc := range cases {
+		if _, err := VerifyAssertion(tc.rpID, tc.origin, tc.challenge, tc.cred, tc.clientDataJSON, tc.authData, tc.sig); err != ErrBadWebAuthn {
+			t.Errorf("%s: got %v, want ErrBadWebAuthn", tc.name, err)
+		}
+	}
+}
+
+func TestWebAuthnChallenge(t *testing.T) {
+	app := &App{Passkeyinator: NewBranca("a passkey challenge key of 32 by")}
+	other := &App{Passkeyinator: NewBranca("another one, for the other app!!")}
+
+	challenge, token, err := app.newWebAuthnChallenge("register", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := app.consumeWebAuthnChallenge(token, "login"); err != ErrBadWebAuthn {
+		t.Fatalf("register challenge used to log in: got %v", err)
+	}
+	if _, _, err := other.consumeWebAuthnChallenge(token, "register"); err != ErrBadWebAuthn {
+		t.Fatalf("challenge used on another app: got %v", err)
+	}
+	userKey, got, err := app.consumeWebAuthnChallenge(token, "register")
+	if err != nil || userKey != "1234" || got != challenge {
+		t.Fatalf("got %q %q %v", userKey, got, err)
+	}
+	if _, _, err := app.consumeWebAuthnChallenge(token, "register"); err != ErrBadWebAuthn {
+		t.Fatalf("challenge used twice: got %v", err)
+	}
+	if _, _, err := app.consumeWebAuthnChallenge("garbage", "register"); err != ErrBadWebAuthn {
+		t.Fatalf("garbage token: got %v", err)
+	}
+}
+
+func TestSpendOncePerApp(t *testing.T) {
+	a, b := &App{}, &App{}
+	if !a.spendOnce("value", time.Minute) || a.spendOnce("value", time.Minute) {
+		t.Fatal("a value should only be spendable once")
+	}
+	if !b.spendOnce("value", time.Minute) {
+		t.Fatal("spending a value on one app used it up on another")
+	}
+}
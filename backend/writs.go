@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html/template"
+	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/Machiel/slugify"
 	"github.com/arangodb/go-driver"
+	"github.com/microcosm-cc/bluemonday"
 )
 
 var (
@@ -74,17 +77,21 @@ type writQuery struct {
 	Limit              []int64   `json:"limit,omitempty"`
 	Tags               []string  `json:"tags,omitempty"`
 	Omissions          []string  `json:"omissions,omitempty"`
+	Cursor             string    `json:"cursor,omitempty"`
+	PageSize           int64     `json:"pagesize,omitempty"`
+	CountTotal         bool      `json:"counttotal,omitempty"`
+
+	// keyset sort on (created, _key), position says where from, both set by ExecPage
+	keyset   bool
+	position *writCursor
 }
 
-// Exec execute a writQuery to retrieve some/certain writs
-func (q *writQuery) Exec() ([]Writ, error) {
-	writs := []Writ{}
+// filter the FILTER statement for everything but paging, its vars go in q.Vars
+func (q *writQuery) filter() string {
 	if q.Vars == nil {
 		q.Vars = obj{}
 	}
 
-	query := "FOR writ IN writs "
-
 	filter := ""
 	firstfilter := true
 
@@ -126,14 +133,14 @@ func (q *writQuery) Exec() ([]Writ, error) {
 		}
 		firstfilter = false
 		if !startzero && !endzero {
-			q.Vars["@betweenStart"] = q.Between.Start
-			q.Vars["@betweenEnd"] = q.Between.End
-			filter += "writ.created > @betweenStart && writ.created < @betweenEnd "
+			q.Vars["betweenStart"] = q.Between.Start
+			q.Vars["betweenEnd"] = q.Between.End
+			filter += "writ.created >= @betweenStart && writ.created < @betweenEnd "
 		} else if !startzero {
-			q.Vars["@betweenStart"] = q.Between.Start
-			filter += "writ.created > @betweenStart "
+			q.Vars["betweenStart"] = q.Between.Start
+			filter += "writ.created >= @betweenStart "
 		} else if !endzero {
-			q.Vars["@betweenEnd"] = q.Between.Start
+			q.Vars["betweenEnd"] = q.Between.End
 			filter += "writ.created < @betweenEnd "
 		}
 	}
@@ -183,11 +190,34 @@ func (q *writQuery) Exec() ([]Writ, error) {
 		filter += `@tags ALL IN writ.tags `
 	}
 
-	if !firstfilter {
-		query += "FILTER " + filter
+	if firstfilter {
+		return ""
+	}
+	return "FILTER " + filter
+}
+
+// Exec execute a writQuery to retrieve some/certain writs
+func (q *writQuery) Exec(app *App) ([]Writ, error) {
+	writs := []Writ{}
+	query := "FOR writ IN writs " + q.filter()
+
+	if q.position != nil {
+		q.Vars["cursorCreated"] = q.position.Created
+		q.Vars["cursorKey"] = q.position.Key
+		if q.position.Before {
+			query += "FILTER writ.created > @cursorCreated || (writ.created == @cursorCreated && writ._key > @cursorKey) "
+		} else {
+			query += "FILTER writ.created < @cursorCreated || (writ.created == @cursorCreated && writ._key < @cursorKey) "
+		}
 	}
 
-	if !q.DontSort {
+	if q.keyset {
+		if q.position != nil && q.position.Before {
+			query += "SORT writ.created ASC, writ._key ASC "
+		} else {
+			query += "SORT writ.created DESC, writ._key DESC "
+		}
+	} else if !q.DontSort {
 		query += "SORT writ.created DESC "
 	}
 
@@ -205,7 +235,11 @@ func (q *writQuery) Exec() ([]Writ, error) {
 	final := "MERGE(writ, {likes: writ.likes + LENGTH(writ.likedby), views: writ.views + LENGTH(writ.viewedby)})"
 
 	if !q.EditorMode {
-		q.Omissions = append(q.Omissions, "_key", "markdown", "edits", "public", "roles")
+		// keyset paging needs every writ's key for its cursors, ExecPage drops them after
+		if !q.keyset {
+			q.Omissions = append(q.Omissions, "_key")
+		}
+		q.Omissions = append(q.Omissions, "markdown", "edits", "public", "roles")
 	}
 
 	if !q.Extensive {
@@ -219,12 +253,12 @@ func (q *writQuery) Exec() ([]Writ, error) {
 
 	query += final
 
-	if DevMode {
+	if app.DevMode {
 		fmt.Println("\n You're trying this query now: \n", query, "\n\t")
 	}
 
 	ctx := driver.WithQueryCount(context.Background())
-	cursor, err := DB.Query(ctx, query, q.Vars)
+	cursor, err := app.DB.Query(ctx, query, q.Vars)
 	if err == nil {
 		defer cursor.Close()
 		for {
@@ -233,7 +267,7 @@ func (q *writQuery) Exec() ([]Writ, error) {
 			if driver.IsNoMoreDocuments(err) {
 				break
 			} else if err != nil {
-				if DevMode {
+				if app.DevMode {
 					fmt.Println("DB Multiple Query - something strange happened: ", err)
 				}
 				panic(err)
@@ -242,14 +276,14 @@ func (q *writQuery) Exec() ([]Writ, error) {
 		}
 	} else if driver.IsNoMoreDocuments(err) {
 		fmt.Println(`No more docs? Awww :( - `, err)
-	} else if DevMode {
+	} else if app.DevMode {
 		fmt.Println("\n... And, it would seem that it has failed: \n", err, "\n\t")
 	}
 	return writs, err
 }
 
 // ExecOne execute a writQuery to retrieve a single writ
-func (q *writQuery) ExecOne() (Writ, error) {
+func (q *writQuery) ExecOne(app *App) (Writ, error) {
 	var writ Writ
 
 	if q.Vars == nil {
@@ -380,13 +414,13 @@ func (q *writQuery) ExecOne() (Writ, error) {
 
 	query += final
 
-	if DevMode {
+	if app.DevMode {
 		fmt.Println("\n You're trying this query now: \n", query, "\n\t")
 	}
 
-	err := QueryOne(query, q.Vars, &writ)
+	err := app.QueryOne(query, q.Vars, &writ)
 
-	if DevMode && err != nil {
+	if app.DevMode && err != nil {
 		fmt.Println("\n... And, it would seem that it has failed: \n", err, "\n\t")
 	}
 
@@ -398,9 +432,9 @@ func (writ *Writ) Slugify() {
 	writ.Slug = slugify.Slugify(writ.Title)
 }
 
-// RenderContent from .Markdown generate html and set .Content
-func (writ *Writ) RenderContent() {
-	writ.Content = string(renderMarkdown([]byte(writ.Markdown), false)[:])
+// RenderContent from .Markdown generate html sanitized with a policy (see App.PolicyFor) and set .Content
+func (writ *Writ) RenderContent(policy *bluemonday.Policy) {
+	writ.Content = string(renderMarkdown([]byte(writ.Markdown), policy)[:])
 }
 
 // ToObj convert writ into map[string]interface{}
@@ -478,82 +512,127 @@ func (writ *Writ) ToObj(omissions ...string) obj {
 }
 
 // Update update a writ's details using a map[string]interface{}
-func (writ *Writ) Update(query string, vars obj) error {
+func (writ *Writ) Update(app *App, query string, vars obj) error {
 	if len(writ.Key) < 0 {
 		return ErrIncompleteWrit
 	}
 	vars["key"] = writ.Key
 	query = "FOR u in writs FILTER u._key == @key UPDATE u WITH " + query + " IN writs OPTIONS {keepNull: false, waitForSync: true} RETURN NEW"
 	ctx := driver.WithQueryCount(context.Background())
-	cursor, err := DB.Query(ctx, query, vars)
-	defer cursor.Close()
-	if err == nil {
-		_, err = cursor.ReadDocument(ctx, writ)
+	cursor, err := app.DB.Query(ctx, query, vars)
+	if err != nil {
+		return err
 	}
+	defer cursor.Close()
+	previous := writ.Slug
+	_, err = cursor.ReadDocument(ctx, writ)
+	app.invalidateWrits(previous, writ.Slug)
 	return err
 }
 
+// updateWrits run a query that updates writs and returns the slug of each one it touched,
+// so their cached pages can be dropped
+func (app *App) updateWrits(query string, vars obj) error {
+	ctx := driver.WithWaitForSync(context.Background())
+	cursor, err := app.DB.Query(ctx, query, vars)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	slugs := []string{}
+	for {
+		var slug string
+		_, err = cursor.ReadDocument(ctx, &slug)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+		slugs = append(slugs, slug)
+	}
+	app.invalidateWrits(slugs...)
+	return nil
+}
+
 // WritByKey retrieve user using their db document key
-func WritByKey(key string) (Writ, error) {
+func (app *App) WritByKey(key string) (Writ, error) {
 	var writ Writ
-	_, err := Writs.ReadDocument(context.Background(), key, &writ)
+	_, err := app.Writs.ReadDocument(context.Background(), key, &writ)
 	return writ, err
 }
 
 // InitWrit initialize a new writ
-func InitWrit(w *Writ) error {
+func (app *App) InitWrit(w *Writ) error {
+	return app.InitWritBy(nil, nil, w)
+}
+
+// InitWritBy initialize a new writ or update an existing one,
+// recording who did it, and from where when c is a request, in the audit log
+func (app *App) InitWritBy(c ctx, actor *User, w *Writ) error {
 	if len(w.Tags) < 1 {
 		return ErrMissingTags
 	}
 
+	// injections are trusted raw html, so only admins (or the app itself) may set them
+	if len(w.Injection) != 0 && actor != nil && !actor.isAdmin() {
+		return ErrUntrustedInjection
+	}
+
 	ctx := driver.WithWaitForSync(context.Background(), true)
 
 	exists := true
 	var err error
 	var currentWrit Writ
 	if len(w.Key) == 0 {
-		if DevMode {
+		if app.DevMode {
 			fmt.Println("Searching For: ", w.Title)
 		}
 		currentWrit, err = (&writQuery{
 			EditorMode: true,
 			Title:      w.Title,
-		}).ExecOne()
+		}).ExecOne(app)
 		exists = err == nil
 		err = nil
+	} else {
+		currentWrit, err = app.WritByKey(w.Key)
+		if err != nil {
+			return err
+		}
 	}
 
 	if !exists {
 		w.Created = time.Now()
 		if len(w.Markdown) < 1 || len(w.Title) < 1 || len(w.Author) < 1 {
-			if DevMode {
+			if app.DevMode {
 				fmt.Println("InitWrit - it's horribly incomplete, fix it, add in author, title, and markdown")
 			}
 			return ErrIncompleteWrit
 		}
 
-		user, err := UserByUsername(w.Author)
+		user, err := app.UserByUsername(w.Author)
 		if err != nil {
-			if DevMode {
+			if app.DevMode {
 				fmt.Println("InitWrit - author ("+w.Author+") is invalid or MIA: ", err)
 			}
 			return ErrAuthorIsNoUser
 		}
 		w.AuthorKey = user.Key
 
-		w.RenderContent()
+		w.RenderContent(app.PolicyFor(user.Roles))
 		if len(w.Slug) < 1 {
 			w.Slugify()
 		}
 
-		meta, err := Writs.CreateDocument(ctx, w)
+		meta, err := app.Writs.CreateDocument(ctx, w)
 		if err != nil {
-			if DevMode {
+			if app.DevMode {
 				fmt.Println(`InitWrit - creating a writ in the db: `, err)
 			}
 			return err
 		}
 		w.Key = meta.Key
+		app.Audit(c, actor, "writ.create", "writs/"+w.Key, nil, writAuditSummary(w))
+		app.invalidateWrits(w.Slug)
 	} else {
 		if len(w.Key) == 0 {
 			w.Key = currentWrit.Key
@@ -568,27 +647,47 @@ func InitWrit(w *Writ) error {
 			w.Content = ""
 			w.Markdown = ""
 		} else {
-			w.RenderContent()
+			w.RenderContent(app.PolicyFor(app.authorRoles(currentWrit.AuthorKey, actor)))
 		}
 		w.Edits = append(w.Edits, time.Now())
 		ctx = driver.WithMergeObjects(ctx, true)
-		_, err := Writs.UpdateDocument(ctx, w.Key, w.ToObj("_key"))
+		_, err := app.Writs.UpdateDocument(ctx, w.Key, w.ToObj("_key"))
 		if err != nil {
-			if DevMode {
+			if app.DevMode {
 				fmt.Println(`InitWrit - error updating a writ in the db: `, err)
 			}
 			return err
 		}
+		after := writAuditSummary(&currentWrit)
+		if len(w.Title) != 0 {
+			after["title"] = w.Title
+			after["slug"] = w.Slug
+		}
+		if len(w.Tags) != 0 {
+			after["tags"] = w.Tags
+		}
+		after["public"] = w.Public
+		after["membersonly"] = w.MembersOnly
+		action := "writ.update"
+		if !currentWrit.Public && w.Public {
+			action = "writ.publish"
+		}
+		app.Audit(c, actor, action, "writs/"+w.Key, writAuditSummary(&currentWrit), after)
+		app.invalidateWrits(currentWrit.Slug, w.Slug)
 		if !currentWrit.Public && w.Public {
-			go notifySubscribers(w.Key)
+			app.Notifying.Add(1)
+			go func(key string) {
+				defer app.Notifying.Done()
+				app.notifySubscribers(key)
+			}(w.Key)
 		}
 	}
 
 	return nil
 }
 
-func notifySubscribers(writKey string) {
-	writ, err := WritByKey(writKey)
+func (app *App) notifySubscribers(writKey string) {
+	writ, err := app.WritByKey(writKey)
 	if err != nil {
 		return
 	}
@@ -596,7 +695,7 @@ func notifySubscribers(writKey string) {
 	query := `FOR u IN users FILTER u.subscriber == true RETURN u`
 	ctx := driver.WithQueryCount(context.Background())
 	var users []User
-	cursor, err := DB.Query(ctx, query, obj{})
+	cursor, err := app.DB.Query(ctx, query, obj{})
 	if err != nil {
 		return
 	}
@@ -613,25 +712,57 @@ func notifySubscribers(writKey string) {
 		users = append(users, doc)
 	}
 
-	mail := MakeEmail()
+	mail := app.Emailer.Make()
 	mail.Subject("Subscriber Update: Newly Published Writ")
-	domain := AppDomain
-	if DevMode {
+	domain := app.Conf.Domain
+	if app.DevMode {
 		domain = "localhost:2443"
 	}
 	mail.HTML().Set(`
 		<h4>There's a new writ: ` + writ.Title + `</h4>
 		<p><a href="https://` + domain + "/writ/" + writ.Slug + `">check it out</a></p>
-		<sub><a href="https://` + domain + `/subscribe-toggle">unsubcribe</a></sub>
+		<sub><a href="https://` + domain + `/unsubscribe">unsubscribe</a></sub>
 	`)
 	for _, user := range users {
 		mail.Bcc(user.Email)
 	}
-	go SendEmail(mail)
+	go app.Emailer.Send(mail)
+}
+
+// pageData the variables the post template renders a writ's page with,
+// root is what links to assets are relative to, "" on the live site
+func (writ *Writ) pageData(app *App, nonce, root string) obj {
+	writdata := writ.ToObj()
+	// content was sanitized when it was rendered, injections are admin-only and trusted
+	writdata["content"] = template.HTML(writ.Content)
+	writdata["injection"] = trustedInjection(writ.Injection, nonce)
+
+	writdata["Created"] = writ.Created.Format("1 Jan 2006")
+	writdata["CreateDate"] = writ.Created
+
+	editslen := len(writ.Edits)
+	if editslen != 0 {
+		writdata["ModifiedDate"] = writ.Edits[editslen-1]
+	}
+
+	writdata["URL"] = "https://" + app.Conf.Domain + "/writ/" + writ.Slug
+	writdata["Nonce"] = nonce
+	writdata["Root"] = root
+	return writdata
+}
+
+// writCacheGroup cached writ pages are invalidated by slug
+func writCacheGroup(c ctx) string {
+	return "writ:" + c.Param("slug")
+}
+
+// listingCacheGroup anything listing more than one writ goes whenever any writ changes
+func listingCacheGroup(c ctx) string {
+	return "listing"
 }
 
-func initWrits() {
-	Server.GET("/writ/:slug", func(c ctx) error {
+func initWrits(app *App) {
+	app.Server.GET("/writ/:slug", func(c ctx) error {
 		slug := c.Param("slug")
 
 		wq := writQuery{
@@ -639,16 +770,13 @@ func initWrits() {
 			Slug:        slug,
 		}
 
-		user, err := CredentialCheck(c)
-		isuser := true
-		if err == nil {
+		user := app.Viewer(c)
+		isuser := user != nil
+		if isuser {
 			wq.Viewer = user.Key
-		} else {
-			isuser = false
-			err = nil
 		}
 
-		writ, err := wq.ExecOne()
+		writ, err := wq.ExecOne(app)
 
 		if driver.IsNotFound(err) {
 			return JSONErr(c, 404, "couldn't find a writ like that")
@@ -658,80 +786,106 @@ func initWrits() {
 			return UnauthorizedError(c)
 		}
 
-		writdata := writ.ToObj()
-
-		writdata["Created"] = writ.Created.Format("1 Jan 2006")
-		writdata["CreateDate"] = writ.Created
-
-		editslen := len(writ.Edits)
-		if editslen != 0 {
-			writdata["ModifiedDate"] = writ.Edits[editslen-1]
-		}
-
-		writdata["URL"] = "https://" + AppDomain + "/writ/" + writ.Slug
+		writdata := writ.pageData(app, CSPNonce(c), "")
 
-		c.Response().Header().Set("Content-Type", "text/html")
-		err = PostTemplate.Execute(c.Response(), &writdata)
-		if err != nil {
-			if DevMode {
-				fmt.Println("GET /writ/:slug - error executing the post template: ", err)
-			}
-		}
-		return err
-	})
+		return app.Templates.Page(c, 200, "post.html", writdata)
+	}, app.Responses.Middleware(writCacheGroup))
 
-	Server.GET("/writs/:page/:count", func(c ctx) error {
+	// deprecated, offsets made deep pages slow and shift when new writs come out,
+	// the first page moves to /writs and the pages after it have to be reached by cursor
+	app.Server.GET("/writs/:page/:count", func(c ctx) error {
 		page, err := strconv.ParseInt(c.Param("page"), 10, 64)
-		if err != nil {
+		if err != nil || page < 0 {
 			return BadRequestError(c)
 		}
 		count, err := strconv.ParseInt(c.Param("count"), 10, 64)
-		if err != nil {
+		if err != nil || count < 1 {
 			return BadRequestError(c)
 		}
+		if page != 0 {
+			return JSONErr(c, 410, "offset pages are gone, follow the next links from /writs instead")
+		}
+		return c.Redirect(301, "/writs?count="+strconv.FormatInt(count, 10))
+	})
 
-		q := &writQuery{
-			Limit: []int64{page, count},
+	// keyset paginated, follow the next and prev links instead of counting pages,
+	// ?total=true counts every writ there is as well
+	app.Server.GET("/writs", func(c ctx) error {
+		q := &writQuery{Cursor: c.QueryParam("cursor"), PageSize: WritPageSize}
+		var err error
+		if raw := c.QueryParam("count"); len(raw) != 0 {
+			q.PageSize, err = strconv.ParseInt(raw, 10, 64)
+			if err != nil || q.PageSize < 1 {
+				return BadRequestError(c)
+			}
+		}
+		if raw := c.QueryParam("total"); len(raw) != 0 {
+			q.CountTotal, err = strconv.ParseBool(raw)
+			if err != nil {
+				return BadRequestError(c)
+			}
 		}
 
-		user, err := CredentialCheck(c)
-		if err == nil && user != nil {
-			if count > 200 {
+		if app.Viewer(c) != nil {
+			if q.PageSize > 200 {
 				return JSONErr(c, 403, "requesting too many items at once, members >= 200")
 			}
 			q.IncludeMembersOnly = true
-		} else if count > 100 {
+		} else if q.PageSize > 100 {
 			return JSONErr(c, 403, "requesting too many items at once, non-members >= 100")
 		}
 
-		writs, err := q.Exec()
-		if err != nil {
+		page, err := q.ExecPage(app)
+		if err == ErrBadCursor {
+			return JSONErr(c, 400, err.Error())
+		} else if err != nil {
 			return ServerDBError(c)
 		}
 
-		return c.JSON(200, writs)
-	})
+		link := func(cursor string) string {
+			params := url.Values{"cursor": {cursor}, "count": {strconv.FormatInt(q.PageSize, 10)}}
+			if q.CountTotal {
+				params.Set("total", "true")
+			}
+			return "/writs?" + params.Encode()
+		}
+		output := obj{"writs": page.Writs}
+		if len(page.Next) != 0 {
+			output["next"] = link(page.Next)
+		}
+		if len(page.Prev) != 0 {
+			output["prev"] = link(page.Prev)
+		}
+		if page.Total != nil {
+			output["total"] = *page.Total
+		}
+		return c.JSON(200, output)
+	}, app.Responses.Middleware(listingCacheGroup))
 
-	Server.POST("/writ", AdminHandle(func(c ctx, user *User) error {
+	app.Server.POST("/writ", app.AdminHandle(func(c ctx, user *User) error {
 		var writ Writ
 		err := UnmarshalJSONBody(c, &writ)
 		if err != nil {
 			return BadRequestError(c)
 		}
 
-		err = InitWrit(&writ)
-		if err != nil {
-			if !driver.IsNoMoreDocuments(err) {
-				return c.JSON(503, obj{"ok": false, "error": err})
+		err = app.InitWritBy(c, user, &writ)
+		switch {
+		case err == ErrMissingTags || err == ErrIncompleteWrit || err == ErrUntrustedInjection || err == ErrAuthorIsNoUser:
+			return JSONErr(c, 400, err.Error())
+		case driver.IsNotFound(err):
+			return JSONErr(c, 404, "there's no writ with that key")
+		case err != nil && !driver.IsNoMoreDocuments(err):
+			if app.DevMode {
+				fmt.Println("POST /writ - error saving a writ: ", err)
 			}
+			return ServerDBError(c)
 		}
 
-		fmt.Println(`Baking Writs! - `, writ.Title)
-
 		return c.JSON(203, obj{"ok": true, "msg": "sucess!"})
 	}))
 
-	Server.POST("/writ/query", AdminHandle(func(c ctx, user *User) error {
+	app.Server.POST("/writ/query", app.AdminHandle(func(c ctx, user *User) error {
 		var q writQuery
 		err := UnmarshalJSONBody(c, &q)
 		if err != nil {
@@ -740,12 +894,17 @@ func initWrits() {
 
 		var output interface{}
 		if q.One {
-			output, err = q.ExecOne()
+			output, err = q.ExecOne(app)
 		} else {
-			output, err = q.Exec()
+			output, err = q.Exec(app)
 		}
-		if err != nil {
-			return c.JSON(503, obj{"ok": false, "error": err})
+		if driver.IsNoMoreDocuments(err) {
+			return JSONErr(c, 404, "no writ matches that query")
+		} else if err != nil {
+			if app.DevMode {
+				fmt.Println("POST /writ/query - error: ", err)
+			}
+			return ServerDBError(c)
 		}
 		return c.JSON(200, output)
 	}))
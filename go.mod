@@ -1,25 +1,35 @@
 module github.com/SaulDoesCode/saul.app
 
+go 1.27.1
+
 require (
 	github.com/Machiel/slugify v1.0.1
 	github.com/SaulDoesCode/mailyak v0.0.0-20181018150953-d080bea9f965
 	github.com/arangodb/go-driver v0.0.0-20180928134511-88874b717ad9
 	github.com/asaskevich/govalidator v0.0.0-20180720115003-f9ffefc3facf
-	github.com/didip/tollbooth v4.0.0+incompatible
 	github.com/driusan/dkim v0.0.0-20180129030250-78ce6f46faf4
 	github.com/integrii/flaggy v0.0.0-20181007032133-1056ce330646
 	github.com/labstack/echo v0.0.0-20180911044237-1abaa3049251
-	github.com/labstack/gommon v0.2.7 // indirect
-	github.com/mattn/go-isatty v0.0.4 // indirect
 	github.com/microcosm-cc/bluemonday v1.0.1
-	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
 	github.com/russross/blackfriday v2.0.0+incompatible
-	github.com/shurcooL/sanitized_anchor_name v0.0.0-20170918181015-86672fcb3f95 // indirect
 	github.com/tidwall/gjson v1.1.3
+	golang.org/x/crypto v0.0.0-20181015023909-0c41d7ab0a0e
+)
+
+require (
+	github.com/arangodb/go-velocypack v0.0.0-20180928134037-d177e3455691 // indirect
+	github.com/coreos/go-iptables v0.4.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/labstack/gommon v0.2.7 // indirect
+	github.com/mattn/go-colorable v0.0.9 // indirect
+	github.com/mattn/go-isatty v0.0.4 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/shurcooL/sanitized_anchor_name v0.0.0-20170918181015-86672fcb3f95 // indirect
+	github.com/stretchr/testify v1.2.2 // indirect
 	github.com/tidwall/match v0.0.0-20171002075945-1731857f09b1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	golang.org/x/crypto v0.0.0-20181015023909-0c41d7ab0a0e
+	github.com/valyala/fasttemplate v0.0.0-20170224212429-dcecefd839c4 // indirect
 	golang.org/x/net v0.0.0-20181017193950-04a2e542c03f // indirect
 	golang.org/x/sys v0.0.0-20181011152604-fa43e7bc11ba // indirect
-	golang.org/x/time v0.0.0-20180412165947-fbb02b2291d2 // indirect
 )